@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// Gencert command specific flags
+	gencertCert   string
+	gencertKey    string
+	gencertHosts  string
+	gencertName   string
+	gencertDays   int
+	gencertClient bool
+)
+
+var gencertCmd = &cobra.Command{
+	Use:   "gencert",
+	Short: "Generate a self-signed certificate for the management API",
+	Long: `Generate a self-signed ECDSA certificate and key for api.tls. Clients
+trust it by using the certificate as their CA (e.g. curl --cacert api.crt).
+
+With --client, the certificate is for a client instead: give it to the client
+and list it in api.tls.client_ca_file to require client certificates.`,
+	RunE: runGencert,
+}
+
+func init() {
+	gencertCmd.Flags().StringVar(&gencertCert, "cert", "api.crt", "Certificate file to write")
+	gencertCmd.Flags().StringVar(&gencertKey, "key", "api.key", "Private key file to write")
+	gencertCmd.Flags().StringVar(&gencertHosts, "hosts", "127.0.0.1,localhost", "Comma-separated IP addresses and host names the server certificate is valid for")
+	gencertCmd.Flags().StringVar(&gencertName, "name", "light-ss", "Certificate common name")
+	gencertCmd.Flags().IntVar(&gencertDays, "days", 365, "Days the certificate is valid")
+	gencertCmd.Flags().BoolVar(&gencertClient, "client", false, "Generate a client certificate")
+	rootCmd.AddCommand(gencertCmd)
+}
+
+func runGencert(cmd *cobra.Command, args []string) error {
+	if gencertDays <= 0 {
+		return fmt.Errorf("days must be positive")
+	}
+	for _, file := range []string{gencertCert, gencertKey} {
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("%s already exists", file)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	// Self-signed certificates act as their own CA
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: gencertName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(0, 0, gencertDays),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if gencertClient {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		for _, host := range strings.Split(gencertHosts, ",") {
+			host = strings.TrimSpace(host)
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else if host != "" {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	if err := os.WriteFile(gencertKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	if err := os.WriteFile(gencertCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		// Leave no key without its certificate, nor a partial certificate
+		os.Remove(gencertCert)
+		os.Remove(gencertKey)
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+
+	fmt.Printf("Certificate: %s\n", gencertCert)
+	fmt.Printf("Key:         %s\n", gencertKey)
+	fmt.Printf("Expires:     %s\n", template.NotAfter.Format(time.RFC3339))
+	return nil
+}
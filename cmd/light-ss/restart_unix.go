@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+)
+
+// restartProcess replaces the process with a fresh start of the same
+// executable and arguments, keeping its PID
+func restartProcess() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	slog.Info("Restarting light-ss", "executable", exe)
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		return fmt.Errorf("failed to restart: %w", err)
+	}
+	return nil
+}
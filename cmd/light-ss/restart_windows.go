@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+)
+
+// restartProcess starts a new process with the same executable and
+// arguments and lets this one exit, as Windows cannot replace a running
+// process image
+func restartProcess() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to restart: %w", err)
+	}
+
+	slog.Info("Restarted light-ss in a new process", "pid", cmd.Process.Pid)
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -11,13 +12,17 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/events"
+	"github.com/xrdavies/light-ss/internal/logging"
 	"github.com/xrdavies/light-ss/internal/mgmt"
 	"github.com/xrdavies/light-ss/internal/server"
+	"github.com/xrdavies/light-ss/internal/watch"
 )
 
 var (
 	// Config file
-	configFile string
+	configFile  string
+	watchConfig bool
 
 	// Shadowsocks server parameters
 	ssServer   string
@@ -31,15 +36,17 @@ var (
 	pluginObfs string
 	pluginHost string
 
-	// Proxy parameters
-	proxies      string
-	httpProxy    string
-	socks5Proxy  string
+	// Proxy parameters (repeatable)
+	proxies      []string
+	httpProxy    []string
+	socks5Proxy  []string
 
 	// API parameters
 	apiEnabled bool
 	apiListen  string
 	apiToken   string
+	apiTLSCert string
+	apiTLSKey  string
 
 	// Logging
 	logLevel string
@@ -55,6 +62,7 @@ var startCmd = &cobra.Command{
 func init() {
 	// Config file (optional)
 	startCmd.Flags().StringVarP(&configFile, "config", "c", "", "Path to configuration file (optional)")
+	startCmd.Flags().BoolVar(&watchConfig, "watch", false, "Reload the configuration file when it changes")
 
 	// Shadowsocks server flags
 	startCmd.Flags().StringVarP(&ssServer, "server", "s", "", "Shadowsocks server address")
@@ -69,14 +77,16 @@ func init() {
 	startCmd.Flags().StringVar(&pluginHost, "plugin-host", "", "Obfuscation host header")
 
 	// Proxy flags
-	startCmd.Flags().StringVar(&proxies, "proxies", "", "Unified proxy listen address (e.g., 127.0.0.1:1080)")
-	startCmd.Flags().StringVar(&httpProxy, "http-proxy", "", "HTTP/HTTPS proxy listen address")
-	startCmd.Flags().StringVar(&socks5Proxy, "socks5-proxy", "", "SOCKS5 proxy listen address (supports user:pass@host:port)")
+	startCmd.Flags().StringArrayVar(&proxies, "proxies", nil, "Unified proxy listen address (e.g., 127.0.0.1:1080), repeatable")
+	startCmd.Flags().StringArrayVar(&httpProxy, "http-proxy", nil, "HTTP/HTTPS proxy listen address (supports user:pass@host:port), repeatable")
+	startCmd.Flags().StringArrayVar(&socks5Proxy, "socks5-proxy", nil, "SOCKS5 proxy listen address (supports user:pass@host:port), repeatable")
 
 	// API flags
 	startCmd.Flags().BoolVar(&apiEnabled, "api-enabled", false, "Enable management API")
 	startCmd.Flags().StringVar(&apiListen, "api-listen", "", "API listen address (e.g., 127.0.0.1:8090)")
 	startCmd.Flags().StringVar(&apiToken, "api-token", "", "API bearer token (optional)")
+	startCmd.Flags().StringVar(&apiTLSCert, "api-tls-cert", "", "API TLS certificate file (serves HTTPS with --api-tls-key)")
+	startCmd.Flags().StringVar(&apiTLSKey, "api-tls-key", "", "API TLS private key file")
 
 	// Logging flags
 	startCmd.Flags().StringVar(&logLevel, "log-level", "", "Log level (debug, info, warn, error)")
@@ -110,19 +120,22 @@ func runStart(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("invalid configuration: %w", err)
 	}
 
+	// Real-time events for API subscribers, including log lines
+	bus := events.NewBus()
+
 	// Set up logging
-	if err := setupLogging(cfg.Logging); err != nil {
-		return fmt.Errorf("failed to setup logging: %w", err)
-	}
+	logging.Setup(cfg.Logging, bus)
 
 	slog.Info("Starting light-ss", "version", rootCmd.Version)
 
 	// Create and start server manager
-	mgr, err := server.NewManager(cfg)
+	mgr, err := server.NewManager(cfg, bus)
 	if err != nil {
 		return fmt.Errorf("failed to create server manager: %w", err)
 	}
 
+	mgr.SetConfigFile(configFile)
+
 	if err := mgr.Start(); err != nil {
 		return fmt.Errorf("failed to start servers: %w", err)
 	}
@@ -132,7 +145,7 @@ func runStart(cmd *cobra.Command, args []string) error {
 	// Create and start API server if enabled
 	var apiServer *mgmt.Server
 	if cfg.API.Enabled {
-		speedTest := mgmt.NewSpeedTest(mgr.GetSSClient())
+		speedTest := mgmt.NewSpeedTest(mgr.GetSSClient)
 		apiServer = mgmt.NewServer(cfg, mgr, mgr.GetCollector(), speedTest)
 
 		go func() {
@@ -144,12 +157,42 @@ func runStart(cmd *cobra.Command, args []string) error {
 		slog.Info("API server started", "address", cfg.API.Listen)
 	}
 
-	// Wait for shutdown signal
+	// Reload the config file on SIGHUP, and when it changes with --watch
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	var fileChanges <-chan struct{}
+	if watchConfig {
+		if configFile == "" {
+			slog.Warn("--watch needs a config file, not watching")
+		} else {
+			watcher := watch.File(configFile, watchDebounce)
+			defer watcher.Close()
+			fileChanges = watcher.Changes()
+			slog.Info("Watching config file for changes", "file", configFile)
+		}
+	}
+
+	// Wait for a shutdown signal, or a stop or restart request from the API
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigChan
-
-	slog.Info("Received shutdown signal", "signal", sig.String())
+	restart := false
+wait:
+	for {
+		select {
+		case sig := <-sigChan:
+			slog.Info("Received shutdown signal", "signal", sig.String())
+			break wait
+		case restart = <-mgr.ExitRequests():
+			slog.Info("Shutdown requested via API", "restart", restart)
+			break wait
+		case <-hupChan:
+			slog.Info("Received SIGHUP, reloading configuration file")
+			reloadConfigFile(mgr)
+		case <-fileChanges:
+			slog.Info("Configuration file changed, reloading", "file", configFile)
+			reloadConfigFile(mgr)
+		}
+	}
 
 	// Graceful shutdown with 30 second timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -168,9 +211,37 @@ func runStart(cmd *cobra.Command, args []string) error {
 	}
 
 	slog.Info("Shutdown complete")
+
+	if restart {
+		return restartProcess()
+	}
 	return nil
 }
 
+// watchDebounce is how long the config file must stay unchanged before it is reloaded
+const watchDebounce = 500 * time.Millisecond
+
+// reloadConfigFile loads the config file again, with the command-line flags
+// on top, and applies it. The running configuration is kept on errors.
+func reloadConfigFile(mgr *server.Manager) {
+	if configFile == "" {
+		slog.Warn("No configuration file to reload, start with -c")
+		return
+	}
+
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		slog.Error("Keeping the running configuration", "error", err)
+		return
+	}
+	applyFlags(cfg)
+
+	// ApplyConfig logs the changes and the outcome
+	if _, err := mgr.ApplyConfig(cfg, server.SourceFile); errors.Is(err, server.ErrInvalidConfig) {
+		slog.Error("Keeping the running configuration", "error", err)
+	}
+}
+
 // applyFlags applies command-line flags to the configuration
 func applyFlags(cfg *config.Config) {
 	// Shadowsocks server flags
@@ -206,24 +277,22 @@ func applyFlags(cfg *config.Config) {
 		}
 	}
 
-	// Proxy flags
-	if proxies != "" {
-		cfg.Proxies.Unified = proxies
-		// Clear separate mode if unified is specified
-		cfg.Proxies.HTTPListen = ""
-		cfg.Proxies.SOCKS5Listen = ""
-	}
-	if httpProxy != "" {
-		cfg.Proxies.HTTPListen = httpProxy
-		// Clear unified mode if separate mode is specified
-		cfg.Proxies.Unified = ""
-	}
-	if socks5Proxy != "" {
-		cfg.Proxies.SOCKS5Listen = socks5Proxy
-		// Parse auth if present
-		cfg.Proxies.SOCKS5Auth = config.ParseAuth(&cfg.Proxies.SOCKS5Listen)
-		// Clear unified mode if separate mode is specified
-		cfg.Proxies.Unified = ""
+	// Proxy flags replace the configured listeners and can be combined
+	if len(proxies)+len(httpProxy)+len(socks5Proxy) > 0 {
+		cfg.Proxies = config.ProxiesConfig{}
+		cfg.Inbounds = nil
+
+		addInbounds := func(typ string, addrs []string) {
+			for _, addr := range addrs {
+				in := config.InboundConfig{Type: typ, Listen: addr}
+				// Parse auth if present
+				in.Auth = config.ParseAuth(&in.Listen)
+				cfg.Inbounds = append(cfg.Inbounds, in)
+			}
+		}
+		addInbounds(config.InboundUnified, proxies)
+		addInbounds(config.InboundHTTP, httpProxy)
+		addInbounds(config.InboundSOCKS5, socks5Proxy)
 	}
 
 	// Logging flags
@@ -241,36 +310,11 @@ func applyFlags(cfg *config.Config) {
 	if apiToken != "" {
 		cfg.API.Token = apiToken
 	}
-}
-
-func setupLogging(cfg config.LoggingConfig) error {
-	var level slog.Level
-	switch cfg.Level {
-	case "debug":
-		level = slog.LevelDebug
-	case "info":
-		level = slog.LevelInfo
-	case "warn":
-		level = slog.LevelWarn
-	case "error":
-		level = slog.LevelError
-	default:
-		level = slog.LevelInfo
-	}
-
-	opts := &slog.HandlerOptions{
-		Level: level,
-	}
-
-	var handler slog.Handler
-	if cfg.Format == "json" {
-		handler = slog.NewJSONHandler(os.Stdout, opts)
-	} else {
-		handler = slog.NewTextHandler(os.Stdout, opts)
+	if apiTLSCert != "" || apiTLSKey != "" {
+		tls := config.APITLSConfig{CertFile: apiTLSCert, KeyFile: apiTLSKey}
+		if cfg.API.TLS != nil {
+			tls.ClientCAFile = cfg.API.TLS.ClientCAFile
+		}
+		cfg.API.TLS = &tls
 	}
-
-	logger := slog.New(handler)
-	slog.SetDefault(logger)
-
-	return nil
 }
@@ -146,7 +146,7 @@ func runTest(cmd *cobra.Command, args []string) error {
 	}
 
 	// Run speed test (with or without download test)
-	speedTest := mgmt.NewSpeedTest(ssClient)
+	speedTest := mgmt.NewSpeedTest(func() *shadowsocks.Client { return ssClient })
 	testResult, err := speedTest.Run(testDuration, testLatencyOnly)
 	if err != nil {
 		result.Error = err.Error()
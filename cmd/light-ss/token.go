@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/xrdavies/light-ss/internal/config"
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token [token]",
+	Short: "Generate an API token and its hash",
+	Long: `Generate a random management API token, or take the given one, and print
+it with the token_hash to put in api.tokens, so the config file does not
+hold the token itself.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runToken,
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+}
+
+func runToken(cmd *cobra.Command, args []string) error {
+	var token string
+	if len(args) > 0 {
+		token = args[0]
+	} else {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return fmt.Errorf("failed to generate token: %w", err)
+		}
+		token = hex.EncodeToString(buf)
+	}
+
+	fmt.Printf("token:      %s\n", token)
+	fmt.Printf("token_hash: %s\n", config.HashToken(token))
+	return nil
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -10,12 +11,18 @@ import (
 
 // Config is the main configuration structure
 type Config struct {
-	Name        string            `yaml:"name" json:"name,omitempty"`           // Optional instance name
-	Shadowsocks ShadowsocksConfig `yaml:"shadowsocks" json:"shadowsocks"`
-	Proxies     ProxiesConfig     `yaml:"proxies" json:"proxies"`
-	Stats       StatsConfig       `yaml:"stats" json:"stats"`
-	Logging     LoggingConfig     `yaml:"logging" json:"logging"`
-	API         APIConfig         `yaml:"api" json:"api"`
+	Name        string              `yaml:"name" json:"name,omitempty"` // Optional instance name
+	Shadowsocks ShadowsocksConfig   `yaml:"shadowsocks" json:"shadowsocks"`
+	Servers     []ShadowsocksConfig `yaml:"servers" json:"servers,omitempty"` // Additional named servers
+	Proxies     ProxiesConfig       `yaml:"proxies" json:"proxies"`
+	Inbounds    []InboundConfig     `yaml:"inbounds" json:"inbounds,omitempty"` // Proxy listeners with per-listener settings
+	Stats       StatsConfig         `yaml:"stats" json:"stats"`
+	Logging     LoggingConfig       `yaml:"logging" json:"logging"`
+	API         APIConfig           `yaml:"api" json:"api"`
+	PAC         PACConfig           `yaml:"pac" json:"pac"`
+	Sniffing    SniffingConfig      `yaml:"sniffing" json:"sniffing"`
+	Limits      LimitsConfig        `yaml:"limits" json:"limits"`
+	Quotas      QuotasConfig        `yaml:"quotas" json:"quotas"`
 }
 
 // ProxiesConfig can be either a string (unified mode) or an object (separate mode)
@@ -25,6 +32,10 @@ type ProxiesConfig struct {
 	HTTPListen   string
 	SOCKS5Listen string
 	SOCKS5Auth   *AuthConfig
+
+	// Client allow/deny lists applying to all of the listeners above
+	Allow []string
+	Deny  []string
 }
 
 // UnmarshalJSON handles both string and object formats for proxies
@@ -38,15 +49,21 @@ func (p *ProxiesConfig) UnmarshalJSON(data []byte) error {
 
 	// Otherwise, unmarshal as object (separate mode)
 	var obj struct {
-		HTTP   string `json:"http"`
-		SOCKS5 string `json:"socks5"`
+		Unified string   `json:"unified"`
+		HTTP    string   `json:"http"`
+		SOCKS5  string   `json:"socks5"`
+		Allow   []string `json:"allow"`
+		Deny    []string `json:"deny"`
 	}
 	if err := json.Unmarshal(data, &obj); err != nil {
 		return err
 	}
 
+	p.Unified = obj.Unified
 	p.HTTPListen = obj.HTTP
 	p.SOCKS5Listen = obj.SOCKS5
+	p.Allow = obj.Allow
+	p.Deny = obj.Deny
 
 	// Parse SOCKS5 auth if present (user:pass@host:port)
 	if p.SOCKS5Listen != "" {
@@ -67,15 +84,21 @@ func (p *ProxiesConfig) UnmarshalYAML(value *yaml.Node) error {
 
 	// Otherwise, unmarshal as object (separate mode)
 	var obj struct {
-		HTTP   string `yaml:"http"`
-		SOCKS5 string `yaml:"socks5"`
+		Unified string   `yaml:"unified"`
+		HTTP    string   `yaml:"http"`
+		SOCKS5  string   `yaml:"socks5"`
+		Allow   []string `yaml:"allow"`
+		Deny    []string `yaml:"deny"`
 	}
 	if err := value.Decode(&obj); err != nil {
 		return err
 	}
 
+	p.Unified = obj.Unified
 	p.HTTPListen = obj.HTTP
 	p.SOCKS5Listen = obj.SOCKS5
+	p.Allow = obj.Allow
+	p.Deny = obj.Deny
 
 	// Parse SOCKS5 auth if present (user:pass@host:port)
 	if p.SOCKS5Listen != "" {
@@ -87,33 +110,27 @@ func (p *ProxiesConfig) UnmarshalYAML(value *yaml.Node) error {
 
 // MarshalJSON handles marshaling back to JSON
 func (p ProxiesConfig) MarshalJSON() ([]byte, error) {
-	if p.Unified != "" {
+	if p.Unified != "" && len(p.Allow) == 0 && len(p.Deny) == 0 {
 		return json.Marshal(p.Unified)
 	}
-
-	obj := map[string]string{}
-	if p.HTTPListen != "" {
-		obj["http"] = p.HTTPListen
-	}
-	if p.SOCKS5Listen != "" {
-		// Add auth back if present
-		if p.SOCKS5Auth != nil {
-			obj["socks5"] = fmt.Sprintf("%s:%s@%s", p.SOCKS5Auth.Username, p.SOCKS5Auth.Password, p.SOCKS5Listen)
-		} else {
-			obj["socks5"] = p.SOCKS5Listen
-		}
-	}
-
-	return json.Marshal(obj)
+	return json.Marshal(p.object())
 }
 
 // MarshalYAML handles marshaling back to YAML
 func (p ProxiesConfig) MarshalYAML() (interface{}, error) {
-	if p.Unified != "" {
+	if p.Unified != "" && len(p.Allow) == 0 && len(p.Deny) == 0 {
 		return p.Unified, nil
 	}
+	return p.object(), nil
+}
 
-	obj := map[string]string{}
+// object returns the object format of the proxies, used when the string
+// format can't hold the settings
+func (p ProxiesConfig) object() map[string]interface{} {
+	obj := map[string]interface{}{}
+	if p.Unified != "" {
+		obj["unified"] = p.Unified
+	}
 	if p.HTTPListen != "" {
 		obj["http"] = p.HTTPListen
 	}
@@ -125,8 +142,13 @@ func (p ProxiesConfig) MarshalYAML() (interface{}, error) {
 			obj["socks5"] = p.SOCKS5Listen
 		}
 	}
-
-	return obj, nil
+	if len(p.Allow) > 0 {
+		obj["allow"] = p.Allow
+	}
+	if len(p.Deny) > 0 {
+		obj["deny"] = p.Deny
+	}
+	return obj
 }
 
 // ParseAuth extracts username:password from user:pass@host:port format
@@ -152,6 +174,11 @@ func parseAuth(addr *string) *AuthConfig {
 	authPart := (*addr)[:atIndex]
 	hostPart := (*addr)[atIndex+1:]
 
+	// Abstract unix sockets (unix:@name) are not credentials
+	if strings.HasPrefix(authPart, "unix:") {
+		return nil
+	}
+
 	// Split auth into username:password
 	colonIndex := strings.Index(authPart, ":")
 	if colonIndex == -1 {
@@ -172,13 +199,14 @@ func parseAuth(addr *string) *AuthConfig {
 
 // ShadowsocksConfig contains shadowsocks server configuration
 type ShadowsocksConfig struct {
-	Server   string       `yaml:"server" json:"server"`     // Server address (can be hostname or IP)
-	Port     int          `yaml:"port" json:"port"`         // Server port (optional, can be in Server field)
-	Password string       `yaml:"password" json:"password"` // Server password
-	Cipher   string       `yaml:"cipher" json:"cipher,omitempty"` // Encryption cipher (method)
-	Method   string       `yaml:"method" json:"method,omitempty"` // Alternative name for cipher
-	Timeout  int          `yaml:"timeout" json:"timeout,omitempty"` // Connection timeout in seconds
-	Plugin   string       `yaml:"plugin" json:"plugin,omitempty"` // Plugin name (e.g., "simple-obfs")
+	Name       string      `yaml:"name" json:"name,omitempty"`               // Server name, referenced by inbounds (only for servers list)
+	Server     string      `yaml:"server" json:"server"`                     // Server address (can be hostname or IP)
+	Port       int         `yaml:"port" json:"port"`                         // Server port (optional, can be in Server field)
+	Password   string      `yaml:"password" json:"password"`                 // Server password
+	Cipher     string      `yaml:"cipher" json:"cipher,omitempty"`           // Encryption cipher (method)
+	Method     string      `yaml:"method" json:"method,omitempty"`           // Alternative name for cipher
+	Timeout    int         `yaml:"timeout" json:"timeout,omitempty"`         // Connection timeout in seconds
+	Plugin     string      `yaml:"plugin" json:"plugin,omitempty"`           // Plugin name (e.g., "simple-obfs")
 	PluginOpts *PluginOpts `yaml:"plugin_opts" json:"plugin_opts,omitempty"` // Plugin options
 }
 
@@ -196,8 +224,9 @@ type AuthConfig struct {
 
 // StatsConfig contains statistics and monitoring configuration
 type StatsConfig struct {
-	Enabled  bool `yaml:"enabled" json:"enabled"`   // Enable statistics collection
-	Interval int  `yaml:"interval" json:"interval"` // Report interval in seconds
+	Enabled     bool   `yaml:"enabled" json:"enabled"`           // Enable statistics collection
+	Interval    int    `yaml:"interval" json:"interval"`         // Report interval in seconds
+	HistoryFile string `yaml:"history_file" json:"history_file"` // File keeping traffic history across restarts
 }
 
 // LoggingConfig contains logging configuration
@@ -206,49 +235,108 @@ type LoggingConfig struct {
 	Format string `yaml:"format" json:"format"` // Log format: json, text
 }
 
+// DefaultRevisions is how many applied configurations are kept for rollback by default
+const DefaultRevisions = 10
+
 // APIConfig contains management API configuration
 type APIConfig struct {
-	Enabled bool   `yaml:"enabled" json:"enabled"`             // Enable management API
-	Listen  string `yaml:"listen" json:"listen"`               // Listen address (e.g., "127.0.0.1:8090")
-	Token   string `yaml:"token" json:"token,omitempty"`       // Optional bearer token for authentication
+	Enabled bool   `yaml:"enabled" json:"enabled"`       // Enable management API
+	Listen  string `yaml:"listen" json:"listen"`         // Listen address (e.g., "127.0.0.1:8090")
+	Token   string `yaml:"token" json:"token,omitempty"` // Optional bearer token with every scope
+
+	Tokens []APITokenConfig `yaml:"tokens" json:"tokens,omitempty"` // Named tokens with scopes
+	TLS    *APITLSConfig    `yaml:"tls" json:"tls,omitempty"`       // Serve HTTPS instead of HTTP
+
+	AllowedOrigins []string `yaml:"allowed_origins" json:"allowed_origins,omitempty"` // Other web origins (scheme://host[:port]) whose pages may open /events/ws
+
+	WriteBack bool `yaml:"write_back" json:"write_back,omitempty"` // Save configuration changes made through the API to the config file
+	Backups   int  `yaml:"backups" json:"backups,omitempty"`       // Previous config files kept by write-back (default 3)
+	Revisions int  `yaml:"revisions" json:"revisions,omitempty"`   // Applied configurations kept for rollback (default 10)
+}
+
+// APITLSConfig contains the management API certificate, reloaded when its files change
+type APITLSConfig struct {
+	CertFile     string `yaml:"cert_file" json:"cert_file"`                     // PEM certificate, followed by any intermediates
+	KeyFile      string `yaml:"key_file" json:"key_file"`                       // PEM private key
+	ClientCAFile string `yaml:"client_ca_file" json:"client_ca_file,omitempty"` // PEM CA bundle; clients need a certificate signed by one of them
+}
+
+// PACConfig contains proxy auto-config (PAC/WPAD) settings
+type PACConfig struct {
+	Enabled bool     `yaml:"enabled" json:"enabled"`         // Serve /proxy.pac and /wpad.dat
+	Direct  []string `yaml:"direct" json:"direct,omitempty"` // Domains, wildcards, IPs or CIDRs that bypass the proxy
+}
+
+// SniffingConfig contains protocol sniffing settings for SOCKS5 requests with IP targets
+type SniffingConfig struct {
+	Enabled     bool     `yaml:"enabled" json:"enabled"`                     // Replace IP targets with the sniffed TLS SNI / HTTP Host
+	SkipDomains []string `yaml:"skip_domains" json:"skip_domains,omitempty"` // Sniffed domains (and subdomains) that keep the IP target
+}
+
+// LimitsConfig contains connection limits applied to all proxy listeners (0 = unlimited)
+type LimitsConfig struct {
+	MaxConnections      int `yaml:"max_connections" json:"max_connections,omitempty"`               // Concurrent client connections
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip" json:"max_connections_per_ip,omitempty"` // Concurrent client connections per IP
+	IdleTimeout         int `yaml:"idle_timeout" json:"idle_timeout,omitempty"`                     // Close connections without traffic after N seconds
+	MaxLifetime         int `yaml:"max_lifetime" json:"max_lifetime,omitempty"`                     // Close connections after N seconds
+
+	RateLimitConfig `yaml:",inline"`           // Bandwidth shared by all connections
+	Users           map[string]RateLimitConfig `yaml:"users" json:"users,omitempty"` // Bandwidth per authenticated username
 }
 
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
-	// Handle server and port
-	if c.Shadowsocks.Server == "" {
-		return ErrMissingServer
+	// The top-level shadowsocks block is the default server
+	if err := c.Shadowsocks.validate(); err != nil {
+		return err
 	}
 
-	// If port is specified separately, combine it with server
-	if c.Shadowsocks.Port > 0 {
-		// Check if server already has a port
-		if !strings.Contains(c.Shadowsocks.Server, ":") {
-			c.Shadowsocks.Server = fmt.Sprintf("%s:%d", c.Shadowsocks.Server, c.Shadowsocks.Port)
+	// Validate additional named servers
+	names := map[string]bool{DefaultServerName: true}
+	for i := range c.Servers {
+		srv := &c.Servers[i]
+		if srv.Name == "" {
+			return fmt.Errorf("servers[%d]: name is required", i)
+		}
+		if names[srv.Name] {
+			return fmt.Errorf("servers[%d]: duplicate server name %q", i, srv.Name)
+		}
+		names[srv.Name] = true
+		if err := srv.validate(); err != nil {
+			return fmt.Errorf("server %q: %w", srv.Name, err)
 		}
 	}
 
-	if c.Shadowsocks.Password == "" {
-		return ErrMissingPassword
+	// Set defaults for proxies if not specified
+	if c.Proxies.Unified == "" && c.Proxies.HTTPListen == "" && c.Proxies.SOCKS5Listen == "" && len(c.Inbounds) == 0 {
+		// If no proxy configuration specified, enable unified mode by default
+		c.Proxies.Unified = "127.0.0.1:1080"
 	}
 
-	// Support "method" as alias for "cipher" (common in SS configs)
-	if c.Shadowsocks.Method != "" && c.Shadowsocks.Cipher == "" {
-		c.Shadowsocks.Cipher = c.Shadowsocks.Method
+	if err := c.validateInbounds(names); err != nil {
+		return err
 	}
 
-	if c.Shadowsocks.Cipher == "" {
-		c.Shadowsocks.Cipher = "AEAD_CHACHA20_POLY1305" // Default cipher
+	if c.Limits.MaxConnections < 0 || c.Limits.MaxConnectionsPerIP < 0 || c.Limits.IdleTimeout < 0 || c.Limits.MaxLifetime < 0 {
+		return fmt.Errorf("limits must not be negative")
 	}
 
-	if c.Shadowsocks.Timeout == 0 {
-		c.Shadowsocks.Timeout = 300 // Default 5 minutes
+	if err := c.validateQuotas(names); err != nil {
+		return err
 	}
 
-	// Set defaults for proxies if not specified
-	if c.Proxies.Unified == "" && c.Proxies.HTTPListen == "" && c.Proxies.SOCKS5Listen == "" {
-		// If no proxy configuration specified, enable unified mode by default
-		c.Proxies.Unified = "127.0.0.1:1080"
+	if err := c.validateTokens(); err != nil {
+		return err
+	}
+
+	if tls := c.API.TLS; tls != nil && (tls.CertFile == "" || tls.KeyFile == "") {
+		return fmt.Errorf("api.tls: cert_file and key_file are required")
+	}
+	for _, origin := range c.API.AllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("api.allowed_origins: %q is not an origin like https://example.com", origin)
+		}
 	}
 
 	// Set defaults for logging
@@ -268,6 +356,66 @@ func (c *Config) Validate() error {
 	if c.API.Listen == "" && c.API.Enabled {
 		c.API.Listen = "127.0.0.1:8090"
 	}
+	if c.API.WriteBack && c.API.Backups == 0 {
+		c.API.Backups = DefaultBackups
+	}
+	if c.API.Revisions == 0 {
+		c.API.Revisions = DefaultRevisions
+	}
+
+	return nil
+}
+
+// validate checks a server configuration and fills in defaults
+func (s *ShadowsocksConfig) validate() error {
+	// Handle server and port
+	if s.Server == "" {
+		return ErrMissingServer
+	}
+
+	// If port is specified separately, combine it with server
+	if s.Port > 0 {
+		// Check if server already has a port
+		if !strings.Contains(s.Server, ":") {
+			s.Server = fmt.Sprintf("%s:%d", s.Server, s.Port)
+		}
+	}
+
+	if s.Password == "" {
+		return ErrMissingPassword
+	}
+
+	// Support "method" as alias for "cipher" (common in SS configs);
+	// cleared so that only the cipher is compared and written back
+	if s.Method != "" && s.Cipher == "" {
+		s.Cipher = s.Method
+	}
+	s.Method = ""
+
+	if s.Cipher == "" {
+		s.Cipher = "AEAD_CHACHA20_POLY1305" // Default cipher
+	}
+
+	// Normalize cipher names (support both formats)
+	normalizeCipherName(s)
+
+	if s.Timeout == 0 {
+		s.Timeout = 300 // Default 5 minutes
+	}
 
 	return nil
 }
+
+// Server returns the server configuration with the given name.
+// The empty name and "default" refer to the top-level shadowsocks block.
+func (c *Config) Server(name string) (ShadowsocksConfig, bool) {
+	if name == "" || name == DefaultServerName {
+		return c.Shadowsocks, true
+	}
+	for _, srv := range c.Servers {
+		if srv.Name == name {
+			return srv, true
+		}
+	}
+	return ShadowsocksConfig{}, false
+}
@@ -0,0 +1,302 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// secretKeys are settings whose values are masked in changes
+var secretKeys = map[string]bool{"password": true, "token": true}
+
+// Change is a setting that differs between two configurations
+type Change struct {
+	Path string `json:"path"`          // Dotted path, e.g. servers.us.server or inbounds.socks5.listen
+	Old  string `json:"old,omitempty"` // Previous value, empty if the setting was added
+	New  string `json:"new,omitempty"` // New value, empty if the setting was removed
+}
+
+// Section returns the top-level configuration key of the change
+func (c Change) Section() string {
+	section, _, _ := strings.Cut(c.Path, ".")
+	return section
+}
+
+// String describes the change for logs
+func (c Change) String() string {
+	switch {
+	case c.Old == "":
+		return c.Path + " added"
+	case c.New == "":
+		return c.Path + " removed"
+	default:
+		return fmt.Sprintf("%s: %s -> %s", c.Path, c.Old, c.New)
+	}
+}
+
+// Diff lists the settings that differ between two configurations, with
+// passwords and tokens masked. Listeners from the legacy proxies setting are
+// compared as inbounds, and servers and inbounds are matched by name and tag.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	diffValue("", reflect.ValueOf(inboundView(old)), reflect.ValueOf(inboundView(new)), &changes)
+	return changes
+}
+
+// inboundView returns a copy of cfg with the proxies setting folded into inbounds
+func inboundView(cfg *Config) Config {
+	view := *cfg
+	view.Inbounds = cfg.AllInbounds()
+	view.Proxies = ProxiesConfig{}
+	return view
+}
+
+// diffValue appends the differences between a and b, found at path
+func diffValue(path string, a, b reflect.Value, changes *[]Change) {
+	switch a.Kind() {
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			name, inline := fieldName(field)
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			fieldPath := path
+			if !inline {
+				fieldPath = joinPath(path, name)
+			}
+			diffValue(fieldPath, a.Field(i), b.Field(i), changes)
+		}
+
+	case reflect.Pointer:
+		switch {
+		case a.IsNil() && b.IsNil():
+		case a.Type().Elem().Kind() == reflect.Struct && (a.IsNil() || b.IsNil()):
+			addPresence(path, !a.IsNil(), !b.IsNil(), changes)
+		case a.IsNil() || b.IsNil():
+			addLeaf(path, a, b, changes)
+		default:
+			diffValue(path, a.Elem(), b.Elem(), changes)
+		}
+
+	case reflect.Map:
+		keys := map[string]reflect.Value{}
+		for _, k := range a.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for _, k := range b.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for _, name := range sortedKeys(keys) {
+			k := keys[name]
+			av, bv := a.MapIndex(k), b.MapIndex(k)
+			if av.IsValid() && bv.IsValid() {
+				diffValue(joinPath(path, name), av, bv, changes)
+			} else {
+				addPresence(joinPath(path, name), av.IsValid(), bv.IsValid(), changes)
+			}
+		}
+
+	case reflect.Slice:
+		if key := itemKey(a.Type().Elem()); key >= 0 {
+			diffItems(path, key, a, b, changes)
+			return
+		}
+		if a.Len() == 0 && b.Len() == 0 {
+			return
+		}
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			addLeaf(path, a, b, changes)
+		}
+
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			addLeaf(path, a, b, changes)
+		}
+	}
+}
+
+// diffItems compares slices of named items (servers, inbounds) by name
+func diffItems(path string, key int, a, b reflect.Value, changes *[]Change) {
+	index := func(s reflect.Value) ([]string, map[string]reflect.Value) {
+		var names []string
+		items := make(map[string]reflect.Value)
+		for i := 0; i < s.Len(); i++ {
+			name := s.Index(i).Field(key).String()
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			names = append(names, name)
+			items[name] = s.Index(i)
+		}
+		return names, items
+	}
+	oldNames, oldItems := index(a)
+	newNames, newItems := index(b)
+
+	for _, name := range oldNames {
+		if item, ok := newItems[name]; ok {
+			diffValue(joinPath(path, name), oldItems[name], item, changes)
+		} else {
+			addPresence(joinPath(path, name), true, false, changes)
+		}
+	}
+	for _, name := range newNames {
+		if _, ok := oldItems[name]; !ok {
+			addPresence(joinPath(path, name), false, true, changes)
+		}
+	}
+}
+
+// itemKey returns the index of the name or tag field of a struct type, or -1
+func itemKey(t reflect.Type) int {
+	if t.Kind() != reflect.Struct {
+		return -1
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if name, _ := fieldName(t.Field(i)); name == "name" || name == "tag" {
+			return i
+		}
+	}
+	return -1
+}
+
+// addPresence records a setting that was added or removed
+func addPresence(path string, inOld, inNew bool, changes *[]Change) {
+	change := Change{Path: path}
+	if inOld {
+		change.Old = "set"
+	}
+	if inNew {
+		change.New = "set"
+	}
+	*changes = append(*changes, change)
+}
+
+// addLeaf records a changed value
+func addLeaf(path string, a, b reflect.Value, changes *[]Change) {
+	secret := secretKeys[lastKey(path)]
+	*changes = append(*changes, Change{
+		Path: path,
+		Old:  formatValue(a, secret),
+		New:  formatValue(b, secret),
+	})
+}
+
+// formatValue formats a setting for a change, never returning ""
+func formatValue(v reflect.Value, secret bool) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return "unset"
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.String {
+		if secret && v.String() != "" {
+			return "***"
+		}
+		return strconv.Quote(v.String())
+	}
+	if v.Kind() == reflect.Slice && v.Len() == 0 {
+		return "[]"
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// fieldName returns the YAML key of a struct field and whether it is inlined
+func fieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("yaml")
+	name, opts, _ := strings.Cut(tag, ",")
+	if strings.Contains(opts, "inline") {
+		return "", true
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, false
+}
+
+// joinPath appends a key to a dotted path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// lastKey returns the last key of a dotted path
+func lastKey(path string) string {
+	return path[strings.LastIndex(path, ".")+1:]
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]reflect.Value) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Clone returns a deep copy of the configuration
+func (c *Config) Clone() (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy configuration: %w", err)
+	}
+	var clone Config
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, fmt.Errorf("failed to copy configuration: %w", err)
+	}
+	return &clone, nil
+}
+
+// Sanitized returns a copy of the configuration with passwords and tokens
+// replaced by "***", including credentials in listen addresses
+func (c *Config) Sanitized() (*Config, error) {
+	clone, err := c.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	mask := func(secret *string) {
+		if *secret != "" {
+			*secret = "***"
+		}
+	}
+	mask(&clone.Shadowsocks.Password)
+	for i := range clone.Servers {
+		mask(&clone.Servers[i].Password)
+	}
+	mask(&clone.API.Token)
+	for i := range clone.API.Tokens {
+		mask(&clone.API.Tokens[i].Token)
+	}
+
+	clone.Proxies.Unified = maskListen(clone.Proxies.Unified)
+	clone.Proxies.HTTPListen = maskListen(clone.Proxies.HTTPListen)
+	if clone.Proxies.SOCKS5Auth != nil {
+		mask(&clone.Proxies.SOCKS5Auth.Password)
+	}
+	for i := range clone.Inbounds {
+		in := &clone.Inbounds[i]
+		in.Listen = maskListen(in.Listen)
+		if in.Auth != nil {
+			mask(&in.Auth.Password)
+		}
+	}
+	return clone, nil
+}
+
+// maskListen masks the password of a user:pass@host:port listen address
+func maskListen(listen string) string {
+	host := listen
+	if auth := parseAuth(&host); auth != nil {
+		return auth.Username + ":***@" + host
+	}
+	return listen
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/xrdavies/light-ss/internal/listener"
+)
+
+// DefaultServerName refers to the top-level shadowsocks server
+const DefaultServerName = "default"
+
+// Inbound types
+const (
+	InboundUnified = "unified" // HTTP/HTTPS and SOCKS5 on one port
+	InboundHTTP    = "http"    // HTTP/HTTPS proxy
+	InboundSOCKS5  = "socks5"  // SOCKS5 proxy
+	InboundTunnel  = "tunnel"  // Forwards every connection to a fixed target
+)
+
+// InboundConfig describes a proxy listener and its per-listener settings
+type InboundConfig struct {
+	Tag      string      `yaml:"tag" json:"tag,omitempty"`           // Routing tag used in logs and stats (defaults to the type)
+	Type     string      `yaml:"type" json:"type"`                   // unified, http, socks5 or tunnel
+	Listen   string      `yaml:"listen" json:"listen"`               // Listen address (supports user:pass@host:port)
+	Auth     *AuthConfig `yaml:"auth" json:"auth,omitempty"`         // Optional credentials (HTTP basic / SOCKS5 user/pass)
+	Server   string      `yaml:"server" json:"server,omitempty"`     // Upstream server name from servers (default server if empty)
+	Target   string      `yaml:"target" json:"target,omitempty"`     // Destination host:port (tunnel only)
+	Sniffing *bool       `yaml:"sniffing" json:"sniffing,omitempty"` // Overrides sniffing.enabled for this listener
+
+	ProxyProtocol  bool     `yaml:"proxy_protocol" json:"proxy_protocol,omitempty"`   // Expect a PROXY protocol v1/v2 header on every connection
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies,omitempty"` // Balancer CIDRs/IPs allowed to send PROXY headers (required with proxy_protocol)
+	Allow          []string `yaml:"allow" json:"allow,omitempty"`                     // Client CIDRs/IPs allowed to connect (all if empty)
+	Deny           []string `yaml:"deny" json:"deny,omitempty"`                       // Client CIDRs/IPs rejected, checked before allow
+
+	RateLimitConfig `yaml:",inline"` // Bandwidth shared by all connections of this listener
+}
+
+// SniffingEnabled reports whether protocol sniffing applies to this inbound
+func (in InboundConfig) SniffingEnabled(global SniffingConfig) bool {
+	if in.Sniffing != nil {
+		return *in.Sniffing
+	}
+	return global.Enabled
+}
+
+// AllInbounds returns the listeners from the legacy proxies setting followed
+// by the inbounds list, with auth parsed from listen addresses and tags filled in
+func (c *Config) AllInbounds() []InboundConfig {
+	var all []InboundConfig
+
+	allow, deny := c.Proxies.Allow, c.Proxies.Deny
+	if c.Proxies.Unified != "" {
+		all = append(all, InboundConfig{Type: InboundUnified, Listen: c.Proxies.Unified, Allow: allow, Deny: deny})
+	}
+	if c.Proxies.HTTPListen != "" {
+		all = append(all, InboundConfig{Type: InboundHTTP, Listen: c.Proxies.HTTPListen, Allow: allow, Deny: deny})
+	}
+	if c.Proxies.SOCKS5Listen != "" {
+		all = append(all, InboundConfig{Type: InboundSOCKS5, Listen: c.Proxies.SOCKS5Listen, Auth: c.Proxies.SOCKS5Auth, Allow: allow, Deny: deny})
+	}
+
+	for _, in := range c.Inbounds {
+		if in.Auth == nil {
+			in.Auth = parseAuth(&in.Listen)
+		}
+		all = append(all, in)
+	}
+
+	// Default tags: the type, or type-N when a type is used more than once
+	counts := map[string]int{}
+	for _, in := range all {
+		if in.Tag == "" {
+			counts[in.Type]++
+		}
+	}
+	seen := map[string]int{}
+	for i := range all {
+		if all[i].Tag != "" {
+			continue
+		}
+		typ := all[i].Type
+		seen[typ]++
+		if counts[typ] > 1 {
+			all[i].Tag = fmt.Sprintf("%s-%d", typ, seen[typ])
+		} else {
+			all[i].Tag = typ
+		}
+	}
+
+	return all
+}
+
+// validateInbounds checks the listener list against the known server names
+func (c *Config) validateInbounds(servers map[string]bool) error {
+	tags := map[string]bool{}
+	listens := map[string]bool{}
+
+	for _, in := range c.AllInbounds() {
+		switch in.Type {
+		case InboundUnified, InboundHTTP, InboundSOCKS5:
+		case InboundTunnel:
+			if in.Target == "" {
+				return fmt.Errorf("inbound %q: tunnel requires a target", in.Tag)
+			}
+		default:
+			return fmt.Errorf("inbound %q: unknown type %q (supported: unified, http, socks5, tunnel)", in.Tag, in.Type)
+		}
+
+		if in.Listen == "" {
+			return fmt.Errorf("inbound %q: listen address is required", in.Tag)
+		}
+		if tags[in.Tag] {
+			return fmt.Errorf("inbound %q: duplicate tag", in.Tag)
+		}
+		tags[in.Tag] = true
+		if listens[in.Listen] {
+			return fmt.Errorf("inbound %q: listen address %s is already used", in.Tag, in.Listen)
+		}
+		listens[in.Listen] = true
+
+		if in.Server != "" && !servers[in.Server] {
+			return fmt.Errorf("inbound %q: unknown server %q", in.Tag, in.Server)
+		}
+
+		if _, err := listener.NewACL(in.Allow, in.Deny); err != nil {
+			return fmt.Errorf("inbound %q: %w", in.Tag, err)
+		}
+
+		// Without a trusted list any client could spoof its address
+		switch {
+		case in.ProxyProtocol && len(in.TrustedProxies) == 0:
+			return fmt.Errorf("inbound %q: proxy_protocol requires trusted_proxies", in.Tag)
+		case !in.ProxyProtocol && len(in.TrustedProxies) > 0:
+			return fmt.Errorf("inbound %q: trusted_proxies requires proxy_protocol", in.Tag)
+		}
+		if _, err := listener.NewACL(in.TrustedProxies, nil); err != nil {
+			return fmt.Errorf("inbound %q: trusted_proxies: %w", in.Tag, err)
+		}
+	}
+
+	if len(tags) == 0 {
+		return ErrNoProxyEnabled
+	}
+
+	return nil
+}
@@ -51,14 +51,11 @@ func LoadConfig(path string) (*Config, error) {
 	// Apply environment variable overrides
 	applyEnvOverrides(&cfg)
 
-	// Validate configuration first (this handles method->cipher conversion)
+	// Validate configuration (this handles method->cipher conversion and cipher names)
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
-	// Normalize cipher names (support both formats)
-	normalizeCipherName(&cfg)
-
 	return &cfg, nil
 }
 
@@ -86,8 +83,8 @@ func applyEnvOverrides(cfg *Config) {
 
 // normalizeCipherName converts cipher names to the format expected by go-shadowsocks2
 // Supports both formats: "aes-128-gcm" and "AEAD_AES_128_GCM"
-func normalizeCipherName(cfg *Config) {
-	cipher := strings.ToUpper(cfg.Shadowsocks.Cipher)
+func normalizeCipherName(cfg *ShadowsocksConfig) {
+	cipher := strings.ToUpper(cfg.Cipher)
 
 	// Map of common cipher names to go-shadowsocks2 format
 	cipherMap := map[string]string{
@@ -104,18 +101,18 @@ func normalizeCipherName(cfg *Config) {
 
 	// Check if already in correct format
 	if strings.HasPrefix(normalized, "AEAD_") {
-		cfg.Shadowsocks.Cipher = normalized
+		cfg.Cipher = normalized
 		return
 	}
 
 	// Check cipher map
 	if mapped, ok := cipherMap[cipher]; ok {
-		cfg.Shadowsocks.Cipher = mapped
+		cfg.Cipher = mapped
 		return
 	}
 
 	// Try adding AEAD_ prefix
 	if !strings.HasPrefix(normalized, "AEAD_") {
-		cfg.Shadowsocks.Cipher = "AEAD_" + normalized
+		cfg.Cipher = "AEAD_" + normalized
 	}
 }
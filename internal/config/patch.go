@@ -0,0 +1,61 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Patch returns a copy of the configuration with a JSON merge patch (RFC 7386)
+// applied to its JSON form: objects are merged key by key, null removes a
+// key, and any other value, including arrays such as servers and inbounds,
+// replaces it. Unknown keys are an error. The result is not validated.
+func (c *Config) Patch(patch []byte) (*Config, error) {
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %w", err)
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to patch configuration: %w", err)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to patch configuration: %w", err)
+	}
+
+	data, err = json.Marshal(mergePatch(doc, p))
+	if err != nil {
+		return nil, fmt.Errorf("failed to patch configuration: %w", err)
+	}
+
+	var next Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&next); err != nil {
+		return nil, fmt.Errorf("invalid configuration after patch: %w", err)
+	}
+	return &next, nil
+}
+
+// mergePatch applies a decoded merge patch to a decoded JSON document
+func mergePatch(doc, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = make(map[string]interface{})
+	}
+	for key, value := range fields {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		target[key] = mergePatch(target[key], value)
+	}
+	return target
+}
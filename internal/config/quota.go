@@ -0,0 +1,70 @@
+package config
+
+import "fmt"
+
+// Quota actions taken once a quota is used up
+const (
+	QuotaBlock  = "block"  // Refuse new connections
+	QuotaSwitch = "switch" // Send new connections through switch_to
+	QuotaWarn   = "warn"   // Log and report only
+)
+
+// QuotasConfig limits the traffic per upstream server and per proxy user
+type QuotasConfig struct {
+	StateFile string                 `yaml:"state_file" json:"state_file,omitempty"` // Usage is saved here to survive restarts
+	Servers   map[string]QuotaConfig `yaml:"servers" json:"servers,omitempty"`       // By server name (default for the top-level server)
+	Users     map[string]QuotaConfig `yaml:"users" json:"users,omitempty"`           // By authenticated username
+}
+
+// QuotaConfig is a traffic quota (upload plus download) of a server or user
+type QuotaConfig struct {
+	Daily    ByteSize `yaml:"daily" json:"daily,omitempty"`         // Bytes per calendar day (0 = unlimited)
+	Monthly  ByteSize `yaml:"monthly" json:"monthly,omitempty"`     // Bytes per calendar month (0 = unlimited)
+	Action   string   `yaml:"action" json:"action,omitempty"`       // block (default), switch or warn
+	SwitchTo string   `yaml:"switch_to" json:"switch_to,omitempty"` // Server used by the switch action
+}
+
+// Enabled reports whether any quota is configured
+func (q QuotasConfig) Enabled() bool {
+	return len(q.Servers) > 0 || len(q.Users) > 0
+}
+
+// validateQuotas checks quota actions and server references against the known server names
+func (c *Config) validateQuotas(servers map[string]bool) error {
+	for name, q := range c.Quotas.Servers {
+		if !servers[name] {
+			return fmt.Errorf("quotas.servers: unknown server %q", name)
+		}
+		if err := q.validate(servers); err != nil {
+			return fmt.Errorf("quotas.servers.%s: %w", name, err)
+		}
+		c.Quotas.Servers[name] = q
+	}
+	for name, q := range c.Quotas.Users {
+		if err := q.validate(servers); err != nil {
+			return fmt.Errorf("quotas.users.%s: %w", name, err)
+		}
+		c.Quotas.Users[name] = q
+	}
+	return nil
+}
+
+// validate checks a quota and sets the default action
+func (q *QuotaConfig) validate(servers map[string]bool) error {
+	if q.Action == "" {
+		q.Action = QuotaBlock
+	}
+	switch q.Action {
+	case QuotaBlock, QuotaWarn:
+	case QuotaSwitch:
+		if q.SwitchTo == "" {
+			return fmt.Errorf("switch_to is required for action switch")
+		}
+		if !servers[q.SwitchTo] {
+			return fmt.Errorf("unknown switch_to server %q", q.SwitchTo)
+		}
+	default:
+		return fmt.Errorf("unknown action %q (want block, switch or warn)", q.Action)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xrdavies/light-ss/internal/ratelimit"
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a number of bytes. It accepts plain numbers or sizes with a
+// unit suffix such as "512KB" or "10GB" (powers of 1024).
+type ByteSize int64
+
+// byteUnits maps size suffixes to multipliers, longest suffixes first
+var byteUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as "1048576", "1024KB" or "1MB"
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	mult := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size: %q", s)
+	}
+	return ByteSize(n * float64(mult)), nil
+}
+
+// UnmarshalYAML accepts numbers and strings with units
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// UnmarshalJSON accepts numbers and strings with units
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	size, err := ParseByteSize(jsonScalar(data))
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// ByteRate is a rate in bytes per second, written like a ByteSize with an
+// optional "/s" suffix
+type ByteRate int64
+
+// ParseByteRate parses a byte rate such as "1048576", "1024KB" or "1MB/s"
+func ParseByteRate(s string) (ByteRate, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(strings.ToUpper(s)), "/S")
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte rate: %q", s)
+	}
+	return ByteRate(size), nil
+}
+
+// UnmarshalYAML accepts numbers and strings with units
+func (r *ByteRate) UnmarshalYAML(value *yaml.Node) error {
+	rate, err := ParseByteRate(value.Value)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// UnmarshalJSON accepts numbers and strings with units
+func (r *ByteRate) UnmarshalJSON(data []byte) error {
+	rate, err := ParseByteRate(jsonScalar(data))
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// jsonScalar returns a JSON string's contents or the raw text of a number
+func jsonScalar(data []byte) string {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return string(data)
+	}
+	return s
+}
+
+// RateLimitConfig caps upload (client to target) and download (target to
+// client) bandwidth in bytes per second (0 = unlimited)
+type RateLimitConfig struct {
+	UploadRate   ByteRate `yaml:"upload_rate" json:"upload_rate,omitempty"`
+	DownloadRate ByteRate `yaml:"download_rate" json:"download_rate,omitempty"`
+}
+
+// Limit converts the configured rates to bucket rates
+func (r RateLimitConfig) Limit() ratelimit.Limit {
+	return ratelimit.Limit{
+		UploadRate:   int64(r.UploadRate),
+		DownloadRate: int64(r.DownloadRate),
+	}
+}
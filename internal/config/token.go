@@ -0,0 +1,130 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// API token scopes
+const (
+	ScopeStatsRead   = "stats:read"   // Statistics, servers, connections, limits, quotas, metrics and events
+	ScopeConfigRead  = "config:read"  // Configuration and its revisions
+	ScopeSpeedTest   = "speedtest"    // Speed tests
+	ScopeConfigWrite = "config:write" // Reloads, server selection, limits and closing connections
+	ScopeLifecycle   = "lifecycle"    // Stop, restart and drain
+	ScopeAll         = "*"            // Every scope
+)
+
+// Scopes lists the API token scopes, except ScopeAll
+var Scopes = []string{ScopeStatsRead, ScopeConfigRead, ScopeSpeedTest, ScopeConfigWrite, ScopeLifecycle}
+
+// tokenHashPrefix starts a token_hash, the only supported hash being SHA-256
+const tokenHashPrefix = "sha256:"
+
+// APITokenConfig is a named management API token limited to some scopes.
+// The token is given in the config, as a hash, or in a file.
+type APITokenConfig struct {
+	Name      string   `yaml:"name" json:"name"`                       // Shown in audit logs
+	Token     string   `yaml:"token" json:"token,omitempty"`           // Bearer token
+	TokenHash string   `yaml:"token_hash" json:"token_hash,omitempty"` // sha256:<hex> of the token
+	TokenFile string   `yaml:"token_file" json:"token_file,omitempty"` // File holding the token, read again when it changes
+	Scopes    []string `yaml:"scopes" json:"scopes"`                   // Granted scopes, or * for all
+}
+
+// HashToken returns the token_hash of a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return tokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Digest returns the SHA-256 digest of the token, reading token_file if set
+func (t APITokenConfig) Digest() ([]byte, error) {
+	switch {
+	case t.Token != "":
+		sum := sha256.Sum256([]byte(t.Token))
+		return sum[:], nil
+
+	case t.TokenHash != "":
+		hash, ok := strings.CutPrefix(t.TokenHash, tokenHashPrefix)
+		if !ok {
+			return nil, fmt.Errorf("token_hash must start with %q", tokenHashPrefix)
+		}
+		digest, err := hex.DecodeString(hash)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("token_hash is not a hex SHA-256 hash")
+		}
+		return digest, nil
+
+	default:
+		data, err := os.ReadFile(t.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token_file: %w", err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return nil, fmt.Errorf("token_file %s is empty", t.TokenFile)
+		}
+		sum := sha256.Sum256([]byte(token))
+		return sum[:], nil
+	}
+}
+
+// HasScope reports whether the token grants scope
+func (t APITokenConfig) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTokens checks the named API tokens
+func (c *Config) validateTokens() error {
+	names := make(map[string]bool)
+	for i, t := range c.API.Tokens {
+		if t.Name == "" {
+			return fmt.Errorf("api.tokens[%d]: name is required", i)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("api.tokens[%d]: duplicate token name %q", i, t.Name)
+		}
+		names[t.Name] = true
+
+		set := 0
+		for _, v := range []string{t.Token, t.TokenHash, t.TokenFile} {
+			if v != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("api token %q: exactly one of token, token_hash and token_file is required", t.Name)
+		}
+		if _, err := t.Digest(); err != nil {
+			return fmt.Errorf("api token %q: %w", t.Name, err)
+		}
+
+		if len(t.Scopes) == 0 {
+			return fmt.Errorf("api token %q: scopes are required", t.Name)
+		}
+		for _, scope := range t.Scopes {
+			if scope != ScopeAll && !contains(Scopes, scope) {
+				return fmt.Errorf("api token %q: unknown scope %q (want %s or *)", t.Name, scope, strings.Join(Scopes, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// contains reports whether list includes s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,357 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/xrdavies/light-ss/internal/atomicfile"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultBackups is how many previous versions write-back keeps by default
+const DefaultBackups = 3
+
+// WriteBack saves the changes from base to next into the config file at
+// path, leaving settings that did not change as they are in the file, so
+// environment and command-line overrides are not written. YAML files keep
+// their comments and key order where possible, JSON files their key order.
+// The previous file is kept as path.1 and older versions up to path.<backups>.
+func WriteBack(path string, base, next *Config, backups int) error {
+	// Replace the target of a symlink, not the link
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+
+	// JSON is YAML, so both formats are edited as a YAML node tree
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("failed to write config file %s: not a mapping", path)
+	}
+
+	mergeChanges(root, encodeNode(reflect.ValueOf(*base)), encodeNode(reflect.ValueOf(*next)))
+
+	var out []byte
+	if isJSONFile(path, data) {
+		out, err = nodeJSON(root)
+	} else {
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err = enc.Encode(&doc); err == nil {
+			err = enc.Close()
+		}
+		out = buf.Bytes()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode config file %s: %w", path, err)
+	}
+	if bytes.Equal(out, data) {
+		return nil
+	}
+
+	if err := rotateBackups(path, data, info.Mode().Perm(), backups); err != nil {
+		return fmt.Errorf("failed to back up config file %s: %w", path, err)
+	}
+	if err := atomicfile.Write(path, out, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// isJSONFile reports whether a config file is JSON, as LoadConfig decides
+func isJSONFile(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return true
+	case ".yaml", ".yml":
+		return false
+	default:
+		return json.Valid(data)
+	}
+}
+
+// rotateBackups keeps data as path.1, moving older backups up to path.<n>
+func rotateBackups(path string, data []byte, perm os.FileMode, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	for i := n - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return atomicfile.Write(path+".1", data, perm)
+}
+
+// mergeChanges applies the differences between the base and next mappings
+// to the file mapping
+func mergeChanges(file, base, next *yaml.Node) {
+	for i := 0; i+1 < len(next.Content); i += 2 {
+		key, nv := next.Content[i].Value, next.Content[i+1]
+		bv := mapValue(base, key)
+		if bv != nil && equalNodes(bv, nv) {
+			continue
+		}
+
+		fi := mapIndex(file, key)
+		switch {
+		case fi < 0:
+			file.Content = append(file.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, nv)
+		case bv != nil && bv.Kind == yaml.MappingNode && nv.Kind == yaml.MappingNode && file.Content[fi].Kind == yaml.MappingNode:
+			mergeChanges(file.Content[fi], bv, nv)
+		case bv != nil && bv.Kind == yaml.SequenceNode && nv.Kind == yaml.SequenceNode && file.Content[fi].Kind == yaml.SequenceNode &&
+			len(file.Content[fi].Content) == len(bv.Content):
+			// Items (servers, inbounds) edited in place, keeping their comments
+			mergeItems(file.Content[fi], bv, nv)
+		default:
+			replaceNode(file.Content[fi], nv)
+		}
+	}
+
+	// Settings that are now zero, and removed map entries
+	for i := 0; i+1 < len(base.Content); i += 2 {
+		key := base.Content[i].Value
+		if mapValue(next, key) != nil {
+			continue
+		}
+		if fi := mapIndex(file, key); fi >= 0 {
+			file.Content = append(file.Content[:fi-1], file.Content[fi+1:]...)
+		}
+	}
+}
+
+// mergeItems applies the differences between the base and next sequences
+// to a file sequence as long as base. Each next item is matched with a base
+// item that is equal, has the same name, tag or type, or is at the same
+// position, and the matching file item is edited, keeping its comments.
+func mergeItems(file, base, next *yaml.Node) {
+	used := make(map[int]bool)
+	match := make([]int, len(next.Content))
+	for i := range match {
+		match[i] = -1
+	}
+	find := func(same func(bv, nv *yaml.Node) bool) {
+		for i, nv := range next.Content {
+			for j, bv := range base.Content {
+				if match[i] < 0 && !used[j] && same(bv, nv) {
+					match[i] = j
+					used[j] = true
+				}
+			}
+		}
+	}
+	find(equalNodes)
+	for _, key := range []string{"name", "tag", "type"} {
+		find(func(bv, nv *yaml.Node) bool {
+			b, n := mapValue(bv, key), mapValue(nv, key)
+			return b != nil && n != nil && equalNodes(b, n)
+		})
+	}
+	for i := range match {
+		if match[i] < 0 && i < len(base.Content) && !used[i] {
+			match[i] = i
+			used[i] = true
+		}
+	}
+
+	items := make([]*yaml.Node, 0, len(next.Content))
+	for i, nv := range next.Content {
+		j := match[i]
+		if j < 0 {
+			items = append(items, nv)
+			continue
+		}
+		fv, bv := file.Content[j], base.Content[j]
+		switch {
+		case equalNodes(bv, nv):
+		case fv.Kind == yaml.MappingNode && bv.Kind == yaml.MappingNode && nv.Kind == yaml.MappingNode:
+			mergeChanges(fv, bv, nv)
+		default:
+			replaceNode(fv, nv)
+		}
+		items = append(items, fv)
+	}
+	file.Content = items
+}
+
+// replaceNode sets the content of dst to src, keeping the comments of dst
+// and the quoting of strings
+func replaceNode(dst, src *yaml.Node) {
+	head, line, foot := dst.HeadComment, dst.LineComment, dst.FootComment
+	style := dst.Style
+	sameScalar := dst.Kind == yaml.ScalarNode && src.Kind == yaml.ScalarNode && dst.Tag == src.Tag
+	*dst = *src
+	dst.HeadComment, dst.LineComment, dst.FootComment = head, line, foot
+	if sameScalar {
+		dst.Style = style
+	}
+}
+
+// mapIndex returns the index of the value of key in a mapping, or -1
+func mapIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// mapValue returns the value of key in a mapping, or nil
+func mapValue(m *yaml.Node, key string) *yaml.Node {
+	if i := mapIndex(m, key); i >= 0 {
+		return m.Content[i]
+	}
+	return nil
+}
+
+// equalNodes compares the values of two nodes, ignoring style and comments
+func equalNodes(a, b *yaml.Node) bool {
+	if a.Kind != b.Kind || a.Tag != b.Tag || a.Value != b.Value || len(a.Content) != len(b.Content) {
+		return false
+	}
+	for i := range a.Content {
+		if !equalNodes(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeNode converts a configuration value to a YAML node. Zero fields are
+// left out as they are the defaults when loading, except set pointers.
+func encodeNode(v reflect.Value) *yaml.Node {
+	if _, ok := v.Interface().(yaml.Marshaler); ok || v.Kind() != reflect.Struct && v.Kind() != reflect.Map &&
+		v.Kind() != reflect.Slice && v.Kind() != reflect.Pointer {
+		var n yaml.Node
+		if err := n.Encode(v.Interface()); err != nil {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+		}
+		return &n
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		return encodeNode(v.Elem())
+
+	case reflect.Slice:
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for i := 0; i < v.Len(); i++ {
+			seq.Content = append(seq.Content, encodeNode(v.Index(i)))
+		}
+		return seq
+
+	case reflect.Map:
+		m := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k.String()}, encodeNode(v.MapIndex(k)))
+		}
+		return m
+
+	default:
+		m := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for i := 0; i < v.NumField(); i++ {
+			field, fv := v.Type().Field(i), v.Field(i)
+			name, inline := fieldName(field)
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			if inline {
+				m.Content = append(m.Content, encodeNode(fv).Content...)
+				continue
+			}
+			if fv.Kind() == reflect.Pointer && fv.IsNil() || fv.Kind() != reflect.Pointer && fv.IsZero() ||
+				fv.Kind() == reflect.Slice && fv.Len() == 0 {
+				continue
+			}
+			m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, encodeNode(fv))
+		}
+		return m
+	}
+}
+
+// nodeJSON formats a node tree as indented JSON, keeping the key order
+func nodeJSON(n *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeNodeJSON(&buf, n); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// writeNodeJSON writes a node as compact JSON
+func writeNodeJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeNodeJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeNodeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		switch n.Tag {
+		case "!!int", "!!float", "!!bool":
+			buf.WriteString(n.Value)
+		case "!!null":
+			buf.WriteString("null")
+		default:
+			value, _ := json.Marshal(n.Value)
+			buf.Write(value)
+		}
+	case yaml.AliasNode:
+		return writeNodeJSON(buf, n.Alias)
+	default:
+		return fmt.Errorf("unsupported YAML node kind %d", n.Kind)
+	}
+	return nil
+}
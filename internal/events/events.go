@@ -0,0 +1,172 @@
+// Package events fans out real-time events (traffic ticks, connections,
+// server health, reloads and log lines) to API subscribers.
+package events
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types
+const (
+	TypeTraffic      = "traffic"       // Counters and speeds, every second
+	TypeConnOpen     = "conn_open"     // A proxied connection was opened
+	TypeConnClose    = "conn_close"    // A proxied connection was closed
+	TypeServerHealth = "server_health" // Dials to a server started failing or recovered
+	TypeReload       = "reload"        // The configuration was reloaded
+	TypeLog          = "log"           // A log line
+
+	// TypeDropped tells a subscriber how many events it missed because it
+	// did not keep up. It cannot be subscribed to.
+	TypeDropped = "dropped"
+)
+
+// Types lists the event types that can be subscribed to
+var Types = []string{TypeTraffic, TypeConnOpen, TypeConnClose, TypeServerHealth, TypeReload, TypeLog}
+
+// Event is one published event
+type Event struct {
+	ID   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+// Dropped is the data of a TypeDropped event
+type Dropped struct {
+	Count int64 `json:"count"`
+}
+
+// Reload is the data of a TypeReload event
+type Reload struct {
+	Success bool   `json:"success"`
+	Server  string `json:"server,omitempty"` // New default server
+	Error   string `json:"error,omitempty"`
+}
+
+// Bus delivers published events to subscribers without ever blocking the
+// publisher: events for a subscriber whose buffer is full are dropped
+type Bus struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	active atomic.Int32 // Number of subscribers, checked without locking
+
+	nextID  atomic.Uint64
+	dropped atomic.Int64 // Events dropped over all subscribers
+}
+
+// NewBus creates an event bus
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Active reports whether anyone is subscribed, so publishers can skip
+// building events nobody receives. A nil bus is never active.
+func (b *Bus) Active() bool {
+	return b != nil && b.active.Load() > 0
+}
+
+// Publish sends an event to every subscriber of its type. Publishing on a
+// nil bus does nothing.
+func (b *Bus) Publish(typ string, data any) {
+	if !b.Active() {
+		return
+	}
+
+	ev := Event{
+		ID:   b.nextID.Add(1),
+		Type: typ,
+		Time: time.Now(),
+		Data: data,
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if sub.types != nil && !sub.types[typ] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped.Add(1)
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because subscribers fell behind
+func (b *Bus) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// Subscribers returns the number of subscribers
+func (b *Bus) Subscribers() int {
+	return int(b.active.Load())
+}
+
+// Subscribe registers a subscriber for the given event types (all types if
+// empty) that buffers up to buffer events
+func (b *Bus) Subscribe(types []string, buffer int) (*Subscription, error) {
+	sub := &Subscription{
+		bus: b,
+		ch:  make(chan Event, buffer),
+	}
+	if len(types) > 0 {
+		sub.types = make(map[string]bool, len(types))
+		for _, typ := range types {
+			if !knownType(typ) {
+				return nil, fmt.Errorf("unknown event type %q", typ)
+			}
+			sub.types[typ] = true
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[sub] = struct{}{}
+	b.active.Add(1)
+	return sub, nil
+}
+
+// knownType reports whether typ can be subscribed to
+func knownType(typ string) bool {
+	for _, t := range Types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives the events of a subscriber
+type Subscription struct {
+	bus     *Bus
+	types   map[string]bool // nil for all types
+	ch      chan Event
+	dropped atomic.Int64 // Events dropped since the last TakeDropped
+	once    sync.Once
+}
+
+// Events returns the channel events are delivered on. It is closed by Close.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// TakeDropped returns the number of events dropped since the last call
+func (s *Subscription) TakeDropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+// Close unsubscribes and closes the events channel
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.active.Add(-1)
+		s.bus.mu.Unlock()
+		close(s.ch)
+	})
+}
@@ -0,0 +1,113 @@
+package events
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// LogLine is the data of a TypeLog event
+type LogLine struct {
+	Level   string         `json:"level"`
+	Message string         `json:"msg"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// LogHandler is a slog.Handler that passes records to another handler and
+// publishes them as log events
+type LogHandler struct {
+	next   slog.Handler
+	bus    *Bus
+	attrs  []slog.Attr // From WithAttrs, keys prefixed with their groups
+	prefix string      // Groups from WithGroup, joined with dots
+}
+
+// NewLogHandler creates a handler that tees records to bus
+func NewLogHandler(next slog.Handler, bus *Bus) *LogHandler {
+	return &LogHandler{next: next, bus: bus}
+}
+
+// Enabled reports whether the wrapped handler handles the level
+func (h *LogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle publishes the record and passes it on
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.bus.Active() {
+		line := LogLine{
+			Level:   r.Level.String(),
+			Message: r.Message,
+		}
+		if len(h.attrs)+r.NumAttrs() > 0 {
+			line.Attrs = make(map[string]any, len(h.attrs)+r.NumAttrs())
+			for _, a := range h.attrs {
+				addAttr(line.Attrs, "", a)
+			}
+			r.Attrs(func(a slog.Attr) bool {
+				addAttr(line.Attrs, h.prefix, a)
+				return true
+			})
+		}
+		h.bus.Publish(TypeLog, line)
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs returns a handler that adds attrs to every record
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+	h2.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = append(h2.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &h2
+}
+
+// WithGroup returns a handler that nests later attributes under name
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+// addAttr adds an attribute to m, flattening groups into dotted keys
+func addAttr(m map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			addAttr(m, prefix, ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+
+	switch v.Kind() {
+	case slog.KindDuration:
+		m[prefix+a.Key] = v.Duration().String()
+	case slog.KindTime:
+		m[prefix+a.Key] = v.Time().Format(time.RFC3339Nano)
+	case slog.KindAny:
+		// Errors and other values would marshal to {}, use their text instead
+		if err, ok := v.Any().(error); ok {
+			m[prefix+a.Key] = err.Error()
+		} else {
+			m[prefix+a.Key] = v.String()
+		}
+	default:
+		m[prefix+a.Key] = v.Any()
+	}
+}
+
+var _ slog.Handler = (*LogHandler)(nil)
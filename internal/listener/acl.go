@@ -0,0 +1,117 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ACL decides which client addresses may connect to a listener
+type ACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewACL parses allow and deny lists of CIDRs or single IPs.
+// It returns nil when both lists are empty.
+func NewACL(allow, deny []string) (*ACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	a := &ACL{}
+	var err error
+	if a.allow, err = parsePrefixes(allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if a.deny, err = parsePrefixes(deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return a, nil
+}
+
+// parsePrefixes parses entries like "10.0.0.0/8", "::1" or "192.168.1.5"
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", entry)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q", entry)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Allowed reports whether a client may connect. Deny entries win over allow
+// entries; a non-empty allow list rejects everything it doesn't match.
+// Addresses without an IP (Unix sockets) are always allowed.
+func (a *ACL) Allowed(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+
+	var ip netip.Addr
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(addr.IP)
+	default:
+		return true
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range a.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, prefix := range a.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterListener closes connections from clients rejected by the ACL
+type filterListener struct {
+	net.Listener
+	acl      *ACL
+	onReject func(remote net.Addr)
+}
+
+// Filter wraps ln so that connections rejected by acl are closed right after
+// Accept. onReject, if set, is called with the client address of each one.
+func Filter(ln net.Listener, acl *ACL, onReject func(remote net.Addr)) net.Listener {
+	return &filterListener{Listener: ln, acl: acl, onReject: onReject}
+}
+
+// Accept returns the next connection allowed by the ACL
+func (l *filterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.acl.Allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		if l.onReject != nil {
+			l.onReject(conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+}
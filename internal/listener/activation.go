@@ -0,0 +1,130 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// inheritedFD is a socket passed in by systemd or a container runtime. The
+// descriptor stays open, so the socket can be listened on again after a
+// reload closed its listener.
+type inheritedFD struct {
+	fd      int
+	name    string
+	file    *os.File // Opened on first use
+	claimed bool     // A listener for the socket is open
+}
+
+var (
+	inheritedOnce sync.Once
+	inheritedMu   sync.Mutex
+	inherited     []*inheritedFD
+)
+
+// loadInherited parses LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES once
+func loadInherited() {
+	inheritedOnce.Do(func() {
+		// LISTEN_PID, when set, must name this process
+		if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+			return
+		}
+
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count <= 0 {
+			return
+		}
+
+		var names []string
+		if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+			names = strings.Split(v, ":")
+		}
+
+		for i := 0; i < count; i++ {
+			fd := &inheritedFD{fd: listenFDsStart + i}
+			if i < len(names) {
+				fd.name = names[i]
+			}
+			inherited = append(inherited, fd)
+		}
+
+		// Don't leak the variables to child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+}
+
+// listenInherited returns a listener for an fd:N or systemd:name address
+func listenInherited(addr string) (net.Listener, error) {
+	loadInherited()
+
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+
+	var match *inheritedFD
+	if strings.HasPrefix(addr, fdPrefix) {
+		n, err := strconv.Atoi(strings.TrimPrefix(addr, fdPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid file descriptor in %q", addr)
+		}
+		for _, fd := range inherited {
+			if fd.fd == n {
+				match = fd
+				break
+			}
+		}
+	} else {
+		name := strings.TrimPrefix(addr, systemdPrefix)
+		for _, fd := range inherited {
+			if fd.name == name && !fd.claimed {
+				match = fd
+				break
+			}
+		}
+	}
+
+	if match == nil {
+		return nil, fmt.Errorf("no inherited socket matches %q (LISTEN_FDS=%d)", addr, len(inherited))
+	}
+	if match.claimed {
+		return nil, fmt.Errorf("inherited socket %d is already in use", match.fd)
+	}
+
+	if match.file == nil {
+		match.file = os.NewFile(uintptr(match.fd), addr)
+	}
+	// FileListener duplicates the descriptor, closing the listener leaves the original open
+	ln, err := net.FileListener(match.file)
+	if err != nil {
+		return nil, fmt.Errorf("inherited socket %d is not a listening socket: %w", match.fd, err)
+	}
+
+	match.claimed = true
+	return &inheritedListener{Listener: ln, fd: match}, nil
+}
+
+// inheritedListener releases its inherited socket when closed, so a reload
+// can listen on it again
+type inheritedListener struct {
+	net.Listener
+	fd   *inheritedFD
+	once sync.Once
+}
+
+// Close closes the listener and releases the inherited socket
+func (l *inheritedListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() {
+		inheritedMu.Lock()
+		l.fd.claimed = false
+		inheritedMu.Unlock()
+	})
+	return err
+}
@@ -0,0 +1,82 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// inheritSocket makes a listening socket look inherited under name and
+// returns its fd:N address
+func inheritSocket(t *testing.T, name string) string {
+	t.Helper()
+	loadInherited()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inheritedMu.Lock()
+	inherited = append(inherited, &inheritedFD{fd: int(f.Fd()), name: name, file: f})
+	inheritedMu.Unlock()
+	t.Cleanup(func() {
+		inheritedMu.Lock()
+		inherited = nil
+		inheritedMu.Unlock()
+		f.Close()
+	})
+	return fmt.Sprintf("%s%d", fdPrefix, f.Fd())
+}
+
+// accepts reports whether ln accepts a connection
+func accepts(t *testing.T, ln net.Listener) {
+	t.Helper()
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	conn.Close()
+}
+
+func TestInheritedListenAgain(t *testing.T) {
+	for _, prefix := range []string{fdPrefix, systemdPrefix} {
+		t.Run(strings.TrimSuffix(prefix, ":"), func(t *testing.T) {
+			addr := inheritSocket(t, "proxy")
+			if prefix == systemdPrefix {
+				addr = systemdPrefix + "proxy"
+			}
+
+			ln, err := listenInherited(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			accepts(t, ln)
+
+			// The socket is claimed while its listener is open
+			if _, err := listenInherited(addr); err == nil {
+				t.Fatal("second listener on a claimed socket succeeded")
+			}
+
+			// A reload closes the inbound and listens again on the same socket
+			ln.Close()
+			ln, err = listenInherited(addr)
+			if err != nil {
+				t.Fatalf("listen after close: %v", err)
+			}
+			defer ln.Close()
+			accepts(t, ln)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package listener
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter counts the open connections accepted by the listeners it wraps.
+// One Counter may be shared by several listeners.
+type Counter struct {
+	active atomic.Int64
+}
+
+// Active returns the number of accepted connections not closed yet
+func (c *Counter) Active() int64 {
+	return c.active.Load()
+}
+
+// countListener counts accepted connections until they are closed
+type countListener struct {
+	net.Listener
+	counter *Counter
+}
+
+// Count wraps ln so that counter includes its connections
+func Count(ln net.Listener, counter *Counter) net.Listener {
+	return &countListener{Listener: ln, counter: counter}
+}
+
+// Accept returns the next connection and counts it
+func (l *countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.counter.active.Add(1)
+	return &countedConn{Conn: conn, counter: l.counter}, nil
+}
+
+// countedConn leaves its counter when closed
+type countedConn struct {
+	net.Conn
+	counter *Counter
+	once    sync.Once
+}
+
+// Close closes the connection and stops counting it
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.counter.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection
+func (c *countedConn) NetConn() net.Conn {
+	return c.Conn
+}
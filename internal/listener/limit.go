@@ -0,0 +1,237 @@
+package listener
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons reported when a Limiter refuses or closes a connection
+const (
+	ReasonMaxConnections      = "max_connections"
+	ReasonMaxConnectionsPerIP = "max_connections_per_ip"
+	ReasonIdleTimeout         = "idle_timeout"
+	ReasonMaxLifetime         = "max_lifetime"
+)
+
+// Limits configures a Limiter. Zero values disable the respective limit.
+type Limits struct {
+	MaxConnections      int           // Concurrent connections across all listeners
+	MaxConnectionsPerIP int           // Concurrent connections per client IP
+	IdleTimeout         time.Duration // Close connections without traffic in either direction
+	MaxLifetime         time.Duration // Close connections open for longer than this
+}
+
+// Limiter enforces connection limits. One Limiter may be shared by several
+// listeners so that the limits apply to all of them together.
+type Limiter struct {
+	limits Limits
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// NewLimiter creates a limiter, or returns nil when no limit is set
+func NewLimiter(limits Limits) *Limiter {
+	if limits == (Limits{}) {
+		return nil
+	}
+	return &Limiter{
+		limits: limits,
+		perIP:  make(map[string]int),
+	}
+}
+
+// acquire reserves a connection slot for ip ("" for non-IP clients).
+// It returns the reason when a limit is reached.
+func (l *Limiter) acquire(ip string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.MaxConnections > 0 && l.total >= l.limits.MaxConnections {
+		return ReasonMaxConnections, false
+	}
+	if ip != "" && l.limits.MaxConnectionsPerIP > 0 && l.perIP[ip] >= l.limits.MaxConnectionsPerIP {
+		return ReasonMaxConnectionsPerIP, false
+	}
+
+	l.total++
+	if ip != "" {
+		l.perIP[ip]++
+	}
+	return "", true
+}
+
+// release frees a slot taken by acquire
+func (l *Limiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if ip != "" {
+		if l.perIP[ip] <= 1 {
+			delete(l.perIP, ip)
+		} else {
+			l.perIP[ip]--
+		}
+	}
+}
+
+// limitListener applies a Limiter to accepted connections
+type limitListener struct {
+	net.Listener
+	limiter *Limiter
+	onClose func(remote net.Addr, reason string)
+}
+
+// Limit wraps ln so that connections over the concurrency limits are closed
+// right after Accept, and accepted connections are closed when idle or too old.
+// onClose, if set, is called with the reason whenever the limiter closes a connection.
+func Limit(ln net.Listener, limiter *Limiter, onClose func(remote net.Addr, reason string)) net.Listener {
+	return &limitListener{Listener: ln, limiter: limiter, onClose: onClose}
+}
+
+// Accept returns the next connection within the limits
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := clientIP(conn.RemoteAddr())
+		reason, ok := l.limiter.acquire(ip)
+		if ok {
+			return newLimitedConn(conn, l.limiter, ip, l.onClose), nil
+		}
+
+		if l.onClose != nil {
+			l.onClose(conn.RemoteAddr(), reason)
+		}
+		conn.Close()
+	}
+}
+
+// clientIP returns the IP of a TCP client address, or "" for other addresses
+func clientIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return ""
+}
+
+// limitedConn releases its limiter slot on Close and enforces the idle
+// timeout and max lifetime
+type limitedConn struct {
+	net.Conn
+	limiter *Limiter
+	ip      string
+	onClose func(remote net.Addr, reason string)
+
+	lastActivity atomic.Int64 // Unix nanoseconds of the last read or write
+
+	mu            sync.Mutex
+	idleTimer     *time.Timer
+	lifetimeTimer *time.Timer
+	closed        bool
+}
+
+// newLimitedConn wraps conn and starts its timers
+func newLimitedConn(conn net.Conn, limiter *Limiter, ip string, onClose func(net.Addr, string)) *limitedConn {
+	c := &limitedConn{
+		Conn:    conn,
+		limiter: limiter,
+		ip:      ip,
+		onClose: onClose,
+	}
+	c.lastActivity.Store(time.Now().UnixNano())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if idle := limiter.limits.IdleTimeout; idle > 0 {
+		c.idleTimer = time.AfterFunc(idle, c.checkIdle)
+	}
+	if lifetime := limiter.limits.MaxLifetime; lifetime > 0 {
+		c.lifetimeTimer = time.AfterFunc(lifetime, func() {
+			c.expire(ReasonMaxLifetime)
+		})
+	}
+	return c
+}
+
+// Read reads from the connection and records activity
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Write writes to the connection and records activity
+func (c *limitedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// checkIdle closes the connection if it has been idle for the full timeout,
+// otherwise re-arms the timer for the remaining time
+func (c *limitedConn) checkIdle() {
+	idle := c.limiter.limits.IdleTimeout
+	since := time.Since(time.Unix(0, c.lastActivity.Load()))
+	if since >= idle {
+		c.expire(ReasonIdleTimeout)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.idleTimer.Reset(idle - since)
+	}
+}
+
+// expire closes the connection because a limit was reached
+func (c *limitedConn) expire(reason string) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+
+	if c.onClose != nil {
+		c.onClose(c.RemoteAddr(), reason)
+	}
+	c.Close()
+}
+
+// Close stops the timers, releases the limiter slot and closes the connection
+func (c *limitedConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	c.limiter.release(c.ip)
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,102 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Address prefixes for non-TCP listen addresses
+const (
+	unixPrefix    = "unix:"
+	fdPrefix      = "fd:"
+	systemdPrefix = "systemd:"
+)
+
+// Network returns the kind of listen address: "tcp", "unix" or "fd"
+// (a socket inherited via LISTEN_FDS)
+func Network(addr string) string {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		return "unix"
+	case strings.HasPrefix(addr, fdPrefix), strings.HasPrefix(addr, systemdPrefix):
+		return "fd"
+	default:
+		return "tcp"
+	}
+}
+
+// Listen creates a listener for addr, which may be:
+//
+//	host:port                  TCP address
+//	unix:/path/to.sock         Unix domain socket
+//	unix:/path/to.sock?mode=0660  Unix domain socket with file permissions
+//	fd:3                       Socket inherited from the parent (LISTEN_FDS)
+//	systemd:name               Inherited socket matched by LISTEN_FDNAMES
+func Listen(ctx context.Context, addr string) (net.Listener, error) {
+	switch Network(addr) {
+	case "unix":
+		return listenUnix(ctx, strings.TrimPrefix(addr, unixPrefix))
+	case "fd":
+		return listenInherited(addr)
+	default:
+		var lc net.ListenConfig
+		return lc.Listen(ctx, "tcp", addr)
+	}
+}
+
+// listenUnix listens on a Unix domain socket, replacing a stale socket file
+func listenUnix(ctx context.Context, spec string) (net.Listener, error) {
+	path, query, _ := strings.Cut(spec, "?")
+	if path == "" {
+		return nil, errors.New("empty unix socket path")
+	}
+
+	var mode fs.FileMode
+	if query != "" {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unix socket options %q: %w", query, err)
+		}
+		if m := values.Get("mode"); m != "" {
+			parsed, err := strconv.ParseUint(m, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid unix socket mode %q: %w", m, err)
+			}
+			mode = fs.FileMode(parsed)
+		}
+	}
+
+	// Abstract sockets (Linux) have no file to clean up or chmod
+	abstract := strings.HasPrefix(path, "@")
+
+	// Remove a socket left behind by a previous run
+	if !abstract {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+			}
+		}
+	}
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != 0 && !abstract {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set socket mode on %s: %w", path, err)
+		}
+	}
+
+	return ln, nil
+}
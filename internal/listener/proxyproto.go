@@ -0,0 +1,268 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a client may take to send the PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// acceptRetryDelay is the pause after a failed Accept on the raw listener
+const acceptRetryDelay = 50 * time.Millisecond
+
+// v2Signature starts every PROXY protocol v2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1HeaderLen is the longest valid v1 header including CRLF
+const maxV1HeaderLen = 107
+
+// maxV2PayloadLen bounds the address and TLV block of a v2 header; balancers
+// send far less, and a peer must not make every handshake allocate 64 KiB
+const maxV2PayloadLen = 4096
+
+// proxyProtoListener parses a PROXY protocol v1 or v2 header on every accepted
+// connection. Headers are read in per-connection goroutines so a slow or silent
+// client cannot block Accept for everyone else.
+type proxyProtoListener struct {
+	net.Listener
+	trusted   *ACL
+	onReject  func(remote net.Addr)
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ProxyProtocol wraps ln so that connections must start with a PROXY protocol
+// header (as sent by HAProxy and most load balancers). The RemoteAddr of the
+// returned connections is the client address from the header.
+// Only peers allowed by trusted may send a header: connections from other
+// addresses, or without a valid header, are closed. A nil trusted list trusts
+// no TCP peer. onReject, if set, is called with the address of each untrusted peer.
+func ProxyProtocol(ln net.Listener, trusted *ACL, onReject func(remote net.Addr)) net.Listener {
+	l := &proxyProtoListener{
+		Listener: ln,
+		trusted:  trusted,
+		onReject: onReject,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts raw connections and hands them to header parsers
+func (l *proxyProtoListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.Close()
+				return
+			}
+			// Transient errors such as EMFILE: back off like net/http does
+			slog.Warn("Failed to accept connection", "error", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		if !l.trustedPeer(conn.RemoteAddr()) {
+			if l.onReject != nil {
+				l.onReject(conn.RemoteAddr())
+			}
+			conn.Close()
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// trustedPeer reports whether remote may send a PROXY header
+func (l *proxyProtoListener) trustedPeer(remote net.Addr) bool {
+	if l.trusted == nil {
+		_, tcp := remote.(*net.TCPAddr)
+		return !tcp
+	}
+	return l.trusted.Allowed(remote)
+}
+
+// handshake reads the PROXY header and delivers the connection to Accept
+func (l *proxyProtoListener) handshake(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	remote, err := readProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		slog.Debug("Rejected connection without valid PROXY header", "remote", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+
+	var pc net.Conn = conn
+	if remote != nil {
+		pc = &proxyConn{Conn: conn, remote: remote}
+		slog.Debug("PROXY header accepted", "client", remote, "balancer", conn.RemoteAddr())
+	}
+
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept waits for the next connection with a parsed PROXY header
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener
+func (l *proxyProtoListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// proxyConn reports the client address from the PROXY header
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the original client address
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// NetConn returns the underlying connection
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readProxyHeader consumes a v1 or v2 header from r without reading past it.
+// It returns nil when the header carries no address (v1 UNKNOWN, v2 LOCAL or
+// non-IP families), in which case the connection address should be kept.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case string(prefix) == "PROXY":
+		return readProxyV1(r)
+	case bytes.Equal(prefix, v2Signature[:5]):
+		return readProxyV2(r, prefix)
+	default:
+		return nil, errors.New("missing PROXY protocol signature")
+	}
+}
+
+// readProxyV1 parses the text format: "PROXY TCP4 src dst sport dport\r\n".
+// The header is read byte by byte so no payload is consumed.
+func readProxyV1(r io.Reader) (net.Addr, error) {
+	line := []byte("PROXY")
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1HeaderLen {
+			return nil, errors.New("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("invalid source address in PROXY v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary format after the first bytes of the signature
+func readProxyV2(r io.Reader, prefix []byte) (net.Addr, error) {
+	header := make([]byte, 16)
+	copy(header, prefix)
+	if _, err := io.ReadFull(r, header[len(prefix):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], v2Signature) {
+		return nil, errors.New("invalid PROXY v2 signature")
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	if length > maxV2PayloadLen {
+		return nil, fmt.Errorf("PROXY v2 header too long (%d bytes)", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL: health checks from the balancer itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", verCmd&0x0f)
+	}
+
+	// Address family in the high nibble, transport in the low nibble
+	switch family >> 4 {
+	case 0x1: // AF_INET: src(4) dst(4) sport(2) dport(2)
+		if length < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2: // AF_INET6: src(16) dst(16) sport(2) dport(2)
+		if length < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default: // AF_UNSPEC, AF_UNIX: keep the connection address
+		return nil, nil
+	}
+}
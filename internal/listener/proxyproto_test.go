@@ -0,0 +1,171 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2Header encodes a PROXY protocol v2 header
+func v2Header(verCmd, family byte, payload []byte) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, verCmd, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(payload)))
+	return append(h, payload...)
+}
+
+// v2Addrs encodes a v2 address block of src and dst with their ports
+func v2Addrs(src, dst net.IP, sport, dport uint16) []byte {
+	b := append(append([]byte{}, src...), dst...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := v2Addrs(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 51000, 443)
+	ipv6 := v2Addrs(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 51000, 443)
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string // Client address, empty to keep the connection address
+		err    string // Error substring, empty for success
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 51000 443\r\n"), want: "192.0.2.1:51000"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\n"), want: "[2001:db8::1]:51000"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 unknown with addresses", header: []byte("PROXY UNKNOWN ffff:f...f ffff:f...f 65535 65535\r\n")},
+		{name: "v1 truncated", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1"), err: "EOF"},
+		{name: "v1 too long", header: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), err: "too long"},
+		{name: "v1 missing fields", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 51000\r\n"), err: "malformed"},
+		{name: "v1 bad address", header: []byte("PROXY TCP4 192.0.2.x 198.51.100.1 51000 443\r\n"), err: "invalid source"},
+		{name: "v1 bad port", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n"), err: "invalid source"},
+		{name: "v1 udp", header: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 51000 443\r\n"), err: "unsupported"},
+		{name: "v2 tcp4", header: v2Header(0x21, 0x11, ipv4), want: "192.0.2.1:51000"},
+		{name: "v2 tcp6", header: v2Header(0x21, 0x21, ipv6), want: "[2001:db8::1]:51000"},
+		{name: "v2 tcp4 with tlvs", header: v2Header(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)), want: "192.0.2.1:51000"},
+		{name: "v2 local", header: v2Header(0x20, 0x00, nil)},
+		{name: "v2 local with addresses", header: v2Header(0x20, 0x11, ipv4)},
+		{name: "v2 unspec", header: v2Header(0x21, 0x00, nil)},
+		{name: "v2 unix", header: v2Header(0x21, 0x31, make([]byte, 216))},
+		{name: "v2 truncated signature", header: v2Signature[:8], err: "EOF"},
+		{name: "v2 truncated addresses", header: v2Header(0x21, 0x11, ipv4)[:20], err: "EOF"},
+		{name: "v2 short ipv4 block", header: v2Header(0x21, 0x11, ipv4[:8]), err: "short"},
+		{name: "v2 short ipv6 block", header: v2Header(0x21, 0x21, ipv6[:20]), err: "short"},
+		{name: "v2 oversize length", header: v2Header(0x21, 0x11, make([]byte, maxV2PayloadLen+1)), err: "too long"},
+		{name: "v2 bad signature", header: append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 12), err: "signature"},
+		{name: "v2 version 1", header: v2Header(0x11, 0x11, ipv4), err: "version"},
+		{name: "v2 unknown command", header: v2Header(0x22, 0x11, ipv4), err: "command"},
+		{name: "no header", header: []byte("GET / HTTP/1.1\r\n\r\n"), err: "signature"},
+		{name: "empty", header: nil, err: "EOF"},
+		{name: "truncated prefix", header: []byte("PRO"), err: "EOF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Truncated headers end the stream, valid ones are followed by data
+			data := append([]byte{}, tt.header...)
+			if tt.err == "" {
+				data = append(data, "payload"...)
+			}
+			r := bytes.NewReader(data)
+			addr, err := readProxyHeader(r)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("address %q, want %q", got, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("data after the header %q, want %q", rest, "payload")
+			}
+		})
+	}
+}
+
+// dialProxyProtocol connects to ln and sends header followed by "hi"
+func dialProxyProtocol(t *testing.T, ln net.Listener, header string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte(header + "hi"))
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	t.Run("trusted", func(t *testing.T) {
+		raw, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted, _ := NewACL([]string{"127.0.0.1"}, nil)
+		ln := ProxyProtocol(raw, trusted, func(net.Addr) { t.Error("trusted peer rejected") })
+		defer ln.Close()
+
+		dialProxyProtocol(t, ln, "PROXY TCP4 192.0.2.1 198.51.100.1 51000 443\r\n")
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if got := conn.RemoteAddr().String(); got != "192.0.2.1:51000" {
+			t.Errorf("RemoteAddr %s, want the address from the header", got)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hi" {
+			t.Errorf("read %q, %v after the header, want %q", buf, err, "hi")
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		raw, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted, _ := NewACL([]string{"192.0.2.0/24"}, nil)
+		rejected := make(chan net.Addr, 1)
+		ln := ProxyProtocol(raw, trusted, func(remote net.Addr) { rejected <- remote })
+		defer ln.Close()
+
+		dialProxyProtocol(t, ln, "PROXY TCP4 192.0.2.1 198.51.100.1 51000 443\r\n")
+		select {
+		case remote := <-rejected:
+			if host, _, _ := net.SplitHostPort(remote.String()); host != "127.0.0.1" {
+				t.Errorf("rejected %s, want the peer address", remote)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("untrusted peer was not rejected")
+		}
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				accepted <- conn
+			}
+		}()
+		select {
+		case conn := <-accepted:
+			conn.Close()
+			t.Error("connection from an untrusted peer accepted")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
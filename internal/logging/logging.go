@@ -0,0 +1,60 @@
+// Package logging sets up the process-wide slog logger and changes its
+// settings at runtime.
+package logging
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/events"
+)
+
+var (
+	mu     sync.Mutex
+	level  slog.LevelVar // Shared by every handler, so level changes apply at once
+	format string        // Format of the installed handler, empty before Setup
+)
+
+// Setup makes a logger with the configured level and format the default,
+// teeing records to bus. Called again, it changes the level in place and
+// only replaces the handler if the format changed.
+func Setup(cfg config.LoggingConfig, bus *events.Bus) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	level.Set(ParseLevel(cfg.Level))
+
+	if format != "" && format == cfg.Format {
+		return
+	}
+	format = cfg.Format
+
+	opts := &slog.HandlerOptions{
+		Level: &level,
+	}
+
+	var handler slog.Handler
+	if cfg.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+
+	slog.SetDefault(slog.New(events.NewLogHandler(handler, bus)))
+}
+
+// ParseLevel converts a configured level name, defaulting to info
+func ParseLevel(name string) slog.Level {
+	switch name {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,30 @@
+package mgmt
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardHandler serves the embedded dashboard under /dashboard/. The
+// page holds no data itself: it calls the API with the token the user enters.
+func dashboardHandler() http.HandlerFunc {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err) // The directory is embedded above
+	}
+	fileServer := http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fileServer.ServeHTTP(w, r)
+	}
+}
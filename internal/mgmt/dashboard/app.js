@@ -0,0 +1,418 @@
+// light-ss dashboard: talks to the management API with the bearer token
+// kept in localStorage and follows /events for live updates.
+'use strict';
+
+const base = new URL('..', location.href); // API root, the dashboard lives at /dashboard/
+const tokenKey = 'light-ss-token';
+const chartPoints = 300; // One traffic event per second
+const maxLogLines = 200;
+const maxConnections = 200;
+
+const $ = (id) => document.getElementById(id);
+
+// ---- API ----
+
+class Unauthorized extends Error {}
+
+function authHeaders() {
+  const token = localStorage.getItem(tokenKey);
+  return token ? { Authorization: 'Bearer ' + token } : {};
+}
+
+async function api(path, options = {}) {
+  const res = await fetch(new URL(path, base), {
+    ...options,
+    headers: { ...authHeaders(), ...(options.headers || {}) },
+  });
+  if (res.status === 401) {
+    showLogin();
+    throw new Unauthorized('unauthorized');
+  }
+  const body = await res.json().catch(() => ({}));
+  if (!res.ok) {
+    throw new Error(body.error || res.statusText);
+  }
+  return body;
+}
+
+function postJSON(path, data) {
+  return api(path, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(data),
+  });
+}
+
+// ---- Formatting ----
+
+function formatBytes(n) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + ' ' + units[i];
+}
+
+function formatDuration(ms) {
+  const s = Math.floor(ms / 1000);
+  if (s < 60) return s + 's';
+  if (s < 3600) return Math.floor(s / 60) + 'm ' + (s % 60) + 's';
+  return Math.floor(s / 3600) + 'h ' + Math.floor((s % 3600) / 60) + 'm';
+}
+
+// el creates an element with text content or children
+function el(tag, content, className) {
+  const e = document.createElement(tag);
+  if (className) e.className = className;
+  if (Array.isArray(content)) e.append(...content);
+  else if (content !== undefined) e.textContent = content;
+  return e;
+}
+
+function button(label, onClick, className) {
+  const b = el('button', label, className);
+  b.addEventListener('click', onClick);
+  return b;
+}
+
+// ---- Login ----
+
+function showLogin(message) {
+  $('login-error').textContent = message || '';
+  if (!$('login').open) $('login').showModal();
+}
+
+$('login-form').addEventListener('submit', () => {
+  localStorage.setItem(tokenKey, $('token').value);
+  $('token').value = '';
+  start();
+});
+
+$('logout').addEventListener('click', () => {
+  localStorage.removeItem(tokenKey);
+  location.reload();
+});
+
+// ---- Throughput chart ----
+
+const samples = []; // {up, down} in bytes/sec
+
+function drawChart() {
+  const canvas = $('chart');
+  const ratio = window.devicePixelRatio || 1;
+  canvas.width = canvas.clientWidth * ratio;
+  canvas.height = canvas.clientHeight * ratio;
+  const ctx = canvas.getContext('2d');
+  const w = canvas.width;
+  const h = canvas.height;
+  ctx.clearRect(0, 0, w, h);
+
+  const max = Math.max(1024, ...samples.map((s) => Math.max(s.up, s.down)));
+  $('chart-max').textContent = 'max ' + formatBytes(max) + '/s';
+
+  const style = getComputedStyle(document.documentElement);
+  for (const [key, color] of [['down', '--down'], ['up', '--up']]) {
+    ctx.strokeStyle = style.getPropertyValue(color);
+    ctx.lineWidth = 2 * ratio;
+    ctx.beginPath();
+    samples.forEach((s, i) => {
+      const x = w - (samples.length - 1 - i) * (w / (chartPoints - 1));
+      const y = h - (s[key] / max) * (h - 4 * ratio) - 2 * ratio;
+      if (i === 0) ctx.moveTo(x, y);
+      else ctx.lineTo(x, y);
+    });
+    ctx.stroke();
+  }
+}
+
+window.addEventListener('resize', drawChart);
+
+// ---- Stats ----
+
+function showTraffic(t) {
+  $('download-speed').textContent = formatBytes(t.download_speed) + '/s';
+  $('upload-speed').textContent = formatBytes(t.upload_speed) + '/s';
+  $('active').textContent = t.active_connections;
+  $('bytes').textContent = formatBytes(t.bytes_received) + ' / ' + formatBytes(t.bytes_sent);
+
+  samples.push({ up: t.upload_speed, down: t.download_speed });
+  if (samples.length > chartPoints) samples.shift();
+  drawChart();
+}
+
+async function loadStats() {
+  try {
+    const s = await api('stats');
+    $('total').textContent = s.total_connections;
+    $('uptime').textContent = s.uptime;
+    if (!streaming) {
+      showTraffic(s);
+    }
+  } catch (e) {
+    if (!(e instanceof Unauthorized)) $('total').textContent = e.message;
+  }
+}
+
+// ---- Servers ----
+
+async function loadServers() {
+  let servers;
+  try {
+    servers = await api('servers');
+  } catch (e) {
+    return;
+  }
+  const rows = servers.map((s) => {
+    const errors = Object.values(s.dial_errors || {}).reduce((a, b) => a + b, 0);
+    const health = el('td', [el('span', undefined, 'dot ' + (s.healthy ? 'ok' : 'bad')), s.healthy ? 'up' : 'failing']);
+    const action = el('td');
+    if (s.name !== 'default') {
+      action.append(button('Use as default', () => selectServer(s.name)));
+    }
+    return el('tr', [
+      el('td', s.name),
+      el('td', s.address),
+      health,
+      el('td', s.dials ? s.avg_latency_ms.toFixed(1) + ' ms' : '-', 'num'),
+      el('td', s.dials, 'num'),
+      el('td', errors, 'num'),
+      el('td', s.active_connections, 'num'),
+      action,
+    ]);
+  });
+  $('servers').replaceChildren(...rows);
+}
+
+async function selectServer(name) {
+  if (!confirm('Switch new connections of the default server to ' + name + '?')) return;
+  try {
+    await postJSON('servers/select', { name });
+  } catch (e) {
+    alert('Switch failed: ' + e.message);
+  }
+  loadServers();
+}
+
+// ---- Connections ----
+
+async function loadConnections() {
+  let conns;
+  try {
+    conns = await api('connections');
+  } catch (e) {
+    return;
+  }
+  $('conn-count').textContent = conns.length > maxConnections
+    ? conns.length + ' open, showing the newest ' + maxConnections
+    : conns.length + ' open';
+
+  const now = Date.now();
+  const rows = conns.slice(-maxConnections).reverse().map((c) => el('tr', [
+    el('td', c.id, 'num'),
+    el('td', c.type),
+    el('td', c.inbound),
+    el('td', c.client || ''),
+    el('td', c.user || ''),
+    el('td', c.target, 'target'),
+    el('td', c.server),
+    el('td', formatDuration(now - new Date(c.start).getTime()), 'num'),
+    el('td', formatBytes(c.bytes_received), 'num'),
+    el('td', formatBytes(c.bytes_sent), 'num'),
+    el('td', [button('Close', () => closeConnection(c.id), 'danger')]),
+  ]));
+  $('connections').replaceChildren(...rows);
+}
+
+async function closeConnection(id) {
+  try {
+    await api('connections/' + id, { method: 'DELETE' });
+  } catch (e) {
+    alert('Close failed: ' + e.message);
+  }
+  loadConnections();
+}
+
+$('close-all').addEventListener('click', async () => {
+  if (!confirm('Close all open connections?')) return;
+  try {
+    await api('connections', { method: 'DELETE' });
+  } catch (e) {
+    alert('Close failed: ' + e.message);
+  }
+  loadConnections();
+});
+
+// Connection events arrive in bursts, so refresh the table at most once a second
+let connRefresh = null;
+function scheduleConnections() {
+  if (connRefresh) return;
+  connRefresh = setTimeout(() => {
+    connRefresh = null;
+    loadConnections();
+  }, 1000);
+}
+
+// ---- Actions ----
+
+async function speedTest(latencyOnly) {
+  const result = $('speedtest-result');
+  $('speedtest').disabled = $('latencytest').disabled = true;
+  result.textContent = 'Running...';
+  try {
+    const r = await api('speedtest?duration=5' + (latencyOnly ? '&latency_only=true' : ''));
+    result.textContent = 'Latency ' + r.latency_ms + ' ms' +
+      (latencyOnly ? '' : ', download ' + formatBytes(r.download_speed) + '/s');
+  } catch (e) {
+    result.textContent = 'Failed: ' + e.message;
+  }
+  $('speedtest').disabled = $('latencytest').disabled = false;
+}
+
+$('speedtest').addEventListener('click', () => speedTest(false));
+$('latencytest').addEventListener('click', () => speedTest(true));
+
+$('reload-form').addEventListener('submit', async (e) => {
+  e.preventDefault();
+  const form = new FormData(e.target);
+  const req = { server: form.get('server'), password: form.get('password') };
+  if (form.get('cipher')) req.cipher = form.get('cipher');
+  try {
+    const r = await postJSON('reload', req);
+    $('reload-result').textContent = r.message;
+    e.target.reset();
+  } catch (err) {
+    $('reload-result').textContent = 'Failed: ' + err.message;
+  }
+});
+
+// ---- Log ----
+
+function appendLog(time, level, text) {
+  const log = $('log');
+  const atBottom = log.scrollTop + log.clientHeight >= log.scrollHeight - 4;
+  log.append(el('div', new Date(time).toLocaleTimeString() + ' ' + level.padEnd(5) + ' ' + text, level));
+  while (log.childElementCount > maxLogLines) log.firstChild.remove();
+  if (atBottom) log.scrollTop = log.scrollHeight;
+}
+
+function formatLogLine(line) {
+  const attrs = Object.entries(line.attrs || {}).map(([k, v]) => k + '=' + v);
+  return [line.msg, ...attrs].join(' ');
+}
+
+// ---- Event stream ----
+
+// EventSource cannot send an Authorization header, so read the SSE stream with fetch
+let streaming = false;
+
+function handleEvent(ev) {
+  switch (ev.type) {
+    case 'traffic':
+      showTraffic(ev.data);
+      break;
+    case 'conn_open':
+    case 'conn_close':
+      scheduleConnections();
+      break;
+    case 'server_health':
+      loadServers();
+      break;
+    case 'reload':
+      appendLog(ev.time, ev.data.success ? 'INFO' : 'ERROR',
+        'reload ' + (ev.data.success ? 'succeeded' : 'failed: ' + ev.data.error));
+      loadServers();
+      break;
+    case 'log':
+      appendLog(ev.time, ev.data.level, formatLogLine(ev.data));
+      break;
+    case 'dropped':
+      appendLog(ev.time, 'WARN', ev.data.count + ' events dropped, the dashboard fell behind');
+      break;
+  }
+}
+
+async function streamEvents() {
+  const res = await fetch(new URL('events', base), { headers: authHeaders() });
+  if (res.status === 401) {
+    showLogin('Invalid token');
+    return false;
+  }
+  if (!res.ok) {
+    throw new Error(res.statusText);
+  }
+
+  streaming = true;
+  $('stream').textContent = 'live';
+  $('stream').classList.add('live');
+
+  const reader = res.body.getReader();
+  const decoder = new TextDecoder();
+  let buf = '';
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) break;
+    buf += decoder.decode(value, { stream: true });
+
+    let end;
+    while ((end = buf.indexOf('\n\n')) >= 0) {
+      const block = buf.slice(0, end);
+      buf = buf.slice(end + 2);
+      const data = block.split('\n').filter((l) => l.startsWith('data: ')).map((l) => l.slice(6)).join('\n');
+      if (data) handleEvent(JSON.parse(data));
+    }
+  }
+  return true;
+}
+
+let following = false;
+
+async function followEvents() {
+  following = true;
+  for (;;) {
+    try {
+      if (!(await streamEvents())) break;
+    } catch (e) {
+      // Reconnect below
+    }
+    streaming = false;
+    $('stream').textContent = 'offline';
+    $('stream').classList.remove('live');
+    await new Promise((r) => setTimeout(r, 3000));
+  }
+  streaming = false;
+  following = false;
+}
+
+// ---- Startup ----
+
+let started = false;
+
+async function start() {
+  try {
+    const c = await api('config');
+    $('instance').textContent = c.name || '';
+  } catch (e) {
+    return; // Unauthorized shows the login dialog
+  }
+
+  loadStats();
+  loadServers();
+  loadConnections();
+  if (!started) {
+    started = true;
+    setInterval(loadStats, 5000);
+    setInterval(loadServers, 5000);
+    setInterval(loadConnections, 5000);
+  }
+  if (!following) followEvents();
+}
+
+fetch(new URL('version', base))
+  .then((r) => r.json())
+  .then((v) => { $('version').textContent = v.version ? 'v' + v.version : ''; })
+  .catch(() => {});
+
+drawChart();
+start();
@@ -0,0 +1,171 @@
+package mgmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/events"
+	"golang.org/x/net/websocket"
+)
+
+// eventBuffer is how many events a subscriber may fall behind before
+// events are dropped for it
+const eventBuffer = 256
+
+// sseKeepAlive is how often an idle event stream sends a comment so proxies
+// keep it open
+const sseKeepAlive = 15 * time.Second
+
+// subscribe subscribes to the event types in the types query parameter,
+// writing an error response on failure
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) *events.Subscription {
+	if s.manager == nil || s.manager.Events() == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "events not available")
+		return nil
+	}
+
+	var types []string
+	if v := r.URL.Query().Get("types"); v != "" {
+		for _, typ := range strings.Split(v, ",") {
+			types = append(types, strings.TrimSpace(typ))
+		}
+	}
+
+	sub, err := s.manager.Events().Subscribe(types, eventBuffer)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	return sub
+}
+
+// pending returns ev, preceded by a dropped event if the subscriber missed
+// events since the last call
+func pending(sub *events.Subscription, ev events.Event) []events.Event {
+	if n := sub.TakeDropped(); n > 0 {
+		dropped := events.Event{Type: events.TypeDropped, Time: time.Now(), Data: events.Dropped{Count: n}}
+		return []events.Event{dropped, ev}
+	}
+	return []events.Event{ev}
+}
+
+// handleEvents streams events as Server-Sent Events, e.g. ?types=traffic,log
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	sub := s.subscribe(w, r)
+	if sub == nil {
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable buffering in nginx
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev := <-sub.Events():
+			for _, ev := range pending(sub, ev) {
+				data, err := json.Marshal(ev)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// handleEventsWS streams events over a WebSocket as JSON text messages
+func (s *Server) handleEventsWS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	sub := s.subscribe(w, r)
+	if sub == nil {
+		return
+	}
+	defer sub.Close()
+
+	websocket.Server{Handshake: s.checkOrigin, Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		// Read until the client goes away, which also answers its pings
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			var msg []byte
+			for websocket.Message.Receive(ws, &msg) == nil {
+			}
+		}()
+
+		for {
+			select {
+			case ev := <-sub.Events():
+				for _, ev := range pending(sub, ev) {
+					if err := websocket.JSON.Send(ws, ev); err != nil {
+						return
+					}
+				}
+			case <-gone:
+				return
+			case <-s.closing:
+				return
+			}
+		}
+	}}.ServeHTTP(w, r)
+}
+
+// checkOrigin rejects WebSocket handshakes from web pages of other sites,
+// which browsers would let read the events of an API without tokens.
+// Clients without an Origin header are not browsers and are accepted.
+func (s *Server) checkOrigin(cfg *websocket.Config, r *http.Request) error {
+	var err error
+	if cfg.Origin, err = websocket.Origin(cfg, r); err != nil {
+		return err
+	}
+	if cfg.Origin == nil || strings.EqualFold(cfg.Origin.Host, r.Host) {
+		return nil
+	}
+	origin := cfg.Origin.Scheme + "://" + cfg.Origin.Host
+	for _, allowed := range s.manager.GetConfig().API.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return nil
+		}
+	}
+	slog.Warn("WebSocket origin rejected", "origin", origin, "host", r.Host, "remote", r.RemoteAddr)
+	return fmt.Errorf("origin %s not allowed", origin)
+}
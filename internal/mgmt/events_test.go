@@ -0,0 +1,48 @@
+package mgmt
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/server"
+	"golang.org/x/net/websocket"
+)
+
+func TestEventsWSOrigin(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, err := s.manager.UpdateConfig(func(next *config.Config) error {
+		next.API.AllowedOrigins = []string{"https://dash.example.com"}
+		return nil
+	}, server.SourceAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/events/ws"
+	tests := []struct {
+		name   string
+		origin string
+		ok     bool
+	}{
+		{"same host", ts.URL, true},
+		{"allowed", "https://dash.example.com", true},
+		{"other site", "https://evil.example", false},
+		{"other port", "http://127.0.0.1:1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, err := websocket.Dial(url, "", tt.origin)
+			if err == nil {
+				ws.Close()
+			}
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("handshake from %s: error %v, want accepted = %v", tt.origin, err, tt.ok)
+			}
+		})
+	}
+}
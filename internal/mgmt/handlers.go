@@ -1,14 +1,22 @@
 package mgmt
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/pac"
+	"github.com/xrdavies/light-ss/internal/ratelimit"
+	"github.com/xrdavies/light-ss/internal/server"
+	"github.com/xrdavies/light-ss/internal/stats"
 )
 
 // Response structures
@@ -26,16 +34,28 @@ type VersionResponse struct {
 }
 
 type StatsResponse struct {
-	Name              string `json:"name,omitempty"` // Instance name
-	TotalConnections  int64  `json:"total_connections"`
-	ActiveConnections int64  `json:"active_connections"`
-	HTTPConnections   int64  `json:"http_connections"`
-	SOCKS5Connections int64  `json:"socks5_connections"`
-	BytesSent         int64  `json:"bytes_sent"`
-	BytesReceived     int64  `json:"bytes_received"`
-	UploadSpeed       int64  `json:"upload_speed"`   // bytes/sec
-	DownloadSpeed     int64  `json:"download_speed"` // bytes/sec
-	Uptime            string `json:"uptime"`
+	Name                string                        `json:"name,omitempty"` // Instance name
+	TotalConnections    int64                         `json:"total_connections"`
+	ActiveConnections   int64                         `json:"active_connections"`
+	HTTPConnections     int64                         `json:"http_connections"`
+	SOCKS5Connections   int64                         `json:"socks5_connections"`
+	RejectedConnections int64                         `json:"rejected_connections"` // Refused by allow/deny lists or limits
+	BytesSent           int64                         `json:"bytes_sent"`
+	BytesReceived       int64                         `json:"bytes_received"`
+	UploadSpeed         int64                         `json:"upload_speed"`            // bytes/sec
+	DownloadSpeed       int64                         `json:"download_speed"`          // bytes/sec
+	CloseReasons        map[string]int64              `json:"close_reasons,omitempty"` // Connections refused or closed by limits
+	RateLimits          *ratelimit.Limits             `json:"rate_limits,omitempty"`   // Current bandwidth limits, bytes/sec
+	Groups              map[string][]stats.GroupStats `json:"groups,omitempty"`        // Top keys by traffic per requested dimension
+	Uptime              string                        `json:"uptime"`
+	RateLimitsChanged   bool                          `json:"rate_limits_changed,omitempty"` // Changed with PUT /limits, until the next reload
+}
+
+type HistoryResponse struct {
+	Resolution string               `json:"resolution"` // minute or hour
+	From       time.Time            `json:"from"`
+	To         time.Time            `json:"to"`
+	Points     []stats.HistoryPoint `json:"points"`
 }
 
 type SpeedTestResponse struct {
@@ -53,16 +73,78 @@ type ConfigResponse struct {
 	Proxies    string            `json:"proxies,omitempty"`
 	HTTP       string            `json:"http,omitempty"`
 	SOCKS5     string            `json:"socks5,omitempty"`
+	Inbounds   []InboundInfo     `json:"inbounds,omitempty"`
+	Servers    []string          `json:"servers,omitempty"` // Additional named servers
+}
+
+type ServerInfo struct {
+	Name              string           `json:"name"`
+	Address           string           `json:"address"`
+	Cipher            string           `json:"cipher"`
+	Plugin            string           `json:"plugin,omitempty"`
+	Healthy           bool             `json:"healthy"` // Whether the last dial succeeded
+	Dials             int64            `json:"dials"`   // Successful dials
+	DialErrors        map[string]int64 `json:"dial_errors,omitempty"`
+	AvgLatencyMS      float64          `json:"avg_latency_ms"` // Mean latency of successful dials
+	ActiveConnections int64            `json:"active_connections"`
+	Selected          bool             `json:"selected"` // Used by inbounds without a server setting
+}
+
+type SelectServerRequest struct {
+	Name string `json:"name"`
+}
+
+type InboundInfo struct {
+	Tag    string `json:"tag"`
+	Type   string `json:"type"`
+	Listen string `json:"listen"`
+	Server string `json:"server,omitempty"`
+	Target string `json:"target,omitempty"`
+	Auth   bool   `json:"auth"` // Whether credentials are required
+}
+
+// LimitsRequest changes bandwidth limits. Omitted scopes are left unchanged;
+// rates accept numbers or sizes like "10MB" and 0 removes a limit.
+// LimitsResponse reports the current bandwidth limits, bytes/sec
+type LimitsResponse struct {
+	ratelimit.Limits
+	Changed bool `json:"changed"` // Changed with PUT /limits; the next reload restores the configured limits
+}
+
+type LimitsRequest struct {
+	Global   *config.RateLimitConfig           `json:"global,omitempty"`
+	Inbounds map[string]config.RateLimitConfig `json:"inbounds,omitempty"`
+	Users    map[string]config.RateLimitConfig `json:"users,omitempty"`
 }
 
 type ReloadRequest struct {
 	Server      string                `json:"server"`
 	Password    string                `json:"password"`
 	Cipher      string                `json:"cipher,omitempty"`
+	Timeout     int                   `json:"timeout,omitempty"` // Seconds, the current timeout if omitted
 	Plugin      string                `json:"plugin,omitempty"`
 	PluginOpts  *config.PluginOpts    `json:"plugin_opts,omitempty"`
 }
 
+type ReloadResponse struct {
+	Status   string                 `json:"status"` // ok or error
+	Message  string                 `json:"message"`
+	Sections []server.SectionResult `json:"sections"`         // Changed sections and how they were applied
+	Config   *config.Config         `json:"config,omitempty"` // Resulting configuration (sanitized), for PATCH /config
+}
+
+type DrainResponse struct {
+	Status    string `json:"status"`    // drained, or timeout if connections remain
+	Remaining int64  `json:"remaining"` // Client connections still open
+	Duration  string `json:"duration"`
+}
+
+// Drain timeouts
+const (
+	defaultDrainTimeout = 30 * time.Second
+	maxDrainTimeout     = time.Hour
+)
+
 type SuccessResponse struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
@@ -85,9 +167,15 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 		uptime = stats.Uptime.Round(time.Second).String()
 	}
 
+	// Reported so load balancers can take a draining instance out of rotation
+	status := "ok"
+	if s.manager != nil && s.manager.Draining() {
+		status = "draining"
+	}
+
 	writeJSON(w, http.StatusOK, HealthResponse{
-		Name:   s.config.Name,
-		Status: "ok",
+		Name:   s.instanceName(),
+		Status: status,
 		Uptime: uptime,
 	})
 }
@@ -101,7 +189,7 @@ func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
 
 	// TODO: Get actual version from build flags
 	writeJSON(w, http.StatusOK, VersionResponse{
-		Name:      s.config.Name,
+		Name:      s.instanceName(),
 		Version:   "1.0.0",
 		Commit:    "dev",
 		BuildTime: time.Now().Format(time.RFC3339),
@@ -120,21 +208,125 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Optional breakdowns, e.g. ?group_by=domain,server&top=20
+	var groups map[string][]stats.GroupStats
+	if groupBy := r.URL.Query().Get("group_by"); groupBy != "" {
+		top := 10
+		if topStr := r.URL.Query().Get("top"); topStr != "" {
+			n, err := strconv.Atoi(topStr)
+			if err != nil || n < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid top")
+				return
+			}
+			top = n
+		}
+
+		groups = make(map[string][]stats.GroupStats)
+		for _, dim := range strings.Split(groupBy, ",") {
+			dim = strings.TrimSpace(dim)
+			list, err := s.collector.Groups(dim, top)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			groups[dim] = list
+		}
+	}
+
 	stats := s.collector.GetStats()
+	var rateLimits *ratelimit.Limits
+	if s.manager != nil {
+		limits := s.manager.RateLimits().Limits()
+		rateLimits = &limits
+	}
+
 	writeJSON(w, http.StatusOK, StatsResponse{
-		Name:              s.config.Name,
-		TotalConnections:  stats.TotalConnections,
-		ActiveConnections: stats.ActiveConnections,
-		HTTPConnections:   stats.HTTPConnections,
-		SOCKS5Connections: stats.SOCKS5Connections,
-		BytesSent:         stats.BytesSent,
-		BytesReceived:     stats.BytesReceived,
-		UploadSpeed:       stats.UploadSpeed,
-		DownloadSpeed:     stats.DownloadSpeed,
-		Uptime:            stats.Uptime.Round(time.Second).String(),
+		Name:                s.instanceName(),
+		TotalConnections:    stats.TotalConnections,
+		ActiveConnections:   stats.ActiveConnections,
+		HTTPConnections:     stats.HTTPConnections,
+		SOCKS5Connections:   stats.SOCKS5Connections,
+		RejectedConnections: stats.RejectedConnections,
+		BytesSent:           stats.BytesSent,
+		BytesReceived:       stats.BytesReceived,
+		UploadSpeed:         stats.UploadSpeed,
+		DownloadSpeed:       stats.DownloadSpeed,
+		CloseReasons:        stats.CloseReasons,
+		RateLimits:          rateLimits,
+		Groups:              groups,
+		Uptime:              stats.Uptime.Round(time.Second).String(),
+		RateLimitsChanged:   s.manager.RateLimitsChanged(),
+	})
+}
+
+// handleStatsHistory returns traffic history, e.g.
+// ?from=2024-05-01T00:00:00Z&to=2024-05-02T00:00:00Z&resolution=hour
+func (s *Server) handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.manager == nil || s.manager.History() == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "statistics not enabled")
+		return
+	}
+
+	query := r.URL.Query()
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		t, err := parseHistoryTime(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+			return
+		}
+		to = t
+	}
+	from := to.Add(-time.Hour)
+	if v := query.Get("from"); v != "" {
+		t, err := parseHistoryTime(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+			return
+		}
+		from = t
+	}
+	if from.After(to) {
+		writeJSONError(w, http.StatusBadRequest, "from is after to")
+		return
+	}
+
+	// Minutes are kept for a day, so longer ranges default to hours
+	resolution := query.Get("resolution")
+	if resolution == "" {
+		resolution = stats.ResolutionMinute
+		if to.Sub(from) > 24*time.Hour {
+			resolution = stats.ResolutionHour
+		}
+	}
+
+	points, err := s.manager.History().Query(resolution, from, to)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, HistoryResponse{
+		Resolution: resolution,
+		From:       from,
+		To:         to,
+		Points:     points,
 	})
 }
 
+// parseHistoryTime parses an RFC 3339 time or Unix seconds
+func parseHistoryTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
 // handleSpeedTest runs an active speed test
 func (s *Server) handleSpeedTest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -178,7 +370,7 @@ func (s *Server) handleSpeedTest(w http.ResponseWriter, r *http.Request) {
 
 // handleConfig returns current configuration (sanitized)
 func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
 		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
@@ -188,9 +380,14 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == http.MethodPatch {
+		s.handleConfigPatch(w, r)
+		return
+	}
+
 	cfg := s.manager.GetConfig()
 	response := ConfigResponse{
-		Name:   s.config.Name,
+		Name:   cfg.Name,
 		Server: cfg.Shadowsocks.Server,
 		Cipher: cfg.Shadowsocks.Cipher,
 		Plugin: cfg.Shadowsocks.Plugin,
@@ -210,6 +407,20 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 		response.SOCKS5 = cfg.Proxies.SOCKS5Listen
 	}
 
+	for _, in := range cfg.AllInbounds() {
+		response.Inbounds = append(response.Inbounds, InboundInfo{
+			Tag:    in.Tag,
+			Type:   in.Type,
+			Listen: in.Listen,
+			Server: in.Server,
+			Target: in.Target,
+			Auth:   in.Auth != nil,
+		})
+	}
+	for _, srv := range cfg.Servers {
+		response.Servers = append(response.Servers, srv.Name)
+	}
+
 	writeJSON(w, http.StatusOK, response)
 }
 
@@ -237,53 +448,479 @@ func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Build new config
+	// Build new config; validation fills in the default cipher
 	newConfig := config.ShadowsocksConfig{
 		Server:     req.Server,
 		Password:   req.Password,
 		Cipher:     req.Cipher,
 		Plugin:     req.Plugin,
 		PluginOpts: req.PluginOpts,
-		Timeout:    300, // Use default timeout
+		Timeout:    req.Timeout,
+	}
+
+	sections, err := s.manager.ReloadConfig(newConfig)
+	writeReloadResult(w, sections, err)
+}
+
+// handleConfigPatch hot-reloads the current configuration with a JSON merge
+// patch applied, returning the resulting configuration (sanitized)
+func (s *Server) handleConfigPatch(w http.ResponseWriter, r *http.Request) {
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+
+	// Patched under the reload lock, so concurrent changes are kept
+	var patched *config.Config
+	sections, err := s.manager.UpdateConfig(func(next *config.Config) error {
+		p, err := next.Patch(patch)
+		if err != nil {
+			return fmt.Errorf("%w: %v", server.ErrInvalidConfig, err)
+		}
+		*next = *p
+		patched = next
+		return nil
+	}, server.SourceAPI, apiSettingsCheck(r))
+	if err != nil {
+		writeReloadResult(w, sections, err)
+		return
+	}
+
+	cfg, err := patched.Sanitized()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	message := "Configuration reloaded successfully"
+	if len(sections) == 0 {
+		message = "Configuration unchanged"
+	}
+	writeJSON(w, http.StatusOK, ReloadResponse{
+		Status:   "ok",
+		Message:  message,
+		Sections: sections,
+		Config:   cfg,
+	})
+}
+
+// handleConfigHistory lists the applied configuration revisions, newest first
+func (s *Server) handleConfigHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.manager.Revisions())
+}
+
+// handleConfigRollback hot-reloads a previous configuration revision
+func (s *Server) handleConfigRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
+	rev, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/config/rollback/"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid revision")
+		return
+	}
+
+	sections, err := s.manager.Rollback(rev, apiSettingsCheck(r))
+	if errors.Is(err, server.ErrRevisionNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeReloadResult(w, sections, err)
+}
+
+// apiSettingsCheck rejects changes to the api settings unless the token of r
+// has every scope, so tokens cannot grant themselves scopes, disable
+// authentication or bring back revoked tokens
+func apiSettingsCheck(r *http.Request) server.ConfigCheck {
+	return func(old, next *config.Config) error {
+		token := tokenFrom(r.Context())
+		if token == nil || token.HasScope(config.ScopeAll) {
+			return nil
+		}
+		for _, change := range config.Diff(old, next) {
+			if change.Section() == "api" {
+				return fmt.Errorf("token %s lacks scope %s to change %s", token.Name, config.ScopeAll, change.Path)
+			}
+		}
+		return nil
+	}
+}
+
+// writeReloadResult reports a reload with its per-section results
+func writeReloadResult(w http.ResponseWriter, sections []server.SectionResult, err error) {
+	switch {
+	case errors.Is(err, server.ErrInvalidConfig):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, server.ErrNotAllowed):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, ReloadResponse{
+			Status:   "error",
+			Message:  err.Error(),
+			Sections: sections,
+		})
+	case len(sections) == 0:
+		writeJSON(w, http.StatusOK, ReloadResponse{
+			Status:   "ok",
+			Message:  "Configuration unchanged",
+			Sections: sections,
+		})
+	default:
+		writeJSON(w, http.StatusOK, ReloadResponse{
+			Status:   "ok",
+			Message:  "Configuration reloaded successfully",
+			Sections: sections,
+		})
+	}
+}
+
+// handleServers lists the upstream servers with their dial health and latency
+func (s *Server) handleServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
+	cfg := s.manager.GetConfig()
+	servers := append([]config.ShadowsocksConfig{cfg.Shadowsocks}, cfg.Servers...)
+	servers[0].Name = config.DefaultServerName
+	selected := s.manager.SelectedServer()
+
+	var metrics stats.Metrics
+	if s.collector != nil {
+		metrics = s.collector.Metrics()
+	}
+
+	list := make([]ServerInfo, 0, len(servers))
+	for _, srv := range servers {
+		info := ServerInfo{
+			Name:     srv.Name,
+			Address:  srv.Server,
+			Cipher:   srv.Cipher,
+			Plugin:   srv.Plugin,
+			Selected: srv.Name == selected,
+			Healthy:  true,
+		}
+		for _, d := range metrics.Dials {
+			if d.Server != srv.Name {
+				continue
+			}
+			info.Healthy = d.Healthy
+			info.Dials = d.Latency.Count
+			info.DialErrors = d.Errors
+			if d.Latency.Count > 0 {
+				info.AvgLatencyMS = d.Latency.Sum / float64(d.Latency.Count) * 1000
+			}
+		}
+		for _, n := range metrics.Connections {
+			if n.Server == srv.Name {
+				info.ActiveConnections += n.Active
+			}
+		}
+		list = append(list, info)
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleSelectServer selects the server for new connections of inbounds
+// without a server setting
+func (s *Server) handleSelectServer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
 	}
 
-	// Set default cipher if not provided
-	if newConfig.Cipher == "" {
-		newConfig.Cipher = "AEAD_CHACHA20_POLY1305"
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
+	var req SelectServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	if _, ok := s.manager.GetConfig().Server(req.Name); !ok || req.Name == "" {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown server %q", req.Name))
+		return
+	}
+
+	if err := s.manager.SelectServer(req.Name); err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, SuccessResponse{
+		Status:  "ok",
+		Message: fmt.Sprintf("Selected server %s", req.Name),
+	})
+}
+
+// handleLimits returns or updates the bandwidth limits
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
+	rates := s.manager.RateLimits()
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, LimitsResponse{Limits: rates.Limits(), Changed: s.manager.RateLimitsChanged()})
+		return
+	}
+
+	var req LimitsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+
+	var global *ratelimit.Limit
+	if req.Global != nil {
+		limit := req.Global.Limit()
+		global = &limit
+	}
+	inbounds := make(map[string]ratelimit.Limit)
+	for tag, rate := range req.Inbounds {
+		inbounds[tag] = rate.Limit()
+	}
+	users := make(map[string]ratelimit.Limit)
+	for name, rate := range req.Users {
+		users[name] = rate.Limit()
+	}
+	if err := s.manager.UpdateRateLimits(global, inbounds, users); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limits := rates.Limits()
+	slog.Info("Bandwidth limits updated until the next reload",
+		"upload_rate", limits.Global.UploadRate,
+		"download_rate", limits.Global.DownloadRate,
+		"inbounds", len(req.Inbounds),
+		"users", len(req.Users))
+	writeJSON(w, http.StatusOK, LimitsResponse{Limits: limits, Changed: true})
+}
+
+// handleQuotas returns the usage and state of every traffic quota
+func (s *Server) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
+	quotas := s.manager.Quotas()
+	if quotas == nil {
+		writeJSONError(w, http.StatusNotFound, "quotas not configured")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, quotas.Status())
+}
+
+// handleConnections lists open connections, or closes all of them
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.collector == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "statistics not enabled")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, s.collector.Connections())
+		return
+	}
+
+	n := s.collector.CloseAllConnections()
+	slog.Info("Connections closed via API", "count", n)
+	writeJSON(w, http.StatusOK, SuccessResponse{
+		Status:  "ok",
+		Message: fmt.Sprintf("Closed %d connections", n),
+	})
+}
+
+// handleConnection closes the connection given by /connections/{id}
+func (s *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
 	}
 
-	// Reload configuration
-	if err := s.manager.ReloadConfig(newConfig); err != nil {
-		slog.Error("Configuration reload failed", "error", err)
-		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("reload failed: %v", err))
+	if s.collector == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "statistics not enabled")
 		return
 	}
 
-	slog.Info("Configuration reloaded successfully")
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/connections/"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+
+	if !s.collector.CloseConnection(id) {
+		writeJSONError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+
+	slog.Info("Connection closed via API", "id", id)
 	writeJSON(w, http.StatusOK, SuccessResponse{
 		Status:  "ok",
-		Message: "Configuration reloaded successfully",
+		Message: fmt.Sprintf("Connection %d closed", id),
 	})
 }
 
-// handleStop initiates graceful shutdown
+// handlePAC serves the generated proxy auto-config file
+func (s *Server) handlePAC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
+	script := s.manager.PACScript(r.Host)
+	if script == nil {
+		writeJSONError(w, http.StatusNotFound, "PAC file not enabled")
+		return
+	}
+
+	w.Header().Set("Content-Type", pac.ContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(script)
+}
+
+// handleStop initiates graceful shutdown, as on SIGTERM
 func (s *Server) handleStop(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
 	writeJSON(w, http.StatusOK, SuccessResponse{
 		Status:  "ok",
 		Message: "Shutdown initiated",
 	})
 
-	// Trigger shutdown asynchronously
-	go func() {
-		time.Sleep(100 * time.Millisecond) // Give time for response to be sent
-		slog.Info("Shutdown requested via API")
-		// TODO: Implement actual shutdown trigger
-	}()
+	// The API server finishes this response before it shuts down
+	s.manager.Stop()
+}
+
+// handleRestart shuts down gracefully and starts light-ss again in place
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
+	if err := s.manager.CanRestart(); err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, SuccessResponse{
+		Status:  "ok",
+		Message: "Restart initiated",
+	})
+
+	s.manager.Restart()
+}
+
+// handleDrain stops accepting connections and waits for open ones to
+// finish, e.g. ?timeout=60s (default 30s)
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if s.manager == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "manager not available")
+		return
+	}
+
+	timeout := defaultDrainTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := parseTimeout(v)
+		if err != nil || d <= 0 || d > maxDrainTimeout {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid timeout (max %s)", maxDrainTimeout))
+			return
+		}
+		timeout = d
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	remaining := s.manager.Drain(ctx)
+
+	status := "drained"
+	if remaining > 0 {
+		status = "timeout"
+	}
+	writeJSON(w, http.StatusOK, DrainResponse{
+		Status:    status,
+		Remaining: remaining,
+		Duration:  time.Since(start).Round(time.Millisecond).String(),
+	})
+}
+
+// parseTimeout parses a duration like "90s" or a number of seconds
+func parseTimeout(v string) (time.Duration, error) {
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	return time.ParseDuration(v)
 }
 
 // Helper functions
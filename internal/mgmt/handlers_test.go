@@ -0,0 +1,158 @@
+package mgmt
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/events"
+	"github.com/xrdavies/light-ss/internal/server"
+)
+
+// testTokens are an admin token with every scope, a deploy token that can
+// read and change the configuration and a ci token that reads stats
+var testTokens = []config.APITokenConfig{
+	{Name: "admin", Token: "admin-secret", Scopes: []string{config.ScopeAll}},
+	{Name: "deploy", Token: "deploy-secret", Scopes: []string{config.ScopeConfigRead, config.ScopeConfigWrite}},
+	{Name: "ci", Token: "ci-secret", Scopes: []string{config.ScopeStatsRead}},
+}
+
+// newTestServer returns an API server accepting tokens. Inbounds are not started.
+func newTestServer(t *testing.T, tokens []config.APITokenConfig) *Server {
+	t.Helper()
+	cfg := &config.Config{
+		Shadowsocks: config.ShadowsocksConfig{Server: "127.0.0.1:8388", Password: "pass", Cipher: "chacha20-ietf-poly1305"},
+		Inbounds:    []config.InboundConfig{{Type: "socks5", Listen: "127.0.0.1:0"}},
+		API: config.APIConfig{
+			Enabled: true,
+			Listen:  "127.0.0.1:0",
+			Tokens:  tokens,
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	mgr, err := server.NewManager(cfg, events.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(cfg, mgr, mgr.GetCollector(), nil)
+}
+
+// call sends a request with a bearer token and returns the response status
+func call(t *testing.T, s *Server, method, path, token, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestConfigChangeAPIScope(t *testing.T) {
+	escalate := `{"api": {"tokens": [{"name": "deploy", "token": "deploy-secret", "scopes": ["*"]}]}}`
+
+	t.Run("patch", func(t *testing.T) {
+		s := newTestServer(t, testTokens)
+		if code := call(t, s, http.MethodPatch, "/config", "deploy-secret", escalate); code != http.StatusForbidden {
+			t.Errorf("deploy changing api.tokens: status %d, want 403", code)
+		}
+		if code := call(t, s, http.MethodPatch, "/config", "deploy-secret", `{"api": {"token": null, "tokens": null}}`); code != http.StatusForbidden {
+			t.Errorf("deploy disabling authentication: status %d, want 403", code)
+		}
+		if code := call(t, s, http.MethodPatch, "/config", "deploy-secret", `{"stats": {"interval": 30}}`); code != http.StatusOK {
+			t.Errorf("deploy changing stats: status %d, want 200", code)
+		}
+		if code := call(t, s, http.MethodPatch, "/config", "admin-secret", escalate); code != http.StatusOK {
+			t.Errorf("admin changing api.tokens: status %d, want 200", code)
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		s := newTestServer(t, testTokens)
+
+		// Revoke the ci token, then try to bring it back with a rollback
+		revoke := `{"api": {"tokens": [{"name": "admin", "token": "admin-secret", "scopes": ["*"]},
+			{"name": "deploy", "token": "deploy-secret", "scopes": ["config:read", "config:write"]}]}}`
+		if code := call(t, s, http.MethodPatch, "/config", "admin-secret", revoke); code != http.StatusOK {
+			t.Fatalf("admin revoking ci: status %d, want 200", code)
+		}
+		if code := call(t, s, http.MethodGet, "/stats", "ci-secret", ""); code != http.StatusUnauthorized {
+			t.Fatalf("revoked ci token: status %d, want 401", code)
+		}
+
+		if code := call(t, s, http.MethodPost, "/config/rollback/1", "deploy-secret", ""); code != http.StatusForbidden {
+			t.Errorf("deploy restoring a revoked token: status %d, want 403", code)
+		}
+		if code := call(t, s, http.MethodGet, "/stats", "ci-secret", ""); code != http.StatusUnauthorized {
+			t.Errorf("revoked ci token after rejected rollback: status %d, want 401", code)
+		}
+		if code := call(t, s, http.MethodPost, "/config/rollback/1", "admin-secret", ""); code != http.StatusOK {
+			t.Errorf("admin rollback: status %d, want 200", code)
+		}
+	})
+}
+
+func TestConfigPatchConcurrent(t *testing.T) {
+	s := newTestServer(t, testTokens)
+
+	// Every patch adds its own user limit; none may be lost
+	const patches = 20
+	var wg sync.WaitGroup
+	for i := 0; i < patches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"limits": {"users": {"user%d": {"upload_rate": 1000}}}}`, i)
+			if code := call(t, s, http.MethodPatch, "/config", "admin-secret", body); code != http.StatusOK {
+				t.Errorf("patch %d: status %d, want 200", i, code)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if users := s.manager.GetConfig().Limits.Users; len(users) != patches {
+		t.Errorf("%d user limits after %d patches, want all of them", len(users), patches)
+	}
+}
+
+func TestLimitsUpdate(t *testing.T) {
+	s := newTestServer(t, testTokens)
+
+	if code := call(t, s, http.MethodPut, "/limits", "admin-secret", `{"inbounds": {"nope": {"upload_rate": 1000}}}`); code != http.StatusBadRequest {
+		t.Errorf("unknown inbound: status %d, want 400", code)
+	}
+	if code := call(t, s, http.MethodPut, "/limits", "admin-secret", `{"users": {"nobody": {"upload_rate": 1000}}}`); code != http.StatusBadRequest {
+		t.Errorf("unknown user: status %d, want 400", code)
+	}
+	if s.manager.RateLimitsChanged() {
+		t.Fatal("rejected updates reported as changed")
+	}
+
+	tag := s.manager.GetConfig().AllInbounds()[0].Tag
+	body := fmt.Sprintf(`{"inbounds": {%q: {"upload_rate": 1000}}}`, tag)
+	if code := call(t, s, http.MethodPut, "/limits", "admin-secret", body); code != http.StatusOK {
+		t.Fatalf("known inbound: status %d, want 200", code)
+	}
+	if !s.manager.RateLimitsChanged() {
+		t.Error("runtime limits not reported as changed")
+	}
+	if limits := s.manager.RateLimits().Limits(); limits.Inbounds[tag].UploadRate != 1000 {
+		t.Errorf("inbound %q upload rate %d, want 1000", tag, limits.Inbounds[tag].UploadRate)
+	}
+
+	// The next configuration change restores the configured limits
+	if code := call(t, s, http.MethodPatch, "/config", "admin-secret", `{"stats": {"interval": 30}}`); code != http.StatusOK {
+		t.Fatalf("patch: status %d, want 200", code)
+	}
+	if s.manager.RateLimitsChanged() {
+		t.Error("runtime limits still reported as changed after a reload")
+	}
+	if limits := s.manager.RateLimits().Limits(); limits.Inbounds[tag].UploadRate != 0 {
+		t.Errorf("inbound %q upload rate %d after a reload, want 0", tag, limits.Inbounds[tag].UploadRate)
+	}
+}
@@ -0,0 +1,198 @@
+package mgmt
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/events"
+	"github.com/xrdavies/light-ss/internal/quota"
+)
+
+// metricsContentType is the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// handleMetrics exports statistics in the Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+	if s.collector != nil {
+		s.writeStatsMetrics(m)
+	}
+	if s.manager != nil {
+		if quotas := s.manager.Quotas(); quotas != nil {
+			writeQuotaMetrics(m, quotas.Status())
+		}
+		if bus := s.manager.Events(); bus != nil {
+			writeEventMetrics(m, bus)
+		}
+	}
+	writeRuntimeMetrics(m)
+	m.w.Flush()
+}
+
+// writeStatsMetrics writes the counters of the stats collector
+func (s *Server) writeStatsMetrics(m *metricsWriter) {
+	stats := s.collector.GetStats()
+	metrics := s.collector.Metrics()
+
+	m.family("light_ss_uptime_seconds", "gauge", "Time since light-ss started.")
+	m.sample("light_ss_uptime_seconds", nil, stats.Uptime.Seconds())
+
+	m.family("light_ss_connections_total", "counter", "Proxied connections by proxy type, inbound and server.")
+	for _, n := range metrics.Connections {
+		m.sample("light_ss_connections_total", []string{"type", n.ProxyType, "inbound", n.Inbound, "server", n.Server}, float64(n.Total))
+	}
+	m.family("light_ss_connections_active", "gauge", "Open proxied connections by proxy type, inbound and server.")
+	for _, n := range metrics.Connections {
+		m.sample("light_ss_connections_active", []string{"type", n.ProxyType, "inbound", n.Inbound, "server", n.Server}, float64(n.Active))
+	}
+
+	m.family("light_ss_connections_rejected_total", "counter", "Client connections refused by allow/deny lists, limits or quotas.")
+	m.sample("light_ss_connections_rejected_total", nil, float64(stats.RejectedConnections))
+
+	m.family("light_ss_connections_closed_total", "counter", "Connections refused or closed by light-ss by reason.")
+	for _, reason := range sortedKeys(stats.CloseReasons) {
+		m.sample("light_ss_connections_closed_total", []string{"reason", reason}, float64(stats.CloseReasons[reason]))
+	}
+
+	m.family("light_ss_bytes_sent_total", "counter", "Bytes sent from clients to targets.")
+	m.sample("light_ss_bytes_sent_total", nil, float64(stats.BytesSent))
+	m.family("light_ss_bytes_received_total", "counter", "Bytes received from targets for clients.")
+	m.sample("light_ss_bytes_received_total", nil, float64(stats.BytesReceived))
+
+	m.family("light_ss_upload_speed_bytes", "gauge", "Upload speed in bytes per second over the last 10 seconds.")
+	m.sample("light_ss_upload_speed_bytes", nil, float64(stats.UploadSpeed))
+	m.family("light_ss_download_speed_bytes", "gauge", "Download speed in bytes per second over the last 10 seconds.")
+	m.sample("light_ss_download_speed_bytes", nil, float64(stats.DownloadSpeed))
+
+	m.family("light_ss_dial_duration_seconds", "histogram", "Latency of successful dials to the shadowsocks servers.")
+	for _, d := range metrics.Dials {
+		for i, bound := range d.Latency.Buckets {
+			m.sample("light_ss_dial_duration_seconds_bucket", []string{"server", d.Server, "le", formatFloat(bound)}, float64(d.Latency.Counts[i]))
+		}
+		m.sample("light_ss_dial_duration_seconds_bucket", []string{"server", d.Server, "le", "+Inf"}, float64(d.Latency.Count))
+		m.sample("light_ss_dial_duration_seconds_sum", []string{"server", d.Server}, d.Latency.Sum)
+		m.sample("light_ss_dial_duration_seconds_count", []string{"server", d.Server}, float64(d.Latency.Count))
+	}
+
+	m.family("light_ss_dial_errors_total", "counter", "Failed dials to the shadowsocks servers by reason.")
+	for _, d := range metrics.Dials {
+		for _, reason := range sortedKeys(d.Errors) {
+			m.sample("light_ss_dial_errors_total", []string{"server", d.Server, "reason", reason}, float64(d.Errors[reason]))
+		}
+	}
+
+	m.family("light_ss_plugin_handshake_failures_total", "counter", "Failed plugin handshakes with the shadowsocks servers.")
+	for _, d := range metrics.Dials {
+		m.sample("light_ss_plugin_handshake_failures_total", []string{"server", d.Server}, float64(d.PluginFailures))
+	}
+}
+
+// writeQuotaMetrics writes the usage and limits of traffic quotas
+func writeQuotaMetrics(m *metricsWriter, quotas []quota.Status) {
+	m.family("light_ss_quota_used_bytes", "gauge", "Traffic counted against quotas in the current period.")
+	for _, q := range quotas {
+		m.sample("light_ss_quota_used_bytes", []string{"scope", q.Scope, "name", q.Name, "period", quota.PeriodDaily}, float64(q.DailyUsed))
+		m.sample("light_ss_quota_used_bytes", []string{"scope", q.Scope, "name", q.Name, "period", quota.PeriodMonthly}, float64(q.MonthlyUsed))
+	}
+
+	m.family("light_ss_quota_limit_bytes", "gauge", "Configured traffic quotas.")
+	for _, q := range quotas {
+		if q.DailyLimit > 0 {
+			m.sample("light_ss_quota_limit_bytes", []string{"scope", q.Scope, "name", q.Name, "period", quota.PeriodDaily}, float64(q.DailyLimit))
+		}
+		if q.MonthlyLimit > 0 {
+			m.sample("light_ss_quota_limit_bytes", []string{"scope", q.Scope, "name", q.Name, "period", quota.PeriodMonthly}, float64(q.MonthlyLimit))
+		}
+	}
+}
+
+// writeEventMetrics writes the state of the real-time event bus
+func writeEventMetrics(m *metricsWriter, bus *events.Bus) {
+	m.family("light_ss_event_subscribers", "gauge", "Clients subscribed to /events.")
+	m.sample("light_ss_event_subscribers", nil, float64(bus.Subscribers()))
+	m.family("light_ss_events_dropped_total", "counter", "Events dropped for subscribers that fell behind.")
+	m.sample("light_ss_events_dropped_total", nil, float64(bus.Dropped()))
+}
+
+// writeRuntimeMetrics writes Go runtime metrics
+func writeRuntimeMetrics(m *metricsWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	m.family("go_info", "gauge", "Information about the Go environment.")
+	m.sample("go_info", []string{"version", runtime.Version()}, 1)
+	m.family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	m.sample("go_goroutines", nil, float64(runtime.NumGoroutine()))
+	m.family("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	m.sample("go_memstats_alloc_bytes", nil, float64(mem.Alloc))
+	m.family("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	m.sample("go_memstats_heap_inuse_bytes", nil, float64(mem.HeapInuse))
+	m.family("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.")
+	m.sample("go_memstats_sys_bytes", nil, float64(mem.Sys))
+	m.family("go_memstats_mallocs_total", "counter", "Total number of heap objects allocated.")
+	m.sample("go_memstats_mallocs_total", nil, float64(mem.Mallocs))
+	m.family("go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	m.sample("go_gc_cycles_total", nil, float64(mem.NumGC))
+	m.family("go_gc_pause_seconds_total", "counter", "Total time spent in GC stop-the-world pauses.")
+	m.sample("go_gc_pause_seconds_total", nil, (time.Duration(mem.PauseTotalNs)).Seconds())
+}
+
+// metricsWriter writes metric families in the Prometheus text format
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+// family writes the HELP and TYPE lines of a metric
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a value with labels given as name/value pairs
+func (m *metricsWriter) sample(name string, labels []string, value float64) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			fmt.Fprintf(m.w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		m.w.WriteByte('}')
+	}
+	m.w.WriteByte(' ')
+	m.w.WriteString(formatFloat(value))
+	m.w.WriteByte('\n')
+}
+
+// labelEscaper escapes label values as required by the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatFloat formats a sample value or bucket bound
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,20 +1,118 @@
 package mgmt
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"reflect"
 	"strings"
 	"time"
+
+	"github.com/xrdavies/light-ss/internal/config"
 )
 
-// withAuth wraps a handler with authentication middleware
-func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
+// apiToken is a configured token with the SHA-256 digest of its value
+type apiToken struct {
+	config.APITokenConfig
+	digest []byte
+}
+
+// tokenCheckInterval is how often requests check the token files for changes
+const tokenCheckInterval = time.Second
+
+// tokenSettings are the API settings the token list is built from
+type tokenSettings struct {
+	token  string
+	tokens []config.APITokenConfig
+}
+
+// apiTokens returns the configured tokens, rebuilt when reloads change them
+// or a token_file changes; api.token is a token named "token" with every scope
+func (s *Server) apiTokens() []apiToken {
+	s.tokensMu.Lock()
+	defer s.tokensMu.Unlock()
+
+	api := s.manager.GetConfig().API
+	current := tokenSettings{token: api.Token, tokens: api.Tokens}
+	if s.tokens != nil && reflect.DeepEqual(current, s.tokenSettings) {
+		if time.Since(s.tokensChecked) < tokenCheckInterval {
+			return s.tokens
+		}
+		s.tokensChecked = time.Now()
+		if equalTimes(tokenFileTimes(current.tokens), s.tokenModTimes) {
+			return s.tokens
+		}
+		slog.Info("API token files changed, reloading tokens")
+	}
+
+	// Stat before reading, so a file replaced during the read is read again
+	modTimes := tokenFileTimes(current.tokens)
+	list := current.tokens
+	if current.token != "" {
+		list = append([]config.APITokenConfig{{Name: "token", Token: current.token, Scopes: []string{config.ScopeAll}}}, list...)
+	}
+	tokens := make([]apiToken, 0, len(list))
+	for _, t := range list {
+		digest, err := t.Digest()
+		if err != nil {
+			slog.Warn("API token disabled", "token", t.Name, "error", err)
+			continue
+		}
+		tokens = append(tokens, apiToken{APITokenConfig: t, digest: digest})
+	}
+	s.tokens, s.tokenSettings = tokens, current
+	s.tokenModTimes, s.tokensChecked = modTimes, time.Now()
+	return tokens
+}
+
+// tokenFileTimes returns the modification times of the token files, the zero
+// time for files that cannot be read
+func tokenFileTimes(tokens []config.APITokenConfig) []time.Time {
+	var modTimes []time.Time
+	for _, t := range tokens {
+		if t.TokenFile == "" {
+			continue
+		}
+		var modTime time.Time
+		if info, err := os.Stat(t.TokenFile); err == nil {
+			modTime = info.ModTime()
+		}
+		modTimes = append(modTimes, modTime)
+	}
+	return modTimes
+}
+
+// tokenKey is the context key of the token a request authenticated with
+type tokenKey struct{}
+
+// tokenFrom returns the token a request authenticated with, nil when no
+// tokens are configured
+func tokenFrom(ctx context.Context) *apiToken {
+	token, _ := ctx.Value(tokenKey{}).(*apiToken)
+	return token
+}
+
+// withAuth wraps a handler with authentication middleware. GET and HEAD
+// requests need a token with the read scope, other methods the write scope,
+// and calls with other methods are logged with the token name for auditing.
+func (s *Server) withAuth(read, write string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Skip auth if no token is configured
-		if s.token == "" {
-			next(w, r)
+		scope := read
+		mutating := r.Method != http.MethodGet && r.Method != http.MethodHead
+		if mutating {
+			scope = write
+		}
+
+		// Skip auth if no token is configured; read on every request as reloads may change it
+		if api := s.manager.GetConfig().API; api.Token == "" && len(api.Tokens) == 0 {
+			s.audit(w, r, "", mutating, next)
 			return
 		}
+		tokens := s.apiTokens()
 
 		// Check Authorization header
 		auth := r.Header.Get("Authorization")
@@ -30,15 +128,60 @@ func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		token := strings.TrimPrefix(auth, bearerPrefix)
-		if token != s.token {
+		// Compare digests in constant time, checking every token
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, bearerPrefix)))
+		var token *apiToken
+		for i := range tokens {
+			if subtle.ConstantTimeCompare(tokens[i].digest, sum[:]) == 1 && token == nil {
+				token = &tokens[i]
+			}
+		}
+		if token == nil {
+			slog.Warn("API authentication failed", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
 			writeJSONError(w, http.StatusUnauthorized, "invalid token")
 			return
 		}
 
+		if !token.HasScope(scope) {
+			slog.Warn("API call denied", "token", token.Name, "scope", scope, "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			writeJSONError(w, http.StatusForbidden, fmt.Sprintf("token lacks scope %s", scope))
+			return
+		}
+
 		// Token valid, proceed
+		r = r.WithContext(context.WithValue(r.Context(), tokenKey{}, token))
+		s.audit(w, r, token.Name, mutating, next)
+	}
+}
+
+// audit calls next, logging mutating calls with the token name and response status
+func (s *Server) audit(w http.ResponseWriter, r *http.Request, token string, mutating bool, next http.HandlerFunc) {
+	if !mutating {
 		next(w, r)
+		return
 	}
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next(rec, r)
+	slog.Info("API audit",
+		"token", token,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote", r.RemoteAddr,
+		"status", rec.status,
+	)
+}
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
 }
 
 // withLogging wraps a handler with request logging
@@ -0,0 +1,42 @@
+package mgmt
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/config"
+)
+
+func TestTokenFileRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("old-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, []config.APITokenConfig{{Name: "rotated", TokenFile: file, Scopes: []string{config.ScopeConfigRead}}})
+
+	if code := call(t, s, http.MethodGet, "/config/history", "old-secret", ""); code != http.StatusOK {
+		t.Fatalf("token from file: status %d, want 200", code)
+	}
+
+	// Rotate the token without a reload; the file time may not move on coarse clocks
+	if err := os.WriteFile(file, []byte("new-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	s.tokensMu.Lock()
+	s.tokensChecked = time.Time{} // Skip the wait for the next check
+	s.tokensMu.Unlock()
+
+	if code := call(t, s, http.MethodGet, "/config/history", "old-secret", ""); code != http.StatusUnauthorized {
+		t.Errorf("rotated out token: status %d, want 401", code)
+	}
+	if code := call(t, s, http.MethodGet, "/config/history", "new-secret", ""); code != http.StatusOK {
+		t.Errorf("rotated in token: status %d, want 200", code)
+	}
+}
@@ -2,11 +2,15 @@ package mgmt
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/listener"
 	"github.com/xrdavies/light-ss/internal/server"
 	"github.com/xrdavies/light-ss/internal/stats"
 )
@@ -14,25 +18,29 @@ import (
 // Server is the management API HTTP server
 type Server struct {
 	listen     string
-	token      string
 	manager    *server.Manager
 	collector  *stats.Collector
 	speedTest  *SpeedTest
 	httpServer *http.Server
 	router     *http.ServeMux
-	config     *config.Config // Full config for accessing instance name
+	closing    chan struct{} // Closed on shutdown to end event streams
+
+	tokensMu      sync.Mutex
+	tokens        []apiToken    // Built from tokenSettings
+	tokenSettings tokenSettings // API settings tokens was built from
+	tokenModTimes []time.Time   // Of the token files tokens was read from
+	tokensChecked time.Time     // Last check of the token files for changes
 }
 
 // NewServer creates a new API server
 func NewServer(cfg *config.Config, mgr *server.Manager, collector *stats.Collector, speedTest *SpeedTest) *Server {
 	s := &Server{
 		listen:    cfg.API.Listen,
-		token:     cfg.API.Token,
 		manager:   mgr,
 		collector: collector,
 		speedTest: speedTest,
 		router:    http.NewServeMux(),
-		config:    cfg,
+		closing:   make(chan struct{}),
 	}
 
 	// Register routes
@@ -41,16 +49,45 @@ func NewServer(cfg *config.Config, mgr *server.Manager, collector *stats.Collect
 	return s
 }
 
+// instanceName returns the instance name of the current configuration
+func (s *Server) instanceName() string {
+	if s.manager == nil {
+		return ""
+	}
+	return s.manager.GetConfig().Name
+}
+
 // registerRoutes sets up all API endpoints
 func (s *Server) registerRoutes() {
 	// Wrap handlers with middleware
 	s.router.HandleFunc("/health", s.withLogging(s.handleHealth))
 	s.router.HandleFunc("/version", s.withLogging(s.handleVersion))
-	s.router.HandleFunc("/stats", s.withLogging(s.withAuth(s.handleStats)))
-	s.router.HandleFunc("/speedtest", s.withLogging(s.withAuth(s.handleSpeedTest)))
-	s.router.HandleFunc("/config", s.withLogging(s.withAuth(s.handleConfig)))
-	s.router.HandleFunc("/reload", s.withLogging(s.withAuth(s.handleReload)))
-	s.router.HandleFunc("/stop", s.withLogging(s.withAuth(s.handleStop)))
+	s.router.HandleFunc("/stats", s.withLogging(s.withAuth(config.ScopeStatsRead, config.ScopeStatsRead, s.handleStats)))
+	s.router.HandleFunc("/stats/history", s.withLogging(s.withAuth(config.ScopeStatsRead, config.ScopeStatsRead, s.handleStatsHistory)))
+	s.router.HandleFunc("/speedtest", s.withLogging(s.withAuth(config.ScopeSpeedTest, config.ScopeSpeedTest, s.handleSpeedTest)))
+	s.router.HandleFunc("/config", s.withLogging(s.withAuth(config.ScopeConfigRead, config.ScopeConfigWrite, s.handleConfig)))
+	s.router.HandleFunc("/config/history", s.withLogging(s.withAuth(config.ScopeConfigRead, config.ScopeConfigRead, s.handleConfigHistory)))
+	s.router.HandleFunc("/config/rollback/", s.withLogging(s.withAuth(config.ScopeConfigWrite, config.ScopeConfigWrite, s.handleConfigRollback)))
+	s.router.HandleFunc("/reload", s.withLogging(s.withAuth(config.ScopeConfigWrite, config.ScopeConfigWrite, s.handleReload)))
+	s.router.HandleFunc("/servers", s.withLogging(s.withAuth(config.ScopeStatsRead, config.ScopeStatsRead, s.handleServers)))
+	s.router.HandleFunc("/servers/select", s.withLogging(s.withAuth(config.ScopeConfigWrite, config.ScopeConfigWrite, s.handleSelectServer)))
+	s.router.HandleFunc("/limits", s.withLogging(s.withAuth(config.ScopeStatsRead, config.ScopeConfigWrite, s.handleLimits)))
+	s.router.HandleFunc("/quotas", s.withLogging(s.withAuth(config.ScopeStatsRead, config.ScopeConfigWrite, s.handleQuotas)))
+	s.router.HandleFunc("/connections", s.withLogging(s.withAuth(config.ScopeStatsRead, config.ScopeConfigWrite, s.handleConnections)))
+	s.router.HandleFunc("/connections/", s.withLogging(s.withAuth(config.ScopeConfigWrite, config.ScopeConfigWrite, s.handleConnection)))
+	s.router.HandleFunc("/metrics", s.withLogging(s.withAuth(config.ScopeStatsRead, config.ScopeStatsRead, s.handleMetrics)))
+	s.router.HandleFunc("/events", s.withLogging(s.withAuth(config.ScopeStatsRead, config.ScopeStatsRead, s.handleEvents)))
+	s.router.HandleFunc("/events/ws", s.withLogging(s.withAuth(config.ScopeStatsRead, config.ScopeStatsRead, s.handleEventsWS)))
+	s.router.HandleFunc("/stop", s.withLogging(s.withAuth(config.ScopeLifecycle, config.ScopeLifecycle, s.handleStop)))
+	s.router.HandleFunc("/restart", s.withLogging(s.withAuth(config.ScopeLifecycle, config.ScopeLifecycle, s.handleRestart)))
+	s.router.HandleFunc("/drain", s.withLogging(s.withAuth(config.ScopeLifecycle, config.ScopeLifecycle, s.handleDrain)))
+
+	// The dashboard page is public; it asks for the token and sends it with API calls
+	s.router.HandleFunc("/dashboard/", s.withLogging(dashboardHandler()))
+
+	// PAC/WPAD files are fetched by browsers, which cannot send bearer tokens
+	s.router.HandleFunc("/proxy.pac", s.withLogging(s.handlePAC))
+	s.router.HandleFunc("/wpad.dat", s.withLogging(s.handlePAC))
 }
 
 // Start starts the API server
@@ -60,9 +97,30 @@ func (s *Server) Start() error {
 		Handler: s.router,
 	}
 
-	slog.Info("Starting management API server", "address", s.listen)
+	// Load the certificate before listening, so a bad one fails fast
+	var certs *certStore
+	tlsConfig := s.manager.GetConfig().API.TLS
+	if tlsConfig != nil {
+		var err error
+		if certs, err = newCertStore(*tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	ln, err := listener.Listen(context.Background(), s.listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.listen, err)
+	}
+
+	if certs != nil {
+		ln = tls.NewListener(ln, &tls.Config{GetConfigForClient: certs.configForClient})
+		slog.Info("Starting management API server", "address", s.listen, "tls", true,
+			"client_certificates", tlsConfig.ClientCAFile != "")
+	} else {
+		slog.Info("Starting management API server", "address", s.listen)
+	}
 
-	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := s.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("API server error: %w", err)
 	}
 
@@ -73,6 +131,7 @@ func (s *Server) Start() error {
 func (s *Server) Shutdown(ctx context.Context) error {
 	if s.httpServer != nil {
 		slog.Info("Shutting down API server")
+		close(s.closing) // Event streams never end on their own
 		return s.httpServer.Shutdown(ctx)
 	}
 	return nil
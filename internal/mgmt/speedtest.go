@@ -11,7 +11,7 @@ import (
 
 // SpeedTest performs active speed tests through shadowsocks connection
 type SpeedTest struct {
-	ssClient *shadowsocks.Client
+	getClient func() *shadowsocks.Client // Returns the current client, which reloads replace
 }
 
 // SpeedTestResult holds the results of a speed test
@@ -20,10 +20,11 @@ type SpeedTestResult struct {
 	LatencyMS     int64 // latency in milliseconds
 }
 
-// NewSpeedTest creates a new speed test instance
-func NewSpeedTest(ssClient *shadowsocks.Client) *SpeedTest {
+// NewSpeedTest creates a new speed test instance testing the client
+// getClient returns at the start of each run
+func NewSpeedTest(getClient func() *shadowsocks.Client) *SpeedTest {
 	return &SpeedTest{
-		ssClient: ssClient,
+		getClient: getClient,
 	}
 }
 
@@ -32,11 +33,12 @@ func NewSpeedTest(ssClient *shadowsocks.Client) *SpeedTest {
 func (st *SpeedTest) Run(durationSec int, latencyOnly bool) (*SpeedTestResult, error) {
 	var latency int64
 	var err error
+	ssClient := st.getClient()
 
 	if latencyOnly {
 		// For latency-only mode, use google.com for faster and more reliable testing
 		latencyStart := time.Now()
-		conn, err := st.ssClient.Dial("tcp", "www.google.com:80")
+		conn, err := ssClient.Dial("tcp", "www.google.com:80")
 		if err != nil {
 			return nil, fmt.Errorf("failed to connect: %w", err)
 		}
@@ -51,7 +53,7 @@ func (st *SpeedTest) Run(durationSec int, latencyOnly bool) (*SpeedTestResult, e
 
 	// For full speed test, measure latency to cloudflare
 	latencyStart := time.Now()
-	conn, err := st.ssClient.Dial("tcp", "speed.cloudflare.com:443")
+	conn, err := ssClient.Dial("tcp", "speed.cloudflare.com:443")
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
@@ -71,7 +73,7 @@ func (st *SpeedTest) Run(durationSec int, latencyOnly bool) (*SpeedTestResult, e
 	// Use a custom HTTP client that uses shadowsocks connection
 	client := &http.Client{
 		Transport: &http.Transport{
-			Dial: st.ssClient.Dial,
+			Dial: ssClient.Dial,
 		},
 		Timeout: time.Duration(durationSec+5) * time.Second,
 	}
@@ -0,0 +1,138 @@
+package mgmt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/config"
+)
+
+// certCheckInterval is how often handshakes check the certificate files for changes
+const certCheckInterval = time.Second
+
+// certStore holds the TLS settings of the API, reloading the certificate,
+// key and client CAs when their files change. Until a changed set of files
+// loads, handshakes keep using the previous one.
+type certStore struct {
+	cfg config.APITLSConfig
+
+	mu       sync.Mutex
+	tls      *tls.Config
+	checked  time.Time   // Last check for changes
+	modTimes []time.Time // Of the files tls was loaded from
+}
+
+// newCertStore loads the configured certificate and client CAs
+func newCertStore(cfg config.APITLSConfig) (*certStore, error) {
+	c := &certStore{cfg: cfg, checked: time.Now()}
+	modTimes, err := c.stat()
+	if err != nil {
+		return nil, err
+	}
+	if c.tls, err = c.load(); err != nil {
+		return nil, err
+	}
+	c.modTimes = modTimes
+	return c, nil
+}
+
+// files returns the files the TLS settings are loaded from
+func (c *certStore) files() []string {
+	files := []string{c.cfg.CertFile, c.cfg.KeyFile}
+	if c.cfg.ClientCAFile != "" {
+		files = append(files, c.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// stat returns the modification times of the files
+func (c *certStore) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load API certificate: %w", err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// load reads the certificate, key and client CAs into TLS settings
+func (c *certStore) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load API certificate: %w", err)
+	}
+
+	settings := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if c.cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(c.cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load API client CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("failed to load API client CAs: no certificates in %s", c.cfg.ClientCAFile)
+		}
+		settings.ClientCAs = pool
+		settings.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return settings, nil
+}
+
+// configForClient returns the TLS settings for a handshake, reloading them
+// first if the files changed
+func (c *certStore) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < certCheckInterval {
+		return c.tls, nil
+	}
+	c.checked = time.Now()
+
+	modTimes, err := c.stat()
+	if err != nil {
+		slog.Warn("Keeping the current API certificate", "error", err)
+		return c.tls, nil
+	}
+	if equalTimes(modTimes, c.modTimes) {
+		return c.tls, nil
+	}
+
+	// Files are often replaced one at a time, so a failed load is retried
+	// once another file changes
+	c.modTimes = modTimes
+	settings, err := c.load()
+	if err != nil {
+		slog.Warn("Keeping the current API certificate", "error", err)
+		return c.tls, nil
+	}
+	c.tls = settings
+	slog.Info("API certificate reloaded", "cert_file", c.cfg.CertFile)
+	return c.tls, nil
+}
+
+// equalTimes reports whether two lists of times are the same
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
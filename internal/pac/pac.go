@@ -0,0 +1,160 @@
+package pac
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/listener"
+)
+
+// ContentType is the MIME type browsers expect for PAC and WPAD files
+const ContentType = "application/x-ns-proxy-autoconfig"
+
+// lanNetworks are always sent direct (loopback, private and link-local ranges)
+var lanNetworks = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"100.64.0.0/10",
+}
+
+// localSuffixes are domain suffixes that only resolve on the local network
+var localSuffixes = []string{"localhost", "local", "lan", "internal", "home.arpa"}
+
+// proxyEntry is a listener that browsers can use
+type proxyEntry struct {
+	kind string // unified, http or socks5
+	host string
+	port string
+}
+
+// File is a generated proxy auto-config script for the current listeners
+type File struct {
+	proxies []proxyEntry
+	rules   string // Pre-rendered direct rules (JavaScript)
+}
+
+// New builds a PAC file from the proxy listeners and direct list in cfg
+func New(cfg *config.Config) *File {
+	f := &File{}
+
+	for _, in := range cfg.AllInbounds() {
+		// Tunnels forward to a fixed target and can't act as a browser proxy
+		if in.Type != config.InboundTunnel {
+			f.addProxy(in.Type, in.Listen)
+		}
+	}
+
+	f.rules = renderRules(cfg.PAC.Direct)
+
+	return f
+}
+
+// addProxy records a listener if it is a TCP address browsers can reach
+func (f *File) addProxy(kind, listen string) {
+	if listener.Network(listen) != "tcp" {
+		return
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return
+	}
+	f.proxies = append(f.proxies, proxyEntry{kind: kind, host: host, port: port})
+}
+
+// Render returns the PAC script. requestHost is the host the client used to
+// fetch the file and replaces unspecified listen addresses (e.g. 0.0.0.0).
+func (f *File) Render(requestHost string) []byte {
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = h
+	}
+	if requestHost == "" {
+		requestHost = "127.0.0.1"
+	}
+
+	var routes []string
+	for _, p := range f.proxies {
+		host := p.host
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = requestHost
+		}
+		addr := net.JoinHostPort(host, p.port)
+
+		switch p.kind {
+		case "unified":
+			routes = append(routes, "PROXY "+addr, "SOCKS5 "+addr)
+		case "http":
+			routes = append(routes, "PROXY "+addr)
+		case "socks5":
+			routes = append(routes, "SOCKS5 "+addr, "SOCKS "+addr)
+		}
+	}
+
+	// Without any reachable listener there is nothing to proxy through
+	proxy := "DIRECT"
+	if len(routes) > 0 {
+		proxy = strings.Join(routes, "; ")
+	}
+
+	var b strings.Builder
+	b.WriteString("// Generated by light-ss\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  var isIP = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n")
+	b.WriteString("  if (isPlainHostName(host)) return \"DIRECT\";\n")
+	b.WriteString(f.rules)
+	fmt.Fprintf(&b, "  return %q;\n", proxy)
+	b.WriteString("}\n")
+
+	return []byte(b.String())
+}
+
+// renderRules renders the LAN bypass and the user's direct list as PAC conditions
+func renderRules(direct []string) string {
+	var b strings.Builder
+
+	for _, suffix := range localSuffixes {
+		writeDomainRule(&b, suffix)
+	}
+	for _, cidr := range lanNetworks {
+		writeNetRule(&b, cidr)
+	}
+
+	for _, entry := range direct {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			if _, _, err := net.ParseCIDR(entry); err == nil {
+				writeNetRule(&b, entry)
+			}
+		case net.ParseIP(entry) != nil:
+			fmt.Fprintf(&b, "  if (host == %q) return \"DIRECT\";\n", entry)
+		case strings.ContainsAny(entry, "*?"):
+			fmt.Fprintf(&b, "  if (shExpMatch(host, %q)) return \"DIRECT\";\n", entry)
+		default:
+			writeDomainRule(&b, strings.TrimPrefix(entry, "."))
+		}
+	}
+
+	return b.String()
+}
+
+// writeDomainRule matches a domain and all of its subdomains
+func writeDomainRule(b *strings.Builder, domain string) {
+	fmt.Fprintf(b, "  if (dnsDomainIs(host, %q) || host == %q) return \"DIRECT\";\n", "."+domain, domain)
+}
+
+// writeNetRule matches IPv4 literals inside a CIDR without resolving hostnames
+func writeNetRule(b *strings.Builder, cidr string) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ipnet.IP.To4() == nil {
+		return
+	}
+	mask := net.IP(ipnet.Mask).String()
+	fmt.Fprintf(b, "  if (isIP && isInNet(host, %q, %q)) return \"DIRECT\";\n", ipnet.IP.String(), mask)
+}
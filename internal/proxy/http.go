@@ -2,82 +2,146 @@ package proxy
 
 import (
 	"context"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
 
 	"github.com/elazarl/goproxy"
-	"github.com/xrdavies/light-ss/internal/shadowsocks"
-	"github.com/xrdavies/light-ss/internal/stats"
+	"github.com/xrdavies/light-ss/internal/pac"
 )
 
 // HTTPServer wraps an HTTP/HTTPS proxy server
 type HTTPServer struct {
+	tag        string
 	server     *http.Server
 	proxy      *goproxy.ProxyHttpServer
 	listenAddr string
-	ssClient   *shadowsocks.Client
-	collector  *stats.Collector
+	lnOpts     listenOptions
+	dialer     *dialer
 }
 
 // NewHTTPServer creates a new HTTP/HTTPS proxy server
-func NewHTTPServer(listen string, ssClient *shadowsocks.Client, collector *stats.Collector) (*HTTPServer, error) {
+func NewHTTPServer(opts Options) (*HTTPServer, error) {
+	h := &HTTPServer{
+		tag:        opts.Tag,
+		listenAddr: opts.Listen,
+		lnOpts:     newListenOptions(opts),
+		dialer:     newDialer(opts),
+	}
+
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = false
 
 	// Create custom transport that uses shadowsocks
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			conn, err := ssClient.DialContext(ctx, network, addr)
-			if err != nil {
-				return nil, err
-			}
-
-			// Wrap connection with stats tracking if collector is enabled
-			if collector != nil {
-				conn = stats.NewTrackedConn(conn, collector, "http", addr)
-			}
-
-			return conn, nil
+			return h.dialer.dial(ctx, "http", network, addr, false)
 		},
 	}
 
 	proxy.Tr = transport
 
+	// Check proxy credentials on plain HTTP requests
+	auth := opts.Auth
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if !checkProxyAuth(req, auth) {
+			slog.Debug("HTTP proxy authentication failed", "inbound", h.tag, "remote", req.RemoteAddr)
+			return req, newProxyAuthResponse(req)
+		}
+		req.Header.Del("Proxy-Authorization")
+		return req.WithContext(withClientString(req.Context(), req.RemoteAddr)), nil
+	})
+
 	// Handle HTTPS CONNECT requests
 	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		return goproxy.OkConnect, host
+		if !checkProxyAuth(ctx.Req, auth) {
+			slog.Debug("HTTP proxy authentication failed", "inbound", h.tag, "remote", ctx.Req.RemoteAddr)
+			ctx.Resp = newProxyAuthResponse(ctx.Req)
+			return goproxy.RejectConnect, host
+		}
+		return &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: h.handleConnect}, host
 	}))
 
-	server := &http.Server{
-		Addr:    listen,
+	// Requests addressed to the proxy itself can fetch the PAC file
+	proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var script []byte
+		if opts.PACScript != nil && req.Method == http.MethodGet && isPACPath(req.URL.Path) {
+			script = opts.PACScript(req.Host)
+		}
+		if script == nil {
+			http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", pac.ContentType)
+		w.Write(script)
+	})
+
+	h.proxy = proxy
+	h.server = &http.Server{
+		Addr:    opts.Listen,
 		Handler: proxy,
 	}
 
-	return &HTTPServer{
-		server:     server,
-		proxy:      proxy,
-		listenAddr: listen,
-		ssClient:   ssClient,
-		collector:  collector,
-	}, nil
+	if opts.Auth != nil {
+		slog.Info("HTTP proxy authentication enabled", "inbound", h.tag, "username", opts.Auth.Username)
+	}
+
+	return h, nil
+}
+
+// handleConnect tunnels a hijacked CONNECT request through shadowsocks
+func (h *HTTPServer) handleConnect(req *http.Request, clientConn net.Conn, ctx *goproxy.ProxyCtx) {
+	defer clientConn.Close()
+
+	host := req.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+
+	targetConn, err := h.dialer.dial(withClient(context.Background(), clientConn.RemoteAddr()), "http", "tcp", host, false)
+	if err != nil {
+		slog.Error("failed to connect to target", "inbound", h.tag, "host", host, "error", err)
+		io.WriteString(clientConn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+
+	io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	relay(clientConn, targetConn)
+}
+
+// newProxyAuthResponse builds a 407 response asking for basic credentials
+func newProxyAuthResponse(req *http.Request) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusProxyAuthRequired, "Proxy Authentication Required")
+	resp.Header.Set("Proxy-Authenticate", `Basic realm="light-ss"`)
+	return resp
+}
+
+// Tag returns the routing tag of the listener
+func (h *HTTPServer) Tag() string {
+	return h.tag
 }
 
 // Start starts the HTTP/HTTPS proxy server
-func (h *HTTPServer) Start() error {
-	slog.Info("HTTP/HTTPS proxy started", "listen", h.listenAddr)
+func (h *HTTPServer) Start(ctx context.Context) error {
+	ln, err := h.lnOpts.listen(ctx)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("HTTP/HTTPS proxy started", "inbound", h.tag, "listen", h.listenAddr)
 
 	go func() {
-		if err := h.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			slog.Error("HTTP server error", "error", err)
+		if err := h.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP server error", "inbound", h.tag, "error", err)
 		}
 	}()
 
 	return nil
 }
 
-// Stop stops the HTTP/HTTPS proxy server
-func (h *HTTPServer) Stop(ctx context.Context) error {
-	slog.Info("Stopping HTTP/HTTPS proxy")
+// Shutdown stops the HTTP/HTTPS proxy server
+func (h *HTTPServer) Shutdown(ctx context.Context) error {
+	slog.Info("Stopping HTTP/HTTPS proxy", "inbound", h.tag)
 	return h.server.Shutdown(ctx)
 }
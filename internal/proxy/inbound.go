@@ -0,0 +1,413 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/listener"
+	"github.com/xrdavies/light-ss/internal/quota"
+	"github.com/xrdavies/light-ss/internal/ratelimit"
+	"github.com/xrdavies/light-ss/internal/shadowsocks"
+	"github.com/xrdavies/light-ss/internal/stats"
+)
+
+// Inbound is a proxy listener managed by server.Manager
+type Inbound interface {
+	// Tag returns the routing tag of the listener
+	Tag() string
+
+	// Start binds the listen address and serves connections in the background
+	Start(ctx context.Context) error
+
+	// Shutdown stops accepting new connections
+	Shutdown(ctx context.Context) error
+}
+
+// Options holds the per-listener settings shared by all inbound types
+type Options struct {
+	Tag       string
+	Listen    string
+	Auth      *config.AuthConfig                    // Optional credentials
+	Target    string                                // Fixed destination (tunnel only)
+	Server    string                                // Upstream server name, empty for the selected server
+	Selected  func() string                         // Returns the selected server, used when Server is empty
+	GetClient func(name string) *shadowsocks.Client // Returns the current client of a server (for hot-reload)
+	Collector *stats.Collector                      // Optional stats collector
+	Sniffing  *config.SniffingConfig                // Protocol sniffing, nil when disabled
+	PACScript func(host string) []byte              // Renders the PAC file, returns nil when disabled
+
+	ProxyProtocol bool              // Parse a PROXY protocol header to learn the real client address
+	TrustedProxy  *listener.ACL     // Peers allowed to send PROXY headers
+	ACL           *listener.ACL     // Client allow/deny lists, nil to accept everyone
+	Limiter       *listener.Limiter // Connection limits shared by all inbounds, nil for none
+	Counter       *listener.Counter // Counts open client connections, nil for none
+	RateLimits    *ratelimit.Set    // Bandwidth limits, nil for none
+	Quota         *quota.Enforcer   // Traffic quotas, nil for none
+}
+
+// New creates an inbound of the given type
+func New(typ string, opts Options) (Inbound, error) {
+	switch typ {
+	case config.InboundUnified:
+		return NewUnifiedProxy(opts)
+	case config.InboundHTTP:
+		return NewHTTPServer(opts)
+	case config.InboundSOCKS5:
+		return NewSOCKS5Server(opts)
+	case config.InboundTunnel:
+		return NewTunnel(opts)
+	default:
+		return nil, fmt.Errorf("unknown inbound type: %s", typ)
+	}
+}
+
+// listenOptions holds the listener-level settings of an inbound
+type listenOptions struct {
+	tag           string
+	addr          string
+	auth          bool
+	proxyProtocol bool
+	trustedProxy  *listener.ACL
+	acl           *listener.ACL
+	limiter       *listener.Limiter
+	counter       *listener.Counter
+	collector     *stats.Collector
+}
+
+// newListenOptions creates listener settings from inbound options
+func newListenOptions(opts Options) listenOptions {
+	return listenOptions{
+		tag:           opts.Tag,
+		addr:          opts.Listen,
+		auth:          opts.Auth != nil,
+		proxyProtocol: opts.ProxyProtocol,
+		trustedProxy:  opts.TrustedProxy,
+		acl:           opts.ACL,
+		limiter:       opts.Limiter,
+		counter:       opts.Counter,
+		collector:     opts.Collector,
+	}
+}
+
+// listen binds the address and wraps the listener according to the options
+func (o listenOptions) listen(ctx context.Context) (net.Listener, error) {
+	ln, err := listener.Listen(ctx, o.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", o.addr, err)
+	}
+
+	rejected := &rejectLogger{tag: o.tag}
+
+	if o.proxyProtocol {
+		slog.Info("PROXY protocol enabled", "inbound", o.tag)
+		ln = listener.ProxyProtocol(ln, o.trustedProxy, func(remote net.Addr) {
+			o.recordClose(rejected, remote, reasonUntrustedProxy)
+		})
+	}
+
+	// Filter after PROXY protocol parsing so the real client address is checked
+	if o.acl != nil {
+		ln = listener.Filter(ln, o.acl, func(remote net.Addr) {
+			o.recordClose(rejected, remote, reasonAccessDenied)
+		})
+	} else if !o.auth && exposed(o.addr) {
+		slog.Warn("Inbound is reachable from other hosts without auth or allow list", "inbound", o.tag, "listen", o.addr)
+	}
+
+	if o.limiter != nil {
+		ln = listener.Limit(ln, o.limiter, func(remote net.Addr, reason string) {
+			o.recordClose(rejected, remote, reason)
+		})
+	}
+
+	if o.counter != nil {
+		ln = listener.Count(ln, o.counter)
+	}
+
+	return &accessLogListener{Listener: ln, tag: o.tag}, nil
+}
+
+// Close reasons for clients rejected by the ACL, and for connections to a
+// PROXY protocol inbound from peers outside trusted_proxies
+const (
+	reasonAccessDenied   = "access_denied"
+	reasonUntrustedProxy = "untrusted_proxy"
+)
+
+// recordClose counts and logs a connection refused or closed by the listener.
+// Refusals are logged with rate limiting, timeouts at debug level.
+func (o listenOptions) recordClose(rejected *rejectLogger, remote net.Addr, reason string) {
+	if o.collector != nil {
+		o.collector.RecordCloseReason(reason)
+	}
+
+	switch reason {
+	case listener.ReasonIdleTimeout, listener.ReasonMaxLifetime:
+		slog.Debug("Connection closed", "inbound", o.tag, "client", remote, "reason", reason)
+	default:
+		if o.collector != nil {
+			o.collector.RecordRejected()
+		}
+		rejected.log(remote, reason)
+	}
+}
+
+// exposed reports whether a TCP listen address accepts non-loopback clients
+func exposed(addr string) bool {
+	if listener.Network(addr) != "tcp" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// rejectLogInterval is the minimum time between rejection log lines of a listener
+const rejectLogInterval = 10 * time.Second
+
+// rejectLogger logs rejected clients at most once per rejectLogInterval and
+// reports how many rejections were suppressed in between
+type rejectLogger struct {
+	tag        string
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// log records a rejected client address
+func (r *rejectLogger) log(remote net.Addr, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.last) < rejectLogInterval {
+		r.suppressed++
+		return
+	}
+
+	slog.Warn("Connection rejected", "inbound", r.tag, "client", remote, "reason", reason, "suppressed", r.suppressed)
+	r.last = now
+	r.suppressed = 0
+}
+
+// accessLogListener logs every accepted connection with its client address
+type accessLogListener struct {
+	net.Listener
+	tag string
+}
+
+// Accept waits for the next connection and logs it
+func (l *accessLogListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		slog.Debug("Connection accepted", "inbound", l.tag, "client", conn.RemoteAddr())
+	}
+	return conn, err
+}
+
+// dialer dials targets through the inbound's upstream server and tracks stats
+type dialer struct {
+	tag       string
+	server    string        // Empty for the selected server
+	selected  func() string // Returns the selected server
+	user      string        // Username every client of the inbound authenticates as, empty without auth
+	getClient func(name string) *shadowsocks.Client
+	collector *stats.Collector
+	sniffer   *sniffer
+	rates     ratelimit.Chain // Bandwidth limits applying to the inbound, empty for none
+	quota     *quota.Enforcer
+}
+
+// newDialer creates a dialer from inbound options
+func newDialer(opts Options) *dialer {
+	d := &dialer{
+		tag:       opts.Tag,
+		server:    opts.Server,
+		selected:  opts.Selected,
+		getClient: opts.GetClient,
+		collector: opts.Collector,
+		sniffer:   newSniffer(opts.Sniffing),
+		quota:     opts.Quota,
+	}
+	if opts.Auth != nil {
+		d.user = opts.Auth.Username
+	}
+	if opts.RateLimits != nil {
+		d.rates = opts.RateLimits.Chain(opts.Tag, d.user)
+	}
+	return d
+}
+
+// clientKey is the context key of the client address passed to dialer.dial
+type clientKey struct{}
+
+// withClient returns ctx carrying the address of the client a dial is made for
+func withClient(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientKey{}, addr.String())
+}
+
+// withClientString is withClient for addresses already formatted, e.g. http.Request.RemoteAddr
+func withClientString(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientKey{}, addr)
+}
+
+// clientFrom returns the client address of ctx, empty if unknown
+func clientFrom(ctx context.Context) string {
+	addr, _ := ctx.Value(clientKey{}).(string)
+	return addr
+}
+
+// dial connects to addr through shadowsocks. proxyType is recorded in stats
+// (http, socks5 or tunnel); sniff enables protocol sniffing for IP targets.
+// The client address is taken from ctx (see withClient).
+func (d *dialer) dial(ctx context.Context, proxyType, network, addr string, sniff bool) (net.Conn, error) {
+	server := d.server
+	if server == "" {
+		server = d.selected()
+	}
+	if d.quota != nil {
+		var err error
+		requested := server
+		server, err = d.quota.Route(requested, d.user)
+		if err != nil {
+			if d.collector != nil {
+				d.collector.RecordRejected()
+				d.collector.RecordCloseReason(quota.ReasonExceeded)
+			}
+			slog.Debug("Connection refused by quota", "inbound", d.tag, "server", requested, "user", d.user, "target", addr)
+			return nil, err
+		}
+	}
+
+	dialUpstream := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return d.dialUpstream(ctx, server, network, addr)
+	}
+
+	var conn net.Conn
+	var err error
+	if sniff {
+		conn, err = d.sniffer.dial(ctx, network, addr, dialUpstream)
+	} else {
+		conn, err = dialUpstream(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sniffed, _ := conn.(*sniffConn)
+	conn = newShapedConn(conn, d.rates)
+	if d.collector != nil {
+		tracked := stats.NewTrackedConn(conn, d.collector, stats.ConnInfo{
+			ProxyType:     proxyType,
+			Inbound:       d.tag,
+			Client:        clientFrom(ctx),
+			Server:        server,
+			User:          d.user,
+			Target:        addr,
+			DomainPending: sniffed != nil,
+		})
+		// Traffic is grouped by the domain found by sniffing, not the IP
+		if sniffed != nil {
+			sniffed.onDomain(tracked.SetDomain)
+		}
+		conn = tracked
+	}
+	return conn, nil
+}
+
+// dialUpstream dials addr through the current shadowsocks client of server
+// and records the dial latency or error
+func (d *dialer) dialUpstream(ctx context.Context, server, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.getClient(server).DialContext(ctx, network, addr)
+	if err != nil {
+		slog.Debug("Upstream dial failed", "inbound", d.tag, "server", server, "target", addr, "error", err)
+	}
+
+	if d.collector != nil {
+		reason := ""
+		if err != nil {
+			reason = dialErrorReason(err)
+		}
+		d.collector.RecordDial(server, time.Since(start), reason)
+		if errors.Is(err, shadowsocks.ErrPluginHandshake) {
+			d.collector.RecordPluginFailure(server)
+		}
+	}
+	return conn, err
+}
+
+// dialErrorReason classifies an upstream dial error for the metrics
+func dialErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, shadowsocks.ErrPluginHandshake):
+		return "plugin_handshake"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
+
+// checkProxyAuth validates the Proxy-Authorization header against auth.
+// Always succeeds when auth is nil.
+func checkProxyAuth(req *http.Request, auth *config.AuthConfig) bool {
+	if auth == nil {
+		return true
+	}
+
+	const basicPrefix = "Basic "
+	header := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(header, basicPrefix) {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, basicPrefix))
+	if err != nil {
+		return false
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) == 1
+	return userOK && passOK
+}
+
+// proxyAuthRequired is the response sent to HTTP clients failing authentication
+const proxyAuthRequired = "HTTP/1.1 407 Proxy Authentication Required\r\n" +
+	"Proxy-Authenticate: Basic realm=\"light-ss\"\r\n" +
+	"Content-Length: 0\r\n" +
+	"Connection: close\r\n\r\n"
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/stats"
+)
+
+// relayLinger is how long the remaining direction of a half-closed relay may
+// stay silent before both connections are closed
+const relayLinger = 30 * time.Second
+
+// relayBufferSize is the copy buffer size of each relay direction
+const relayBufferSize = 32 * 1024
+
+// Byte counts of a relay direction are reported to the stats collector once
+// this many bytes are pending or statsFlushInterval has passed
+const (
+	statsFlushBytes    = 256 * 1024
+	statsFlushInterval = time.Second
+)
+
+// relayBufPool holds copy buffers shared by all relays
+var relayBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+// relay copies data between client and target in both directions and closes
+// both connections when done. When one direction reaches EOF, the write side
+// of its destination is closed (TCP half-close) and the other direction keeps
+// running until it finishes too, or has been idle for relayLinger.
+// An error in either direction closes both connections immediately.
+//
+// If target is a stats.TrackedConn, the relay moves data on the wrapped
+// connection and reports byte counts in batches.
+func relay(client, target net.Conn) {
+	var lingering atomic.Bool
+	errCh := make(chan error, 2)
+
+	upstream := target
+	var upload, download func(int64)
+	if tracked, ok := target.(*stats.TrackedConn); ok {
+		upstream = tracked.NetConn()
+		upload = func(n int64) { tracked.AddBytes(n, 0) }
+		download = func(n int64) { tracked.AddBytes(0, n) }
+	}
+
+	go func() {
+		errCh <- relayHalf(upstream, client, &lingering, upload)
+	}()
+	go func() {
+		errCh <- relayHalf(client, upstream, &lingering, download)
+	}()
+
+	if err := <-errCh; err != nil {
+		client.Close()
+		target.Close()
+	} else {
+		// Bound the read already in progress on the remaining direction
+		lingering.Store(true)
+		deadline := time.Now().Add(relayLinger)
+		client.SetReadDeadline(deadline)
+		upstream.SetReadDeadline(deadline)
+	}
+	<-errCh
+
+	client.Close()
+	target.Close()
+}
+
+// relayHalf copies src to dst until EOF and then half-closes dst. count, if
+// set, receives the number of bytes copied in batches. Once lingering is set,
+// the copy ends when src stays silent for relayLinger.
+func relayHalf(dst, src net.Conn, lingering *atomic.Bool, count func(int64)) error {
+	if err := copyHalf(dst, src, lingering, count); err != nil {
+		return err
+	}
+
+	// Without half-close support the peer doesn't see EOF, and the
+	// linger timeout ends the relay instead
+	closeWrite(dst)
+	return nil
+}
+
+// copyHalf copies src to dst with a pooled buffer until EOF
+func copyHalf(dst, src net.Conn, lingering *atomic.Bool, count func(int64)) error {
+	bufp := relayBufPool.Get().(*[]byte)
+	defer relayBufPool.Put(bufp)
+	buf := *bufp
+
+	var pending int64
+	lastFlush := time.Now()
+	defer func() {
+		if count != nil && pending > 0 {
+			count(pending)
+		}
+	}()
+
+	for {
+		if lingering.Load() {
+			src.SetReadDeadline(time.Now().Add(relayLinger))
+		}
+
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			pending += int64(nw)
+			if ew != nil {
+				return ew
+			}
+		}
+
+		if count != nil && pending > 0 && (pending >= statsFlushBytes || time.Since(lastFlush) >= statsFlushInterval) {
+			count(pending)
+			pending = 0
+			lastFlush = time.Now()
+		}
+
+		if er == io.EOF {
+			return nil
+		}
+		if er != nil {
+			return er
+		}
+	}
+}
+
+// closeWriter is implemented by connections supporting TCP half-close
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// netConner is implemented by connection wrappers exposing the wrapped connection
+type netConner interface {
+	NetConn() net.Conn
+}
+
+// errNoHalfClose is returned by closeWrite for connections without half-close support
+var errNoHalfClose = errors.New("connection does not support half-close")
+
+// closeWrite shuts down the write side of conn, looking through wrappers
+// that don't implement CloseWrite themselves
+func closeWrite(conn net.Conn) error {
+	for {
+		if cw, ok := conn.(closeWriter); ok {
+			return cw.CloseWrite()
+		}
+		nc, ok := conn.(netConner)
+		if !ok {
+			return errNoHalfClose
+		}
+		conn = nc.NetConn()
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/xrdavies/light-ss/internal/stats"
+)
+
+// benchPayload is the number of bytes relayed per connection. One benchmark
+// op is one relayed connection, so allocation figures are per connection.
+const benchPayload = 1 << 20
+
+// BenchmarkRelayCopy measures the previous relay, io.Copy in both
+// directions, as a baseline
+func BenchmarkRelayCopy(b *testing.B) {
+	benchRelay(b, true, copyBoth)
+}
+
+// BenchmarkRelayTracked measures the relay with stats accounting, as used for
+// every proxied connection
+func BenchmarkRelayTracked(b *testing.B) {
+	benchRelay(b, true, relay)
+}
+
+// BenchmarkRelayWrapped measures the relay between connection wrappers
+// without stats accounting
+func BenchmarkRelayWrapped(b *testing.B) {
+	benchRelay(b, false, func(client, target net.Conn) {
+		relay(wrappedConn{client}, wrappedConn{target})
+	})
+}
+
+// copyBoth is the previous relay: io.Copy in both directions, returning as
+// soon as either one finishes
+func copyBoth(client, target net.Conn) {
+	defer client.Close()
+	defer target.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(target, client)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(client, target)
+		errCh <- err
+	}()
+	<-errCh
+}
+
+// wrappedConn hides the concrete connection type, like the listener and
+// shadowsocks wrappers do
+type wrappedConn struct {
+	net.Conn
+}
+
+// NetConn returns the underlying connection (for half-close)
+func (c wrappedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// benchRelay measures relayFn moving benchPayload bytes from a client to a
+// target over loopback TCP
+func benchRelay(b *testing.B, tracked bool, relayFn func(client, target net.Conn)) {
+	clientLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clientLn.Close()
+	targetLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer targetLn.Close()
+
+	var collector *stats.Collector
+	if tracked {
+		collector = stats.NewCollector(nil)
+		defer collector.Stop()
+	}
+
+	data := make([]byte, benchPayload)
+	b.SetBytes(benchPayload)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client, proxyClient := dialPair(b, clientLn)
+		proxyTarget, target := dialPair(b, targetLn)
+		var upstream net.Conn = proxyTarget
+		if tracked {
+			upstream = stats.NewTrackedConn(proxyTarget, collector, stats.ConnInfo{ProxyType: "bench", Target: targetLn.Addr().String()})
+		}
+		b.StartTimer()
+
+		done := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, target)
+			target.Close()
+			close(done)
+		}()
+		go relayFn(proxyClient, upstream)
+
+		client.Write(data)
+		client.(*net.TCPConn).CloseWrite()
+		<-done
+		client.Close()
+	}
+}
+
+// dialPair returns both ends of a new loopback connection to ln
+func dialPair(b *testing.B, ln net.Listener) (net.Conn, net.Conn) {
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return dialed, accepted
+}
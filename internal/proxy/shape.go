@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/xrdavies/light-ss/internal/ratelimit"
+)
+
+// shapeChunk is the largest write passed to the target at once, so rate
+// limited uploads are spread evenly instead of bursting whole buffers
+const shapeChunk = 16 * 1024
+
+// shapedConn limits the bandwidth of a target connection. Writes are
+// uploads and reads are downloads from the client's point of view.
+// Closing the connection ends waits for tokens.
+type shapedConn struct {
+	net.Conn
+	chain  ratelimit.Chain
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newShapedConn wraps conn with the buckets of chain, returns conn if chain is empty
+func newShapedConn(conn net.Conn, chain ratelimit.Chain) net.Conn {
+	if len(chain) == 0 {
+		return conn
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &shapedConn{Conn: conn, chain: chain, ctx: ctx, cancel: cancel}
+}
+
+// Read reads from the target and waits until the bytes may be delivered
+func (c *shapedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.chain.WaitDownload(c.ctx, n); werr != nil {
+			return 0, net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+// Write waits for upload tokens and writes to the target in chunks
+func (c *shapedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > shapeChunk {
+			chunk = chunk[:shapeChunk]
+		}
+		if err := c.chain.WaitUpload(c.ctx, len(chunk)); err != nil {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close ends pending waits and closes the connection
+func (c *shapedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection
+func (c *shapedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+var _ net.Conn = (*shapedConn)(nil)
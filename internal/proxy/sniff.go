@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/sniff"
+)
+
+// sniffTimeout is how long to wait for the client's first bytes before
+// dialing the original IP target (for server-speaks-first protocols)
+const sniffTimeout = 300 * time.Millisecond
+
+// dialFunc dials a target address through shadowsocks
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// sniffer replaces IP targets with the domain found in the client's first bytes
+type sniffer struct {
+	skipDomains []string
+}
+
+// newSniffer creates a sniffer, returns nil if sniffing is disabled
+func newSniffer(cfg *config.SniffingConfig) *sniffer {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	return &sniffer{skipDomains: cfg.SkipDomains}
+}
+
+// dial wraps dial with protocol sniffing when addr is an IP address.
+// The actual dial is deferred until the client sends its first bytes, and is
+// made with ctx. Errors of the deferred dial are returned by the first Read,
+// Write or CloseWrite, so callers replying to the client before that (e.g. a
+// SOCKS5 success reply) can't report them.
+func (s *sniffer) dial(ctx context.Context, network, addr string, dial dialFunc) (net.Conn, error) {
+	if s == nil {
+		return dial(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return dial(ctx, network, addr)
+	}
+
+	c := &sniffConn{
+		ctx:     ctx,
+		sniffer: s,
+		network: network,
+		addr:    addr,
+		port:    port,
+		dialFn:  dial,
+		ready:   make(chan struct{}),
+	}
+	c.timer = time.AfterFunc(sniffTimeout, func() {
+		c.once.Do(func() { c.connect(nil) })
+	})
+
+	return c, nil
+}
+
+// sniffConn is a lazily dialed connection that inspects the first client write
+type sniffConn struct {
+	ctx     context.Context // Of the deferred dial
+	sniffer *sniffer
+	network string
+	addr    string // Original IP target
+	port    string
+	dialFn  dialFunc
+	timer   *time.Timer
+
+	once  sync.Once
+	ready chan struct{} // Closed once conn/err are set
+	conn  net.Conn
+	err   error
+
+	// Domain the target is dialed by, see onDomain
+	domainMu   sync.Mutex
+	domainSet  bool
+	domain     string
+	domainFunc func(domain string)
+}
+
+// onDomain calls fn with the domain the target is dialed by once it is
+// known, or with an empty string if the IP target is kept
+func (c *sniffConn) onDomain(fn func(domain string)) {
+	c.domainMu.Lock()
+	if !c.domainSet {
+		c.domainFunc = fn
+		c.domainMu.Unlock()
+		return
+	}
+	domain := c.domain
+	c.domainMu.Unlock()
+	fn(domain)
+}
+
+// setDomain records the domain the target is dialed by and reports it to the
+// onDomain function
+func (c *sniffConn) setDomain(domain string) {
+	c.domainMu.Lock()
+	c.domainSet = true
+	c.domain = domain
+	fn := c.domainFunc
+	c.domainMu.Unlock()
+	if fn != nil {
+		fn(domain)
+	}
+}
+
+// connect dials the target (replaced by the sniffed domain if any) and sends payload
+func (c *sniffConn) connect(payload []byte) {
+	defer close(c.ready)
+	c.timer.Stop()
+
+	target := c.addr
+	dialed := ""
+	if domain := sniff.Domain(payload); domain != "" {
+		if sniff.MatchDomain(domain, c.sniffer.skipDomains) {
+			slog.Debug("Sniffed domain in skip list, keeping IP target", "target", c.addr, "domain", domain)
+		} else {
+			target = net.JoinHostPort(domain, c.port)
+			dialed = domain
+			slog.Debug("Sniffed domain for IP target", "target", c.addr, "domain", domain)
+		}
+	}
+	c.setDomain(dialed)
+
+	conn, err := c.dialFn(c.ctx, c.network, target)
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			conn.Close()
+			c.err = err
+			return
+		}
+	}
+
+	c.conn = conn
+}
+
+// Write dials on the first call using the payload for sniffing
+func (c *sniffConn) Write(b []byte) (int, error) {
+	first := false
+	c.once.Do(func() {
+		first = true
+		c.connect(b)
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	if first {
+		return len(b), nil
+	}
+	return c.conn.Write(b)
+}
+
+// Read waits for the connection to be established
+func (c *sniffConn) Read(b []byte) (int, error) {
+	<-c.ready
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Read(b)
+}
+
+// Close closes the underlying connection or cancels the pending dial
+func (c *sniffConn) Close() error {
+	c.once.Do(func() {
+		c.timer.Stop()
+		c.setDomain("")
+		c.err = net.ErrClosed
+		close(c.ready)
+	})
+	<-c.ready
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// CloseWrite dials if the client sent nothing yet and half-closes the connection
+func (c *sniffConn) CloseWrite() error {
+	c.once.Do(func() { c.connect(nil) })
+	<-c.ready
+	if c.err != nil {
+		return c.err
+	}
+	return closeWrite(c.conn)
+}
+
+// LocalAddr returns an unspecified TCP address until connected
+func (c *sniffConn) LocalAddr() net.Addr {
+	if conn := c.established(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// RemoteAddr returns the original target until connected
+func (c *sniffConn) RemoteAddr() net.Addr {
+	if conn := c.established(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+func (c *sniffConn) SetDeadline(t time.Time) error {
+	if conn := c.established(); conn != nil {
+		return conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *sniffConn) SetReadDeadline(t time.Time) error {
+	if conn := c.established(); conn != nil {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *sniffConn) SetWriteDeadline(t time.Time) error {
+	if conn := c.established(); conn != nil {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// established returns the underlying connection if the dial has completed
+func (c *sniffConn) established() net.Conn {
+	select {
+	case <-c.ready:
+		return c.conn
+	default:
+		return nil
+	}
+}
+
+var _ net.Conn = (*sniffConn)(nil)
@@ -2,90 +2,342 @@ package proxy
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/armon/go-socks5"
 	"github.com/xrdavies/light-ss/internal/config"
-	"github.com/xrdavies/light-ss/internal/shadowsocks"
-	"github.com/xrdavies/light-ss/internal/stats"
+	"github.com/xrdavies/light-ss/internal/quota"
 )
 
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	socks5UserPassVersion = 0x01
+	socks5AuthSuccess     = 0x00
+	socks5AuthFailure     = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5RepSuccess             = 0x00
+	socks5RepNotAllowed          = 0x02
+	socks5RepNetworkUnreachable  = 0x03
+	socks5RepHostUnreachable     = 0x04
+	socks5RepConnectionRefused   = 0x05
+	socks5RepCommandNotSupported = 0x07
+	socks5RepAddrNotSupported    = 0x08
+)
+
+// socks5HandshakeTimeout bounds how long a client may take to negotiate and
+// send its request, so idle connections cannot hold listener slots
+const socks5HandshakeTimeout = 10 * time.Second
+
 // SOCKS5Server wraps a SOCKS5 proxy server
 type SOCKS5Server struct {
+	tag        string
 	listener   net.Listener
-	server     *socks5.Server
+	handler    *socks5Handler
 	listenAddr string
-	ssClient   *shadowsocks.Client
-	collector  *stats.Collector
+	lnOpts     listenOptions
 }
 
 // NewSOCKS5Server creates a new SOCKS5 proxy server
-func NewSOCKS5Server(listen string, auth *config.AuthConfig, ssClient *shadowsocks.Client, collector *stats.Collector) (*SOCKS5Server, error) {
-	conf := &socks5.Config{
-		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			conn, err := ssClient.DialContext(ctx, network, addr)
-			if err != nil {
-				return nil, err
-			}
-
-			// Wrap connection with stats tracking if collector is enabled
-			if collector != nil {
-				conn = stats.NewTrackedConn(conn, collector, "socks5", addr)
-			}
-
-			return conn, nil
-		},
+func NewSOCKS5Server(opts Options) (*SOCKS5Server, error) {
+	s := &SOCKS5Server{
+		tag:        opts.Tag,
+		listenAddr: opts.Listen,
+		lnOpts:     newListenOptions(opts),
+		handler:    newSOCKS5Handler(opts),
 	}
 
-	// Add authentication if configured
-	if auth != nil {
-		credentials := socks5.StaticCredentials{
-			auth.Username: auth.Password,
-		}
-		authenticator := socks5.UserPassAuthenticator{Credentials: credentials}
-		conf.AuthMethods = []socks5.Authenticator{authenticator}
-		slog.Info("SOCKS5 authentication enabled", "username", auth.Username)
+	if opts.Auth != nil {
+		slog.Info("SOCKS5 authentication enabled", "inbound", s.tag, "username", opts.Auth.Username)
 	}
-
-	server, err := socks5.New(conf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create SOCKS5 server: %w", err)
+	if s.handler.dialer.sniffer != nil {
+		slog.Info("SOCKS5 protocol sniffing enabled", "inbound", s.tag, "skip_domains", len(opts.Sniffing.SkipDomains))
 	}
 
-	return &SOCKS5Server{
-		server:     server,
-		listenAddr: listen,
-		ssClient:   ssClient,
-		collector:  collector,
-	}, nil
+	return s, nil
+}
+
+// Tag returns the routing tag of the listener
+func (s *SOCKS5Server) Tag() string {
+	return s.tag
 }
 
 // Start starts the SOCKS5 proxy server
-func (s *SOCKS5Server) Start() error {
-	listener, err := net.Listen("tcp", s.listenAddr)
+func (s *SOCKS5Server) Start(ctx context.Context) error {
+	ln, err := s.lnOpts.listen(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", s.listenAddr, err)
+		return err
 	}
 
-	s.listener = listener
-	slog.Info("SOCKS5 proxy started", "listen", s.listenAddr)
+	s.listener = ln
+	slog.Info("SOCKS5 proxy started", "inbound", s.tag, "listen", s.listenAddr)
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
 
 	go func() {
-		if err := s.server.Serve(listener); err != nil {
-			slog.Error("SOCKS5 server error", "error", err)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("SOCKS5 server error", "inbound", s.tag, "error", err)
+				continue
+			}
+
+			go func() {
+				if err := s.handler.serveConn(conn); err != nil {
+					slog.Debug("SOCKS5 connection failed", "inbound", s.tag, "error", err)
+				}
+			}()
 		}
 	}()
 
 	return nil
 }
 
-// Stop stops the SOCKS5 proxy server
-func (s *SOCKS5Server) Stop() error {
+// Shutdown stops the SOCKS5 proxy server
+func (s *SOCKS5Server) Shutdown(ctx context.Context) error {
 	if s.listener != nil {
-		slog.Info("Stopping SOCKS5 proxy")
+		slog.Info("Stopping SOCKS5 proxy", "inbound", s.tag)
 		return s.listener.Close()
 	}
 	return nil
 }
+
+// socks5Handler serves SOCKS5 CONNECT requests through shadowsocks.
+// Domain names are passed to the shadowsocks server unresolved, so they
+// are neither resolved nor leaked locally.
+type socks5Handler struct {
+	tag    string
+	auth   *config.AuthConfig
+	dialer *dialer
+	dial   dialFunc // Dials targets through dialer, with sniffing
+
+	handshakeTimeout time.Duration // Deadline for negotiation and request, 0 for none
+}
+
+// newSOCKS5Handler creates a SOCKS5 handler from inbound options
+func newSOCKS5Handler(opts Options) *socks5Handler {
+	d := newDialer(opts)
+	return &socks5Handler{
+		tag:    opts.Tag,
+		auth:   opts.Auth,
+		dialer: d,
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.dial(ctx, "socks5", network, addr, true)
+		},
+		handshakeTimeout: socks5HandshakeTimeout,
+	}
+}
+
+// serveConn handles a single SOCKS5 client connection and closes it
+func (h *socks5Handler) serveConn(conn net.Conn) error {
+	defer conn.Close()
+
+	if h.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(h.handshakeTimeout))
+	}
+	if err := h.negotiate(conn); err != nil {
+		return err
+	}
+
+	target, err := h.readRequest(conn)
+	if err != nil {
+		return err
+	}
+	// The dialer and relay apply their own timeouts
+	conn.SetDeadline(time.Time{})
+
+	targetConn, err := h.dial(withClient(context.Background(), conn.RemoteAddr()), "tcp", target)
+	if err != nil {
+		writeSOCKS5Reply(conn, dialErrorReply(err), nil)
+		return fmt.Errorf("connect to %s failed: %w", target, err)
+	}
+
+	if err := writeSOCKS5Reply(conn, socks5RepSuccess, targetConn.LocalAddr()); err != nil {
+		targetConn.Close()
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	relay(conn, targetConn)
+	return nil
+}
+
+// negotiate reads the method selection and authenticates the client
+func (h *socks5Handler) negotiate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("failed to read auth methods: %w", err)
+	}
+
+	want := byte(socks5MethodNoAuth)
+	if h.auth != nil {
+		want = socks5MethodUserPass
+	}
+	if !strings.ContainsRune(string(methods), rune(want)) {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return err
+	}
+
+	if h.auth == nil {
+		return nil
+	}
+	return h.authenticate(conn)
+}
+
+// authenticate performs username/password authentication (RFC 1929)
+func (h *socks5Handler) authenticate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read credentials: %w", err)
+	}
+	if header[0] != socks5UserPassVersion {
+		return fmt.Errorf("unsupported auth version %d", header[0])
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return fmt.Errorf("failed to read username: %w", err)
+	}
+
+	passLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passLen); err != nil {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+	password := make([]byte, passLen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+
+	userOK := subtle.ConstantTimeCompare(username, []byte(h.auth.Username)) == 1
+	passOK := subtle.ConstantTimeCompare(password, []byte(h.auth.Password)) == 1
+	if !userOK || !passOK {
+		conn.Write([]byte{socks5UserPassVersion, socks5AuthFailure})
+		slog.Debug("SOCKS5 authentication failed", "inbound", h.tag, "remote", conn.RemoteAddr())
+		return errors.New("authentication failed")
+	}
+
+	_, err := conn.Write([]byte{socks5UserPassVersion, socks5AuthSuccess})
+	return err
+}
+
+// readRequest reads a CONNECT request and returns the target as host:port
+func (h *socks5Handler) readRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("failed to read request: %w", err)
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = string(domain)
+	default:
+		writeSOCKS5Reply(conn, socks5RepAddrNotSupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("failed to read port: %w", err)
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	// Only CONNECT is supported; BIND and UDP ASSOCIATE can't go through shadowsocks TCP
+	if header[1] != socks5CmdConnect {
+		writeSOCKS5Reply(conn, socks5RepCommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported command %d for %s", header[1], target)
+	}
+
+	return target, nil
+}
+
+// dialErrorReply maps a dial error to a SOCKS5 reply code. Errors of the
+// shadowsocks server dial wrap a *net.OpError, whose errno errors.Is finds.
+func dialErrorReply(err error) byte {
+	switch {
+	case errors.Is(err, quota.ErrExceeded):
+		return socks5RepNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetworkUnreachable
+	default:
+		return socks5RepHostUnreachable
+	}
+}
+
+// writeSOCKS5Reply sends a reply with the bound address (0.0.0.0:0 if not TCP)
+func writeSOCKS5Reply(conn net.Conn, rep byte, bind net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if tcp, ok := bind.(*net.TCPAddr); ok && tcp.IP != nil {
+		ip, port = tcp.IP, tcp.Port
+	}
+
+	atyp := byte(socks5AddrIPv4)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		atyp = socks5AddrIPv6
+	}
+
+	reply := []byte{socks5Version, rep, 0x00, atyp}
+	reply = append(reply, ip...)
+	reply = append(reply, byte(port>>8), byte(port))
+	_, err := conn.Write(reply)
+	return err
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/quota"
+)
+
+// echoDial returns a dial function connecting to an in-memory echo target.
+// The address of each dial is sent on addrs.
+func echoDial(addrs chan<- string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addrs <- addr
+		proxySide, targetSide := net.Pipe()
+		go func() {
+			io.Copy(targetSide, targetSide)
+			targetSide.Close()
+		}()
+		return proxySide, nil
+	}
+}
+
+// serveSOCKS5 runs h on one end of a pipe and returns the client end
+func serveSOCKS5(t *testing.T, h *socks5Handler) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go h.serveConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// expect reads len(want) bytes from conn and compares them to want
+func expect(t *testing.T, conn net.Conn, want []byte, what string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: got %x, want %x", what, got, want)
+	}
+}
+
+// readReply reads a reply with an IPv4 bound address and returns its code
+func readReply(t *testing.T, conn net.Conn) byte {
+	t.Helper()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[0] != socks5Version || reply[3] != socks5AddrIPv4 {
+		t.Fatalf("malformed reply %x", reply)
+	}
+	return reply[1]
+}
+
+// connectRequest encodes a CONNECT request
+func connectRequest(cmd, atyp byte, addr []byte, port uint16) []byte {
+	req := []byte{socks5Version, cmd, 0x00, atyp}
+	if atyp == socks5AddrDomain {
+		req = append(req, byte(len(addr)))
+	}
+	req = append(req, addr...)
+	return append(req, byte(port>>8), byte(port))
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	tests := []struct {
+		name string
+		atyp byte
+		addr []byte
+		want string
+	}{
+		{"ipv4", socks5AddrIPv4, []byte{192, 0, 2, 1}, "192.0.2.1:443"},
+		{"ipv6", socks5AddrIPv6, net.ParseIP("2001:db8::1"), "[2001:db8::1]:443"},
+		{"domain", socks5AddrDomain, []byte("example.com"), "example.com:443"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := make(chan string, 1)
+			client := serveSOCKS5(t, &socks5Handler{dial: echoDial(addrs)})
+
+			client.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+			expect(t, client, []byte{socks5Version, socks5MethodNoAuth}, "method selection")
+
+			client.Write(connectRequest(socks5CmdConnect, tt.atyp, tt.addr, 443))
+			if rep := readReply(t, client); rep != socks5RepSuccess {
+				t.Fatalf("reply = %d, want success", rep)
+			}
+			if addr := <-addrs; addr != tt.want {
+				t.Errorf("dialed %s, want %s (domains must not be resolved)", addr, tt.want)
+			}
+
+			client.Write([]byte("ping"))
+			expect(t, client, []byte("ping"), "relayed data")
+		})
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	auth := &config.AuthConfig{Username: "user", Password: "pass"}
+
+	credentials := func(user, pass string) []byte {
+		msg := []byte{socks5UserPassVersion, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(pass)))
+		return append(msg, pass...)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		addrs := make(chan string, 1)
+		client := serveSOCKS5(t, &socks5Handler{auth: auth, dial: echoDial(addrs)})
+
+		client.Write([]byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodUserPass})
+		expect(t, client, []byte{socks5Version, socks5MethodUserPass}, "method selection")
+		client.Write(credentials("user", "pass"))
+		expect(t, client, []byte{socks5UserPassVersion, socks5AuthSuccess}, "auth status")
+
+		client.Write(connectRequest(socks5CmdConnect, socks5AddrDomain, []byte("example.com"), 80))
+		if rep := readReply(t, client); rep != socks5RepSuccess {
+			t.Fatalf("reply = %d, want success", rep)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		client := serveSOCKS5(t, &socks5Handler{auth: auth, dial: echoDial(make(chan string, 1))})
+
+		client.Write([]byte{socks5Version, 1, socks5MethodUserPass})
+		expect(t, client, []byte{socks5Version, socks5MethodUserPass}, "method selection")
+		client.Write(credentials("user", "wrong"))
+		expect(t, client, []byte{socks5UserPassVersion, socks5AuthFailure}, "auth status")
+
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read after failed auth = %v, want EOF", err)
+		}
+	})
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		client := serveSOCKS5(t, &socks5Handler{auth: auth, dial: echoDial(make(chan string, 1))})
+
+		client.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+		expect(t, client, []byte{socks5Version, socks5MethodNoAcceptable}, "method selection")
+	})
+}
+
+func TestSOCKS5RequestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		want    byte
+	}{
+		{"bind", connectRequest(0x02, socks5AddrIPv4, []byte{192, 0, 2, 1}, 80), socks5RepCommandNotSupported},
+		{"udp associate", connectRequest(0x03, socks5AddrIPv4, []byte{192, 0, 2, 1}, 80), socks5RepCommandNotSupported},
+		{"address type", []byte{socks5Version, socks5CmdConnect, 0x00, 0x09}, socks5RepAddrNotSupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := serveSOCKS5(t, &socks5Handler{dial: echoDial(make(chan string, 1))})
+
+			client.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+			expect(t, client, []byte{socks5Version, socks5MethodNoAuth}, "method selection")
+			client.Write(tt.request)
+			if rep := readReply(t, client); rep != tt.want {
+				t.Errorf("reply = %d, want %d", rep, tt.want)
+			}
+		})
+	}
+}
+
+func TestSOCKS5HandshakeTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	t.Run("stalled", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		done := make(chan error, 1)
+		go func() {
+			done <- (&socks5Handler{dial: echoDial(make(chan string, 1)), handshakeTimeout: timeout}).serveConn(server)
+		}()
+
+		// Start the method selection, then stall
+		client.Write([]byte{socks5Version})
+		select {
+		case err := <-done:
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Errorf("serveConn error %v, want a timeout", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("stalled handshake was not timed out")
+		}
+	})
+
+	t.Run("relay outlasts it", func(t *testing.T) {
+		client := serveSOCKS5(t, &socks5Handler{dial: echoDial(make(chan string, 1)), handshakeTimeout: timeout})
+
+		client.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+		expect(t, client, []byte{socks5Version, socks5MethodNoAuth}, "method selection")
+		client.Write(connectRequest(socks5CmdConnect, socks5AddrIPv4, []byte{192, 0, 2, 1}, 443))
+		if rep := readReply(t, client); rep != socks5RepSuccess {
+			t.Fatalf("reply = %d, want success", rep)
+		}
+
+		time.Sleep(2 * timeout)
+		client.Write([]byte("ping"))
+		expect(t, client, []byte("ping"), "relayed data after the handshake timeout")
+	})
+}
+
+func TestSOCKS5DialErrorReply(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"refused", opErr(syscall.ECONNREFUSED), socks5RepConnectionRefused},
+		{"network unreachable", opErr(syscall.ENETUNREACH), socks5RepNetworkUnreachable},
+		{"host unreachable", opErr(syscall.EHOSTUNREACH), socks5RepHostUnreachable},
+		{"wrapped refused", fmt.Errorf("failed to connect: %w", opErr(syscall.ECONNREFUSED)), socks5RepConnectionRefused},
+		{"quota", fmt.Errorf("server default: %w", quota.ErrExceeded), socks5RepNotAllowed},
+		{"message only", errors.New("connection refused"), socks5RepHostUnreachable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, tt.err
+			}
+			client := serveSOCKS5(t, &socks5Handler{dial: dial})
+
+			client.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+			expect(t, client, []byte{socks5Version, socks5MethodNoAuth}, "method selection")
+			client.Write(connectRequest(socks5CmdConnect, socks5AddrDomain, []byte("example.com"), 443))
+			if rep := readReply(t, client); rep != tt.want {
+				t.Errorf("reply = %d, want %d", rep, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// Tunnel forwards every accepted connection to a fixed target through shadowsocks
+type Tunnel struct {
+	tag      string
+	listen   string
+	lnOpts   listenOptions
+	target   string
+	dialer   *dialer
+	listener net.Listener
+}
+
+// NewTunnel creates a port-forwarding inbound for opts.Target
+func NewTunnel(opts Options) (*Tunnel, error) {
+	if opts.Target == "" {
+		return nil, fmt.Errorf("tunnel %s requires a target", opts.Tag)
+	}
+
+	return &Tunnel{
+		tag:    opts.Tag,
+		listen: opts.Listen,
+		lnOpts: newListenOptions(opts),
+		target: opts.Target,
+		dialer: newDialer(opts),
+	}, nil
+}
+
+// Tag returns the routing tag of the listener
+func (t *Tunnel) Tag() string {
+	return t.tag
+}
+
+// Start begins listening and forwarding connections
+func (t *Tunnel) Start(ctx context.Context) error {
+	ln, err := t.lnOpts.listen(ctx)
+	if err != nil {
+		return err
+	}
+	t.listener = ln
+
+	slog.Info("Tunnel started", "inbound", t.tag, "listen", t.listen, "target", t.target)
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("failed to accept connection", "inbound", t.tag, "error", err)
+				continue
+			}
+
+			go t.handleConnection(conn)
+		}
+	}()
+
+	return nil
+}
+
+// handleConnection relays a client connection to the tunnel target
+func (t *Tunnel) handleConnection(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	// No sniffing, the target is fixed
+	targetConn, err := t.dialer.dial(withClient(context.Background(), clientConn.RemoteAddr()), "tunnel", "tcp", t.target, false)
+	if err != nil {
+		slog.Error("failed to connect to target", "inbound", t.tag, "target", t.target, "error", err)
+		return
+	}
+
+	relay(clientConn, targetConn)
+}
+
+// Shutdown stops accepting new connections
+func (t *Tunnel) Shutdown(ctx context.Context) error {
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
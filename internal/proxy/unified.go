@@ -3,113 +3,129 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
 
-	"github.com/armon/go-socks5"
 	"github.com/elazarl/goproxy"
-	"github.com/xrdavies/light-ss/internal/shadowsocks"
-	"github.com/xrdavies/light-ss/internal/stats"
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/pac"
 )
 
+// httpKeepAliveTimeout is how long a plain HTTP client connection may wait
+// for its next request before it is closed
+const httpKeepAliveTimeout = 60 * time.Second
+
 // UnifiedProxy serves both HTTP/HTTPS and SOCKS5 on a single port
 type UnifiedProxy struct {
-	listen     string
-	getClient  func() *shadowsocks.Client // Function to get current client (for hot-reload)
-	collector  *stats.Collector
-	listener   net.Listener
-	httpProxy  *goproxy.ProxyHttpServer
-	socks5Conf *socks5.Config
+	tag       string
+	listen    string
+	lnOpts    listenOptions
+	auth      *config.AuthConfig
+	dialer    *dialer
+	listener  net.Listener
+	httpProxy *goproxy.ProxyHttpServer
+	socks5    *socks5Handler
+	pacScript func(host string) []byte // Renders the PAC file, returns nil when disabled
 }
 
 // NewUnifiedProxy creates a unified proxy that handles both protocols
-func NewUnifiedProxy(listen string, getClient func() *shadowsocks.Client, collector *stats.Collector) (*UnifiedProxy, error) {
+func NewUnifiedProxy(opts Options) (*UnifiedProxy, error) {
 	u := &UnifiedProxy{
-		listen:    listen,
-		getClient: getClient,
-		collector: collector,
+		tag:       opts.Tag,
+		listen:    opts.Listen,
+		lnOpts:    newListenOptions(opts),
+		auth:      opts.Auth,
+		dialer:    newDialer(opts),
+		pacScript: opts.PACScript,
 	}
 
 	// Setup HTTP proxy
+	httpProxy := newPlainHTTPProxy(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return u.dialer.dial(ctx, "http", network, addr, false)
+	})
+
+	// Setup SOCKS5 handler
+	u.socks5 = newSOCKS5Handler(opts)
+	if u.dialer.sniffer != nil {
+		slog.Info("SOCKS5 protocol sniffing enabled", "inbound", u.tag, "skip_domains", len(opts.Sniffing.SkipDomains))
+	}
+
+	u.httpProxy = httpProxy
+
+	return u, nil
+}
+
+// newPlainHTTPProxy creates the handler of plain HTTP requests, dialing
+// targets with dial
+func newPlainHTTPProxy(dial dialFunc) *goproxy.ProxyHttpServer {
 	httpProxy := goproxy.NewProxyHttpServer()
 	httpProxy.Verbose = false
+	// Every request gets its own upstream connection, so stats and the
+	// client address of the connection belong to that request only
 	httpProxy.Tr = &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			conn, err := u.getClient().DialContext(ctx, network, addr)
-			if err != nil {
-				return nil, err
-			}
-			if collector != nil {
-				conn = stats.NewTrackedConn(conn, collector, "http", addr)
-			}
-			return conn, nil
-		},
+		DialContext:       dial,
+		DisableKeepAlives: true,
 	}
 	httpProxy.ConnectDial = httpProxy.Tr.Dial
+	httpProxy.OnResponse().DoFunc(recordExchange)
+	return httpProxy
+}
 
-	// Setup SOCKS5 config
-	socks5Conf := &socks5.Config{
-		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			conn, err := u.getClient().DialContext(ctx, network, addr)
-			if err != nil {
-				return nil, err
-			}
-			if collector != nil {
-				conn = stats.NewTrackedConn(conn, collector, "socks5", addr)
-			}
-			return conn, nil
-		},
-	}
-
-	u.httpProxy = httpProxy
-	u.socks5Conf = socks5Conf
-
-	return u, nil
+// Tag returns the routing tag of the listener
+func (u *UnifiedProxy) Tag() string {
+	return u.tag
 }
 
 // Start begins listening and serving both protocols
 func (u *UnifiedProxy) Start(ctx context.Context) error {
-	var lc net.ListenConfig
-	listener, err := lc.Listen(ctx, "tcp", u.listen)
+	ln, err := u.lnOpts.listen(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", u.listen, err)
+		return err
 	}
-	u.listener = listener
+	u.listener = ln
 
-	slog.Info("unified proxy started", "address", u.listen, "protocols", "HTTP/HTTPS/SOCKS5")
-
-	// Create SOCKS5 server
-	socks5Server, err := socks5.New(u.socks5Conf)
-	if err != nil {
-		return fmt.Errorf("failed to create SOCKS5 server: %w", err)
-	}
+	slog.Info("unified proxy started", "inbound", u.tag, "address", u.listen, "protocols", "HTTP/HTTPS/SOCKS5")
 
 	go func() {
 		<-ctx.Done()
-		u.listener.Close()
+		ln.Close()
 	}()
 
+	go u.serve(ctx, ln)
+
+	return nil
+}
+
+// serve accepts connections until the listener is closed
+func (u *UnifiedProxy) serve(ctx context.Context, ln net.Listener) {
 	for {
-		conn, err := listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
-				return nil
+				return
 			default:
-				slog.Error("failed to accept connection", "error", err)
-				continue
 			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("failed to accept connection", "inbound", u.tag, "error", err)
+			continue
 		}
 
-		go u.handleConnection(conn, socks5Server)
+		go u.handleConnection(conn)
 	}
 }
 
 // handleConnection detects protocol and routes to appropriate handler
-func (u *UnifiedProxy) handleConnection(conn net.Conn, socks5Server *socks5.Server) {
+func (u *UnifiedProxy) handleConnection(conn net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
 			slog.Error("panic in connection handler", "error", r)
@@ -119,7 +135,9 @@ func (u *UnifiedProxy) handleConnection(conn net.Conn, socks5Server *socks5.Serv
 
 	// Create buffered reader to peek at first byte
 	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(socks5HandshakeTimeout))
 	firstByte, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
 	if err != nil {
 		// Connection closed before sending data during protocol detection
 		slog.Debug("failed to peek first byte for protocol detection (connection closed by client)", "error", err)
@@ -136,8 +154,8 @@ func (u *UnifiedProxy) handleConnection(conn net.Conn, socks5Server *socks5.Serv
 	// SOCKS5 version byte is 0x05
 	if firstByte[0] == 0x05 {
 		slog.Debug("detected SOCKS5 protocol")
-		if err := socks5Server.ServeConn(bufferedConn); err != nil {
-			slog.Error("SOCKS5 connection failed", "error", err)
+		if err := u.socks5.serveConn(bufferedConn); err != nil {
+			slog.Debug("SOCKS5 connection failed", "inbound", u.tag, "error", err)
 		}
 	} else {
 		slog.Debug("detected HTTP protocol")
@@ -146,33 +164,97 @@ func (u *UnifiedProxy) handleConnection(conn net.Conn, socks5Server *socks5.Serv
 	}
 }
 
-// handleHTTP processes HTTP/HTTPS requests
+// handleHTTP processes HTTP/HTTPS requests until the client closes the
+// connection, a response cannot be reused or the connection idles for
+// httpKeepAliveTimeout. Closing it releases its slot in the listener limits.
 func (u *UnifiedProxy) handleHTTP(conn net.Conn, reader *bufio.Reader) {
-	// Parse HTTP request
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		if err != io.EOF {
-			slog.Error("failed to read HTTP request", "error", err)
+	defer conn.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(httpKeepAliveTimeout))
+		req, err := http.ReadRequest(reader)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			var netErr net.Error
+			if err != io.EOF && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				slog.Error("failed to read HTTP request", "error", err)
+			}
+			return
 		}
-		conn.Close()
-		return
+
+		if !u.serveHTTPRequest(conn, req) {
+			return
+		}
+	}
+}
+
+// serveHTTPRequest serves one request read from conn and reports whether the
+// connection can serve another one
+func (u *UnifiedProxy) serveHTTPRequest(conn net.Conn, req *http.Request) bool {
+	req.RemoteAddr = conn.RemoteAddr().String()
+
+	// Requests addressed to the proxy itself (origin-form) for the PAC file
+	if req.Method == http.MethodGet && !req.URL.IsAbs() && isPACPath(req.URL.Path) {
+		u.handlePAC(conn, req)
+		return false
 	}
 
+	// Check proxy credentials if configured
+	if !checkProxyAuth(req, u.auth) {
+		slog.Debug("HTTP proxy authentication failed", "inbound", u.tag, "remote", conn.RemoteAddr())
+		io.WriteString(conn, proxyAuthRequired)
+		return false
+	}
+	req.Header.Del("Proxy-Authorization")
+
 	// Handle CONNECT method (HTTPS tunneling)
 	if req.Method == http.MethodConnect {
 		u.handleConnect(conn, req)
-		return
+		return false
 	}
 
 	// Handle regular HTTP request
 	req.URL.Scheme = "http"
 	req.URL.Host = req.Host
 
-	// Create response writer
+	// Serve with goproxy, passing the client address on to the dialer
+	ex := &exchange{contentLength: -1}
+	writer := newConnResponseWriter(conn)
+	writer.keepAlive(req, ex)
+	ctx := context.WithValue(withClient(req.Context(), conn.RemoteAddr()), exchangeKey{}, ex)
+	u.httpProxy.ServeHTTP(writer, req.WithContext(ctx))
+
+	// Skip what the upstream request did not read of the body
+	req.Body.Close()
+	return writer.finish()
+}
+
+// handlePAC serves the generated PAC file directly from the proxy listener
+func (u *UnifiedProxy) handlePAC(conn net.Conn, req *http.Request) {
+	defer conn.Close()
+
+	var script []byte
+	if u.pacScript != nil {
+		script = u.pacScript(req.Host)
+	}
+
 	writer := newConnResponseWriter(conn)
+	writer.Header().Set("Connection", "close")
+	if script == nil {
+		writer.Header().Set("Content-Length", "0")
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	// Serve with goproxy
-	u.httpProxy.ServeHTTP(writer, req)
+	writer.Header().Set("Content-Type", pac.ContentType)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(script)))
+	writer.Write(script)
+	slog.Debug("Served PAC file", "path", req.URL.Path, "remote", conn.RemoteAddr())
+}
+
+// isPACPath reports whether path is one of the well-known PAC/WPAD locations
+func isPACPath(path string) bool {
+	return path == "/proxy.pac" || path == "/wpad.dat"
 }
 
 // handleConnect handles HTTPS CONNECT tunneling
@@ -180,34 +262,18 @@ func (u *UnifiedProxy) handleConnect(clientConn net.Conn, req *http.Request) {
 	defer clientConn.Close()
 
 	// Connect to target through shadowsocks
-	targetConn, err := u.getClient().DialContext(context.Background(), "tcp", req.Host)
+	targetConn, err := u.dialer.dial(withClient(context.Background(), clientConn.RemoteAddr()), "http", "tcp", req.Host, false)
 	if err != nil {
-		slog.Error("failed to connect to target", "host", req.Host, "error", err)
+		slog.Error("failed to connect to target", "inbound", u.tag, "host", req.Host, "error", err)
 		fmt.Fprintf(clientConn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
 		return
 	}
 	defer targetConn.Close()
 
-	if u.collector != nil {
-		targetConn = stats.NewTrackedConn(targetConn, u.collector, "http", req.Host)
-	}
-
 	// Send success response
 	fmt.Fprintf(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n")
 
-	// Bidirectional copy
-	errCh := make(chan error, 2)
-	go func() {
-		_, err := io.Copy(targetConn, clientConn)
-		errCh <- err
-	}()
-	go func() {
-		_, err := io.Copy(clientConn, targetConn)
-		errCh <- err
-	}()
-
-	// Wait for either direction to complete
-	<-errCh
+	relay(clientConn, targetConn)
 }
 
 // Shutdown gracefully stops the proxy
@@ -228,12 +294,60 @@ func (c *bufferConn) Read(b []byte) (int, error) {
 	return c.reader.Read(b)
 }
 
+// NetConn returns the underlying connection
+func (c *bufferConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// exchangeKey is the context key of the exchange of a plain HTTP request
+type exchangeKey struct{}
+
+// exchange records the upstream response of a plain HTTP request
+type exchange struct {
+	contentLength int64 // Of the upstream response, -1 if unknown
+	err           error // Reading the upstream response body failed
+}
+
+// recordExchange is a goproxy response handler recording the response length
+// and body errors in the exchange of the request
+func recordExchange(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	ex, ok := ctx.Req.Context().Value(exchangeKey{}).(*exchange)
+	if !ok || resp == nil {
+		return resp
+	}
+	ex.contentLength = resp.ContentLength
+	resp.Body = &exchangeBody{ReadCloser: resp.Body, ex: ex}
+	return resp
+}
+
+// exchangeBody records errors reading an upstream response body
+type exchangeBody struct {
+	io.ReadCloser
+	ex *exchange
+}
+
+func (b *exchangeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.ex.err = err
+	}
+	return n, err
+}
+
 // connResponseWriter implements http.ResponseWriter for raw connections
 type connResponseWriter struct {
 	conn       net.Conn
 	header     http.Header
 	statusCode int
 	written    bool
+
+	// Framing for keep-alive connections, see keepAlive
+	req     *http.Request
+	ex      *exchange
+	close   bool           // The connection is closed after the response
+	chunked io.WriteCloser // Encodes a body of unknown length, nil otherwise
+	length  int64          // Declared body length, -1 if none
+	sent    int64          // Body bytes written
 }
 
 func newConnResponseWriter(conn net.Conn) *connResponseWriter {
@@ -247,11 +361,27 @@ func (w *connResponseWriter) Header() http.Header {
 	return w.header
 }
 
+// keepAlive frames the response to req so the connection can serve another
+// request afterwards, unless the client asked to close it
+func (w *connResponseWriter) keepAlive(req *http.Request, ex *exchange) {
+	w.req = req
+	w.ex = ex
+	w.close = req.Close
+	w.length = -1
+}
+
 func (w *connResponseWriter) Write(b []byte) (int, error) {
 	if !w.written {
 		w.WriteHeader(http.StatusOK)
 	}
-	return w.conn.Write(b)
+	if w.chunked != nil {
+		n, err := w.chunked.Write(b)
+		w.sent += int64(n)
+		return n, err
+	}
+	n, err := w.conn.Write(b)
+	w.sent += int64(n)
+	return n, err
 }
 
 func (w *connResponseWriter) WriteHeader(statusCode int) {
@@ -260,6 +390,9 @@ func (w *connResponseWriter) WriteHeader(statusCode int) {
 	}
 	w.written = true
 	w.statusCode = statusCode
+	if w.req != nil {
+		w.frame()
+	}
 
 	// Write status line
 	fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
@@ -271,4 +404,62 @@ func (w *connResponseWriter) WriteHeader(statusCode int) {
 		}
 	}
 	fmt.Fprintf(w.conn, "\r\n")
+
+	if w.req != nil && w.length < 0 && !w.close && !w.bodyless() {
+		w.chunked = httputil.NewChunkedWriter(w.conn)
+	}
+}
+
+// bodyless reports whether the response has no body
+func (w *connResponseWriter) bodyless() bool {
+	return w.req.Method == http.MethodHead || w.statusCode < 200 ||
+		w.statusCode == http.StatusNoContent || w.statusCode == http.StatusNotModified
+}
+
+// frame sets the headers delimiting the response body: its length if known,
+// chunked encoding for HTTP/1.1 clients, otherwise the end of the connection
+func (w *connResponseWriter) frame() {
+	for _, h := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding"} {
+		w.header.Del(h)
+	}
+	// Upgrades such as WebSocket are not supported on raw connections
+	if w.statusCode == http.StatusSwitchingProtocols {
+		w.close = true
+	}
+
+	if n, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		w.length = n
+	} else if w.ex.contentLength >= 0 && !w.bodyless() {
+		// goproxy drops the header when a handler wraps the body
+		w.length = w.ex.contentLength
+		w.header.Set("Content-Length", strconv.FormatInt(w.length, 10))
+	}
+
+	switch {
+	case w.close || w.bodyless() || w.length >= 0:
+	case w.req.ProtoAtLeast(1, 1):
+		w.header.Set("Transfer-Encoding", "chunked")
+	default:
+		w.close = true
+	}
+	if w.close {
+		w.header.Set("Connection", "close")
+	}
+}
+
+// finish completes the response of a keep-alive request and reports whether
+// the connection can serve another request. Responses cut short upstream
+// close the connection so the client notices.
+func (w *connResponseWriter) finish() bool {
+	if !w.written || w.close || w.ex.err != nil {
+		return false
+	}
+	if w.chunked != nil {
+		if err := w.chunked.Close(); err != nil {
+			return false
+		}
+		_, err := io.WriteString(w.conn, "\r\n")
+		return err == nil
+	}
+	return w.bodyless() || w.sent == w.length
 }
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveUnifiedHTTP runs the plain HTTP path of a unified proxy dialing
+// targets directly on one end of a pipe and returns the client end
+func serveUnifiedHTTP(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	var d net.Dialer
+	u := &UnifiedProxy{tag: "test", httpProxy: newPlainHTTPProxy(d.DialContext)}
+
+	client, server := net.Pipe()
+	go u.handleHTTP(server, bufio.NewReader(server))
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { client.Close() })
+	return client, bufio.NewReader(client)
+}
+
+// get sends a GET request for url on conn and returns the response body
+func get(t *testing.T, conn net.Conn, reader *bufio.Reader, url string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	go req.WriteProxy(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s body: %v", url, err)
+	}
+	return resp, string(body)
+}
+
+func TestUnifiedHTTPKeepAlive(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stream":
+			// Unknown length, chunked to the proxy
+			io.WriteString(w, "chunk one ")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "chunk two")
+		case "/cut":
+			conn, buf, _ := w.(http.Hijacker).Hijack()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial")
+			buf.Flush()
+			conn.Close()
+		default:
+			io.WriteString(w, "hello")
+		}
+	}))
+	defer target.Close()
+
+	conn, reader := serveUnifiedHTTP(t)
+	for _, path := range []string{"/fixed", "/stream", "/fixed"} {
+		resp, body := get(t, conn, reader, target.URL+path)
+		if resp.StatusCode != http.StatusOK || resp.Close {
+			t.Fatalf("GET %s: status %d, close %v; want 200 on a kept connection", path, resp.StatusCode, resp.Close)
+		}
+		want := "hello"
+		if path == "/stream" {
+			want = "chunk one chunk two"
+		}
+		if body != want {
+			t.Errorf("GET %s: body %q, want %q", path, body, want)
+		}
+	}
+
+	// A response cut short upstream must not look complete to the client
+	req, _ := http.NewRequest(http.MethodGet, target.URL+"/cut", nil)
+	go req.WriteProxy(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("GET /cut: %v", err)
+	}
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("GET /cut: truncated body read without error")
+	}
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("connection still open after a truncated response")
+	}
+}
+
+func TestUnifiedHTTPConnectionClose(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer target.Close()
+
+	conn, reader := serveUnifiedHTTP(t)
+	req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	req.Close = true
+	go req.WriteProxy(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	if !resp.Close {
+		t.Error("response to Connection: close lacks Connection: close")
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("read after Connection: close returned %v, want EOF", err)
+	}
+}
@@ -0,0 +1,299 @@
+// Package quota enforces daily and monthly traffic quotas of upstream
+// servers and proxy users, based on the usage counted by stats.Collector.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/atomicfile"
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/stats"
+)
+
+// saveInterval is how often usage is written to the state file
+const saveInterval = time.Minute
+
+// checkInterval is how often open connections are checked against the quotas
+const checkInterval = 10 * time.Second
+
+// ReasonExceeded is the close reason for connections refused or closed by a quota
+const ReasonExceeded = "quota_exceeded"
+
+// Scopes of a quota
+const (
+	ScopeServer = "server"
+	ScopeUser   = "user"
+)
+
+// Quota periods
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// ErrExceeded is returned for connections refused by a quota with the block action
+var ErrExceeded = errors.New("traffic quota exceeded")
+
+// Status is the state of one quota
+type Status struct {
+	Scope        string `json:"scope"` // server or user
+	Name         string `json:"name"`
+	Action       string `json:"action"`
+	SwitchTo     string `json:"switch_to,omitempty"`
+	DailyLimit   int64  `json:"daily_limit,omitempty"`
+	DailyUsed    int64  `json:"daily_used"`
+	MonthlyLimit int64  `json:"monthly_limit,omitempty"`
+	MonthlyUsed  int64  `json:"monthly_used"`
+	Exceeded     string `json:"exceeded,omitempty"` // Period used up: daily or monthly
+}
+
+// Enforcer decides which server a new connection may use
+type Enforcer struct {
+	collector *stats.Collector
+	stateFile string
+
+	quotasMu sync.RWMutex
+	servers  map[string]config.QuotaConfig
+	users    map[string]config.QuotaConfig
+
+	mu     sync.Mutex
+	warned map[string]string // Scope/name to the period last reported as exceeded
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates an enforcer and restores usage from the state file.
+// Returns nil if no quotas are configured.
+func New(cfg config.QuotasConfig, collector *stats.Collector) (*Enforcer, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	e := &Enforcer{
+		servers:   cfg.Servers,
+		users:     cfg.Users,
+		collector: collector,
+		stateFile: cfg.StateFile,
+		warned:    make(map[string]string),
+		done:      make(chan struct{}),
+	}
+
+	if e.stateFile == "" {
+		slog.Warn("Quota usage is not persisted, set quotas.state_file to keep it across restarts")
+		return e, nil
+	}
+
+	data, err := os.ReadFile(e.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota state: %w", err)
+	}
+	var state stats.UsageState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse quota state %s: %w", e.stateFile, err)
+	}
+	collector.RestoreUsage(state)
+	slog.Info("Quota usage restored", "file", e.stateFile, "servers", len(state.Servers), "users", len(state.Users))
+
+	return e, nil
+}
+
+// Start closes open connections over their quota and saves usage to the
+// state file periodically
+func (e *Enforcer) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		check := time.NewTicker(checkInterval)
+		defer check.Stop()
+		save := time.NewTicker(saveInterval)
+		defer save.Stop()
+
+		for {
+			select {
+			case <-check.C:
+				e.closeExceeded()
+			case <-save.C:
+				if e.stateFile == "" {
+					continue
+				}
+				if err := e.Save(); err != nil {
+					slog.Error("Failed to save quota state", "error", err)
+				}
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// closeExceeded closes the open connections that Route would no longer send
+// through their server: blocked ones, and ones a switch action moves away
+func (e *Enforcer) closeExceeded() {
+	n := e.collector.CloseConnections(func(conn stats.Connection) bool {
+		server, err := e.Route(conn.Server, conn.User)
+		return err != nil || server != conn.Server
+	}, ReasonExceeded)
+	if n > 0 {
+		slog.Info("Closed connections over their traffic quota", "connections", n)
+	}
+}
+
+// Stop stops periodic saving and saves usage a last time
+func (e *Enforcer) Stop() error {
+	close(e.done)
+	e.wg.Wait()
+	if e.stateFile == "" {
+		return nil
+	}
+	return e.Save()
+}
+
+// Save writes the current usage to the state file, replacing it atomically
+func (e *Enforcer) Save() error {
+	data, err := json.MarshalIndent(e.collector.UsageState(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(e.stateFile, data, 0600)
+}
+
+// Update replaces the quotas, keeping the usage counted so far
+func (e *Enforcer) Update(cfg config.QuotasConfig) {
+	e.quotasMu.Lock()
+	defer e.quotasMu.Unlock()
+	e.servers = cfg.Servers
+	e.users = cfg.Users
+}
+
+// quotas returns the current server and user quotas
+func (e *Enforcer) quotas() (servers, users map[string]config.QuotaConfig) {
+	e.quotasMu.RLock()
+	defer e.quotasMu.RUnlock()
+	return e.servers, e.users
+}
+
+// Route returns the server a new connection of user (empty if not
+// authenticated) should use instead of server, or ErrExceeded if the
+// connection must be refused
+func (e *Enforcer) Route(server, user string) (string, error) {
+	servers, users := e.quotas()
+	if q, ok := users[user]; ok && user != "" {
+		if period := exceeded(q, e.collector.UserUsage(user)); period != "" {
+			e.warn(ScopeUser, user, period, q)
+			switch q.Action {
+			case config.QuotaBlock:
+				return "", ErrExceeded
+			case config.QuotaSwitch:
+				server = q.SwitchTo
+			}
+		}
+	}
+
+	// Follow switch_to chains, refusing when they loop back to an exceeded server
+	visited := make(map[string]bool)
+	for !visited[server] {
+		visited[server] = true
+
+		q, ok := servers[server]
+		if !ok {
+			return server, nil
+		}
+		period := exceeded(q, e.collector.ServerUsage(server))
+		if period == "" {
+			return server, nil
+		}
+		e.warn(ScopeServer, server, period, q)
+
+		switch q.Action {
+		case config.QuotaBlock:
+			return "", ErrExceeded
+		case config.QuotaSwitch:
+			server = q.SwitchTo
+		default:
+			return server, nil
+		}
+	}
+	return "", ErrExceeded
+}
+
+// exceeded returns the period whose quota is used up, or "" if none
+func exceeded(q config.QuotaConfig, u stats.Usage) string {
+	switch {
+	case q.Daily > 0 && u.DayBytes >= int64(q.Daily):
+		return PeriodDaily
+	case q.Monthly > 0 && u.MonthBytes >= int64(q.Monthly):
+		return PeriodMonthly
+	default:
+		return ""
+	}
+}
+
+// warn logs an exceeded quota once per day or month
+func (e *Enforcer) warn(scope, name, period string, q config.QuotaConfig) {
+	key := period + " " + time.Now().Format("2006-01")
+	if period == PeriodDaily {
+		key = period + " " + time.Now().Format("2006-01-02")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.warned[scope+"/"+name] == key {
+		return
+	}
+	e.warned[scope+"/"+name] = key
+
+	attrs := []any{"scope", scope, "name", name, "period", period, "action", q.Action}
+	if q.Action == config.QuotaSwitch {
+		attrs = append(attrs, "switch_to", q.SwitchTo)
+	}
+	slog.Warn("Traffic quota exceeded", attrs...)
+}
+
+// Status returns the state of every quota, servers first
+func (e *Enforcer) Status() []Status {
+	servers, users := e.quotas()
+	var list []Status
+	for _, name := range sortedNames(servers) {
+		list = append(list, status(ScopeServer, name, servers[name], e.collector.ServerUsage(name)))
+	}
+	for _, name := range sortedNames(users) {
+		list = append(list, status(ScopeUser, name, users[name], e.collector.UserUsage(name)))
+	}
+	return list
+}
+
+// status reports one quota
+func status(scope, name string, q config.QuotaConfig, u stats.Usage) Status {
+	return Status{
+		Scope:        scope,
+		Name:         name,
+		Action:       q.Action,
+		SwitchTo:     q.SwitchTo,
+		DailyLimit:   int64(q.Daily),
+		DailyUsed:    u.DayBytes,
+		MonthlyLimit: int64(q.Monthly),
+		MonthlyUsed:  u.MonthBytes,
+		Exceeded:     exceeded(q, u),
+	}
+}
+
+// sortedNames returns the keys of m in order
+func sortedNames(m map[string]config.QuotaConfig) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
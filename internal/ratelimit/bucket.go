@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket limiting a byte rate. The burst size is one
+// second worth of tokens. A rate of 0 means unlimited.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   int64   // Bytes per second, 0 = unlimited
+	tokens float64 // Available bytes, negative while callers are waiting
+	last   time.Time
+}
+
+// NewBucket creates a bucket limited to rate bytes per second
+func NewBucket(rate int64) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Rate returns the current rate in bytes per second (0 = unlimited)
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// SetRate changes the rate. It applies to subsequent calls of Wait.
+func (b *Bucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+// Wait blocks until n bytes may pass or ctx is done. Callers reserve tokens
+// up front, so concurrent callers are served in order and n may exceed the
+// burst size. A canceled wait returns its tokens and ctx.Err().
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	d := b.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.release(n)
+		return ctx.Err()
+	}
+}
+
+// reserve takes n tokens and returns how long the caller has to wait
+func (b *Bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// release returns n reserved tokens, up to the burst size
+func (b *Bucket) release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.tokens += float64(n)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+}
+
+// refill adds the tokens accumulated since the last update, up to the burst size
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if b.rate <= 0 {
+		b.tokens = 0
+		return
+	}
+	b.tokens += elapsed * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+}
@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBucketWaitCanceled(t *testing.T) {
+	b := NewBucket(1000)
+	b.Wait(context.Background(), 1000) // Drain the burst
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Wait(ctx, 10000) // 10 seconds worth of tokens
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Wait = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after cancel")
+	}
+
+	// The canceled reservation is returned, so a small wait is short
+	start := time.Now()
+	if err := b.Wait(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Wait after cancel took %v, canceled tokens were not returned", d)
+	}
+}
@@ -0,0 +1,167 @@
+// Package ratelimit shapes proxied traffic with token buckets applied
+// globally, per inbound and per authenticated user.
+package ratelimit
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Limit is an upload/download rate pair in bytes per second (0 = unlimited)
+type Limit struct {
+	UploadRate   int64 `json:"upload_rate"`
+	DownloadRate int64 `json:"download_rate"`
+}
+
+// Pair holds the upload and download buckets of one scope
+type Pair struct {
+	Upload   *Bucket
+	Download *Bucket
+}
+
+// newPair creates buckets for limit
+func newPair(limit Limit) *Pair {
+	return &Pair{
+		Upload:   NewBucket(limit.UploadRate),
+		Download: NewBucket(limit.DownloadRate),
+	}
+}
+
+// Limit returns the current rates
+func (p *Pair) Limit() Limit {
+	return Limit{UploadRate: p.Upload.Rate(), DownloadRate: p.Download.Rate()}
+}
+
+// SetLimit changes both rates
+func (p *Pair) SetLimit(limit Limit) {
+	p.Upload.SetRate(limit.UploadRate)
+	p.Download.SetRate(limit.DownloadRate)
+}
+
+// Limits describes the rates of every scope
+type Limits struct {
+	Global   Limit            `json:"global"`
+	Inbounds map[string]Limit `json:"inbounds,omitempty"`
+	Users    map[string]Limit `json:"users,omitempty"`
+}
+
+// Set holds the buckets of all scopes. Buckets are created on first use so
+// that limits can be set at runtime for any inbound or user.
+type Set struct {
+	global *Pair
+
+	mu       sync.Mutex
+	inbounds map[string]*Pair
+	users    map[string]*Pair
+}
+
+// NewSet creates buckets for the given limits
+func NewSet(limits Limits) *Set {
+	s := &Set{
+		global:   newPair(limits.Global),
+		inbounds: make(map[string]*Pair),
+		users:    make(map[string]*Pair),
+	}
+	for tag, limit := range limits.Inbounds {
+		s.inbounds[tag] = newPair(limit)
+	}
+	for name, limit := range limits.Users {
+		s.users[name] = newPair(limit)
+	}
+	return s
+}
+
+// Chain returns the buckets applying to a connection on inbound tag by user
+// (empty if not authenticated)
+func (s *Set) Chain(tag, user string) Chain {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chain := Chain{s.global, s.pair(s.inbounds, tag)}
+	if user != "" {
+		chain = append(chain, s.pair(s.users, user))
+	}
+	return chain
+}
+
+// pair returns the buckets for key, creating unlimited ones if needed
+func (s *Set) pair(pairs map[string]*Pair, key string) *Pair {
+	p, ok := pairs[key]
+	if !ok {
+		p = newPair(Limit{})
+		pairs[key] = p
+	}
+	return p
+}
+
+// Limits returns the current rates. Inbounds and users without limits are omitted.
+func (s *Set) Limits() Limits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limits := Limits{
+		Global:   s.global.Limit(),
+		Inbounds: make(map[string]Limit),
+		Users:    make(map[string]Limit),
+	}
+	for tag, p := range s.inbounds {
+		if limit := p.Limit(); limit != (Limit{}) {
+			limits.Inbounds[tag] = limit
+		}
+	}
+	for name, p := range s.users {
+		if limit := p.Limit(); limit != (Limit{}) {
+			limits.Users[name] = limit
+		}
+	}
+	return limits
+}
+
+// Update applies limits. The global limit is always replaced; inbounds and
+// users are only changed if listed.
+func (s *Set) Update(limits Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.global.SetLimit(limits.Global)
+	for _, tag := range sortedKeys(limits.Inbounds) {
+		s.pair(s.inbounds, tag).SetLimit(limits.Inbounds[tag])
+	}
+	for _, name := range sortedKeys(limits.Users) {
+		s.pair(s.users, name).SetLimit(limits.Users[name])
+	}
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]Limit) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Chain is the list of buckets a connection's traffic has to pass
+type Chain []*Pair
+
+// WaitUpload blocks until n bytes may be sent to the target or ctx is done
+func (c Chain) WaitUpload(ctx context.Context, n int) error {
+	for _, p := range c {
+		if err := p.Upload.Wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitDownload blocks until n bytes may be delivered to the client or ctx is done
+func (c Chain) WaitDownload(ctx context.Context, n int) error {
+	for _, p := range c {
+		if err := p.Download.Wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,95 +2,164 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/events"
+	"github.com/xrdavies/light-ss/internal/listener"
+	"github.com/xrdavies/light-ss/internal/pac"
 	"github.com/xrdavies/light-ss/internal/proxy"
+	"github.com/xrdavies/light-ss/internal/quota"
+	"github.com/xrdavies/light-ss/internal/ratelimit"
 	"github.com/xrdavies/light-ss/internal/shadowsocks"
 	"github.com/xrdavies/light-ss/internal/stats"
 )
 
 // Manager manages all proxy servers and their lifecycle
 type Manager struct {
-	unifiedProxy *proxy.UnifiedProxy
-	httpServer   *proxy.HTTPServer
-	socks5Server *proxy.SOCKS5Server
-	ssClient     *shadowsocks.Client
-	collector    *stats.Collector
-	reporter     *stats.Reporter
-	config       *config.Config
-	apiServer    interface{} // Will be *api.Server, using interface{} to avoid circular dependency
+	inbounds  []proxy.Inbound
+	clients   map[string]*shadowsocks.Client // Upstream clients by server name
+	collector *stats.Collector
+	reporter  *stats.Reporter
+	history   *stats.History    // Traffic history, nil when stats are disabled
+	apiServer interface{}       // Will be *api.Server, using interface{} to avoid circular dependency
+	pacFile   *pac.File         // Generated PAC file, nil when disabled
+	limiter   *listener.Limiter // Connection limits shared by all inbounds, nil when unlimited
+	rates     *ratelimit.Set    // Bandwidth limits, adjustable at runtime
+	ratesSet  atomic.Bool       // rates were changed at runtime since the last reload
+	quota     *quota.Enforcer   // Traffic quotas, nil when none are configured
+	events    *events.Bus       // Real-time events for API subscribers
+	conns     *listener.Counter // Open client connections of all inbounds
+
+	// Current configuration, replaced (never modified) by reloads
+	config atomic.Pointer[config.Config]
 
 	// For hot-reload support
 	ssClientMu sync.RWMutex
-	oldClients []*shadowsocks.Client
+	reloadMu   sync.Mutex // Serializes configuration reloads
+	configFile string     // Loaded config file, updated by write-back
+	selected   string     // Server of inbounds without a server setting
+
+	// Applied configurations kept for rollback, oldest first
+	revisionsMu sync.RWMutex
+	revisions   []Revision
+	lastRev     int
 
 	// For graceful shutdown
 	ctx        context.Context
 	cancelFunc context.CancelFunc
+	exit       chan bool // Stop and restart requests, true to restart
+
+	stopMu  sync.Mutex
+	stopped bool // Inbounds no longer accept connections (drained or shut down)
 }
 
-// NewManager creates a new server manager
-func NewManager(cfg *config.Config) (*Manager, error) {
-	// Create shadowsocks client
+// drainPollInterval is how often Drain checks for remaining connections
+const drainPollInterval = 100 * time.Millisecond
+
+// NewManager creates a new server manager that publishes events to bus
+func NewManager(cfg *config.Config, bus *events.Bus) (*Manager, error) {
+	// Create shadowsocks clients for the default and named servers
+	clients := make(map[string]*shadowsocks.Client)
 	ssClient, err := shadowsocks.NewClient(cfg.Shadowsocks)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create shadowsocks client: %w", err)
 	}
+	clients[config.DefaultServerName] = ssClient
+
+	for _, srv := range cfg.Servers {
+		client, err := shadowsocks.NewClient(srv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create shadowsocks client for server %s: %w", srv.Name, err)
+		}
+		clients[srv.Name] = client
+	}
 
-	// Create stats collector if enabled
+	// Create stats collector if enabled; quotas need it to count usage
 	var collector *stats.Collector
 	var reporter *stats.Reporter
+	var history *stats.History
+	if cfg.Stats.Enabled || cfg.Quotas.Enabled() {
+		collector = stats.NewCollector(bus)
+	}
 	if cfg.Stats.Enabled {
-		collector = stats.NewCollector()
 		reporter = stats.NewReporter(collector, cfg.Stats.Interval, cfg.Name)
 		slog.Info("Statistics collection enabled", "interval", cfg.Stats.Interval)
+
+		history, err = stats.NewHistory(collector, cfg.Stats.HistoryFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	quotas, err := quota.New(cfg.Quotas, collector)
+	if err != nil {
+		return nil, err
+	}
+	if quotas != nil {
+		slog.Info("Traffic quotas enabled", "servers", len(cfg.Quotas.Servers), "users", len(cfg.Quotas.Users))
 	}
 
 	// Create cancellable context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 
 	mgr := &Manager{
-		ssClient:   ssClient,
+		clients:    clients,
 		collector:  collector,
 		reporter:   reporter,
-		config:     cfg,
+		history:    history,
+		quota:      quotas,
+		events:     bus,
+		conns:      &listener.Counter{},
+		selected:   config.DefaultServerName,
 		ctx:        ctx,
 		cancelFunc: cancel,
+		exit:       make(chan bool, 1),
+	}
+	mgr.config.Store(cfg)
+	mgr.addRevision(cfg, SourceStartup, nil)
+
+	// Generate PAC file if enabled
+	if cfg.PAC.Enabled {
+		mgr.pacFile = pac.New(cfg)
+		slog.Info("PAC file enabled", "direct_entries", len(cfg.PAC.Direct))
+	}
+
+	// Connection limits are shared by all listeners
+	mgr.limiter = listener.NewLimiter(connectionLimits(cfg.Limits))
+	if mgr.limiter != nil {
+		slog.Info("Connection limits enabled",
+			"max_connections", cfg.Limits.MaxConnections,
+			"max_connections_per_ip", cfg.Limits.MaxConnectionsPerIP,
+			"idle_timeout", cfg.Limits.IdleTimeout,
+			"max_lifetime", cfg.Limits.MaxLifetime)
+	}
+
+	// Bandwidth limits are created for every scope so they can be changed at runtime
+	mgr.rates = ratelimit.NewSet(rateLimits(cfg))
+	if limits := mgr.rates.Limits(); limits.Global != (ratelimit.Limit{}) || len(limits.Inbounds) > 0 || len(limits.Users) > 0 {
+		slog.Info("Bandwidth limits enabled",
+			"upload_rate", limits.Global.UploadRate,
+			"download_rate", limits.Global.DownloadRate,
+			"inbounds", len(limits.Inbounds),
+			"users", len(limits.Users))
 	}
 
-	// Check if unified mode is enabled
-	if cfg.Proxies.Unified != "" {
-		// Create unified proxy for both HTTP/HTTPS and SOCKS5
-		unifiedProxy, err := proxy.NewUnifiedProxy(cfg.Proxies.Unified, mgr.GetSSClient, collector)
+	// Create a front-end for every configured listener
+	for _, in := range cfg.AllInbounds() {
+		inbound, err := mgr.newInbound(in, cfg.Sniffing, mgr.limiter)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create unified proxy: %w", err)
-		}
-		mgr.unifiedProxy = unifiedProxy
-		slog.Info("Using unified proxy mode", "address", cfg.Proxies.Unified)
-	} else {
-		// Separate mode: create HTTP and SOCKS5 proxies separately
-		// Create HTTP proxy if enabled
-		if cfg.Proxies.HTTPListen != "" {
-			httpServer, err := proxy.NewHTTPServer(cfg.Proxies.HTTPListen, ssClient, collector)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create HTTP server: %w", err)
-			}
-			mgr.httpServer = httpServer
-			slog.Info("HTTP/HTTPS proxy enabled", "address", cfg.Proxies.HTTPListen)
+			return nil, err
 		}
+		mgr.inbounds = append(mgr.inbounds, inbound)
 
-		// Create SOCKS5 proxy if enabled
-		if cfg.Proxies.SOCKS5Listen != "" {
-			socks5Server, err := proxy.NewSOCKS5Server(cfg.Proxies.SOCKS5Listen, cfg.Proxies.SOCKS5Auth, ssClient, collector)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create SOCKS5 server: %w", err)
-			}
-			mgr.socks5Server = socks5Server
-			slog.Info("SOCKS5 proxy enabled", "address", cfg.Proxies.SOCKS5Listen)
-		}
+		slog.Info("Inbound enabled", "tag", in.Tag, "type", in.Type, "address", in.Listen, "server", serverName(in.Server))
 	}
 
 	// Create API server if enabled (imported locally to avoid circular dependency)
@@ -103,6 +172,87 @@ func NewManager(cfg *config.Config) (*Manager, error) {
 	return mgr, nil
 }
 
+// inboundOptions builds the front-end options for an inbound listener
+func (m *Manager) inboundOptions(in config.InboundConfig, sniffing config.SniffingConfig, limiter *listener.Limiter) (proxy.Options, error) {
+	acl, err := listener.NewACL(in.Allow, in.Deny)
+	if err != nil {
+		return proxy.Options{}, err
+	}
+	trusted, err := listener.NewACL(in.TrustedProxies, nil)
+	if err != nil {
+		return proxy.Options{}, err
+	}
+
+	opts := proxy.Options{
+		Tag:       in.Tag,
+		Listen:    in.Listen,
+		Auth:      in.Auth,
+		Target:    in.Target,
+		Server:    in.Server,
+		Selected:  m.SelectedServer,
+		GetClient: m.serverClient,
+		Collector: m.collector,
+		PACScript: m.PACScript,
+
+		ProxyProtocol: in.ProxyProtocol,
+		TrustedProxy:  trusted,
+		ACL:           acl,
+		Limiter:       limiter,
+		Counter:       m.conns,
+		RateLimits:    m.rates,
+		Quota:         m.quota,
+	}
+
+	if in.SniffingEnabled(sniffing) {
+		sniffing.Enabled = true
+		opts.Sniffing = &sniffing
+	}
+
+	return opts, nil
+}
+
+// connectionLimits converts the configured connection limits
+func connectionLimits(cfg config.LimitsConfig) listener.Limits {
+	return listener.Limits{
+		MaxConnections:      cfg.MaxConnections,
+		MaxConnectionsPerIP: cfg.MaxConnectionsPerIP,
+		IdleTimeout:         time.Duration(cfg.IdleTimeout) * time.Second,
+		MaxLifetime:         time.Duration(cfg.MaxLifetime) * time.Second,
+	}
+}
+
+// rateLimits collects the bandwidth limits of the configuration
+func rateLimits(cfg *config.Config) ratelimit.Limits {
+	limits := ratelimit.Limits{
+		Global:   cfg.Limits.Limit(),
+		Inbounds: make(map[string]ratelimit.Limit),
+		Users:    make(map[string]ratelimit.Limit),
+	}
+	for _, in := range cfg.AllInbounds() {
+		limits.Inbounds[in.Tag] = in.Limit()
+	}
+	for name, rate := range cfg.Limits.Users {
+		limits.Users[name] = rate.Limit()
+	}
+	return limits
+}
+
+// serverName returns the server name of an inbound, the default server if empty
+func serverName(name string) string {
+	if name == "" {
+		return config.DefaultServerName
+	}
+	return name
+}
+
+// serverClient returns the current client for a server, so inbounds pick up
+// reloaded clients
+func (m *Manager) serverClient(name string) *shadowsocks.Client {
+	m.ssClientMu.RLock()
+	defer m.ssClientMu.RUnlock()
+	return m.clients[name]
+}
+
 // Start starts all enabled proxy servers
 func (m *Manager) Start() error {
 	// Start stats reporter if enabled
@@ -110,29 +260,21 @@ func (m *Manager) Start() error {
 		m.reporter.Start()
 		slog.Info("Statistics reporter started")
 	}
-
-	// Start unified proxy if enabled
-	if m.unifiedProxy != nil {
-		go func() {
-			if err := m.unifiedProxy.Start(m.ctx); err != nil {
-				slog.Error("Unified proxy error", "error", err)
-			}
-		}()
-		return nil
+	if m.history != nil {
+		m.history.Start()
 	}
 
-	// Otherwise start HTTP and SOCKS5 proxies separately
-	// Start HTTP proxy if enabled
-	if m.httpServer != nil {
-		if err := m.httpServer.Start(); err != nil {
-			return fmt.Errorf("failed to start HTTP server: %w", err)
-		}
+	if m.quota != nil {
+		m.quota.Start()
 	}
 
-	// Start SOCKS5 proxy if enabled
-	if m.socks5Server != nil {
-		if err := m.socks5Server.Start(); err != nil {
-			return fmt.Errorf("failed to start SOCKS5 server: %w", err)
+	// Start every inbound, stopping the ones already started on failure
+	for i, inbound := range m.inbounds {
+		if err := inbound.Start(m.ctx); err != nil {
+			for _, started := range m.inbounds[:i] {
+				started.Shutdown(m.ctx)
+			}
+			return fmt.Errorf("failed to start inbound %s: %w", inbound.Tag(), err)
 		}
 	}
 
@@ -153,6 +295,18 @@ func (m *Manager) Shutdown(ctx context.Context) error {
 		m.reporter.Stop()
 		slog.Info("Statistics reporter stopped")
 	}
+	if m.history != nil {
+		if err := m.history.Stop(); err != nil {
+			slog.Error("Failed to save statistics history", "error", err)
+		}
+	}
+
+	// Save quota usage before the collector stops
+	if m.quota != nil {
+		if err := m.quota.Stop(); err != nil {
+			slog.Error("Failed to save quota state", "error", err)
+		}
+	}
 
 	// Stop stats collector
 	if m.collector != nil {
@@ -174,95 +328,232 @@ func (m *Manager) Shutdown(ctx context.Context) error {
 		)
 	}
 
-	// Stop unified proxy if enabled
-	if m.unifiedProxy != nil {
-		if err := m.unifiedProxy.Shutdown(ctx); err != nil {
-			slog.Error("Error stopping unified proxy", "error", err)
-		} else {
-			slog.Info("Unified proxy stopped")
-		}
-		return nil
+	m.stopInbounds(ctx)
+
+	return nil
+}
+
+// stopInbounds stops every inbound from accepting connections, once
+func (m *Manager) stopInbounds(ctx context.Context) {
+	m.stopMu.Lock()
+	defer m.stopMu.Unlock()
+	if m.stopped {
+		return
 	}
+	m.stopped = true
+
+	// In parallel, as HTTP inbounds wait for requests in progress
+	var wg sync.WaitGroup
+	for _, inbound := range m.inbounds {
+		wg.Add(1)
+		go func(inbound proxy.Inbound) {
+			defer wg.Done()
+			// Listeners may already be closed by the canceled context
+			if err := inbound.Shutdown(ctx); err != nil && !errors.Is(err, net.ErrClosed) {
+				slog.Error("Error stopping inbound", "tag", inbound.Tag(), "error", err)
+			} else {
+				slog.Info("Inbound stopped", "tag", inbound.Tag())
+			}
+		}(inbound)
+	}
+	wg.Wait()
+}
 
-	// Stop HTTP proxy
-	if m.httpServer != nil {
-		if err := m.httpServer.Stop(ctx); err != nil {
-			slog.Error("Error stopping HTTP server", "error", err)
-		} else {
-			slog.Info("HTTP server stopped")
+// Drain stops accepting connections on every inbound and waits until the
+// open ones are closed or ctx is done. It returns the number still open.
+func (m *Manager) Drain(ctx context.Context) int64 {
+	slog.Info("Draining connections", "active", m.conns.Active())
+	m.stopInbounds(ctx)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		n := m.conns.Active()
+		if n == 0 {
+			slog.Info("All connections drained")
+			return 0
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			slog.Warn("Drain deadline reached", "remaining", n)
+			return n
 		}
 	}
+}
 
-	// Stop SOCKS5 proxy
-	if m.socks5Server != nil {
-		if err := m.socks5Server.Stop(); err != nil {
-			slog.Error("Error stopping SOCKS5 server", "error", err)
-		} else {
-			slog.Info("SOCKS5 server stopped")
-		}
+// Draining reports whether the inbounds stopped accepting connections
+func (m *Manager) Draining() bool {
+	m.stopMu.Lock()
+	defer m.stopMu.Unlock()
+	return m.stopped
+}
+
+// ActiveConnections returns the number of open client connections
+func (m *Manager) ActiveConnections() int64 {
+	return m.conns.Active()
+}
+
+// Stop asks the process to shut down gracefully, as on SIGTERM
+func (m *Manager) Stop() {
+	m.requestExit(false)
+}
+
+// Restart asks the process to shut down gracefully and start again in place
+func (m *Manager) Restart() {
+	m.requestExit(true)
+}
+
+// requestExit queues a stop or restart request; the first one wins
+func (m *Manager) requestExit(restart bool) {
+	select {
+	case m.exit <- restart:
+	default:
 	}
+}
+
+// ExitRequests delivers Stop (false) and Restart (true) requests to the
+// process lifecycle
+func (m *Manager) ExitRequests() <-chan bool {
+	return m.exit
+}
 
+// CanRestart returns an error if the process cannot restart in place, which
+// is the case when it listens on sockets inherited from its parent
+func (m *Manager) CanRestart() error {
+	cfg := m.GetConfig()
+	addrs := []string{cfg.API.Listen}
+	for _, in := range cfg.AllInbounds() {
+		addrs = append(addrs, in.Listen)
+	}
+	for _, addr := range addrs {
+		if listener.Network(addr) == "fd" {
+			return fmt.Errorf("listening on inherited socket %s, restart the service instead", addr)
+		}
+	}
 	return nil
 }
 
-// GetConfig returns the current configuration
+// GetConfig returns the current configuration. It is replaced on reload
+// and must not be modified.
 func (m *Manager) GetConfig() *config.Config {
+	return m.config.Load()
+}
+
+// GetSSClient returns the current shadowsocks client of the selected server (thread-safe)
+func (m *Manager) GetSSClient() *shadowsocks.Client {
 	m.ssClientMu.RLock()
 	defer m.ssClientMu.RUnlock()
-	return m.config
+	return m.clients[m.selected]
 }
 
-// GetSSClient returns the shadowsocks client (thread-safe)
-func (m *Manager) GetSSClient() *shadowsocks.Client {
+// PACScript renders the PAC file for a client that reached us via host.
+// Returns nil when PAC serving is disabled.
+func (m *Manager) PACScript(host string) []byte {
 	m.ssClientMu.RLock()
 	defer m.ssClientMu.RUnlock()
-	return m.ssClient
+	if m.pacFile == nil {
+		return nil
+	}
+	return m.pacFile.Render(host)
 }
 
-// GetCollector returns the stats collector
-func (m *Manager) GetCollector() *stats.Collector {
-	return m.collector
+// RateLimits returns the bandwidth limits shared with the inbounds
+func (m *Manager) RateLimits() *ratelimit.Set {
+	return m.rates
 }
 
-// ReloadConfig hot-reloads the shadowsocks configuration
-func (m *Manager) ReloadConfig(newConfig config.ShadowsocksConfig) error {
-	slog.Info("Reloading shadowsocks configuration", "server", newConfig.Server)
+// UpdateRateLimits changes bandwidth limits at runtime without changing the
+// configuration, so the next applied configuration change restores the
+// configured limits. A nil global limit keeps the current one; inbounds and
+// users are only changed if listed, and must exist in the configuration.
+func (m *Manager) UpdateRateLimits(global *ratelimit.Limit, inbounds, users map[string]ratelimit.Limit) error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	cfg := m.GetConfig()
+	tags := make(map[string]bool)
+	known := make(map[string]bool)
+	for _, in := range cfg.AllInbounds() {
+		tags[in.Tag] = true
+		if in.Auth != nil {
+			known[in.Auth.Username] = true
+		}
+	}
+	for name := range cfg.Limits.Users {
+		known[name] = true
+	}
+	for tag := range inbounds {
+		if !tags[tag] {
+			return fmt.Errorf("unknown inbound %q", tag)
+		}
+	}
+	for name := range users {
+		if !known[name] {
+			return fmt.Errorf("unknown user %q, no inbound authenticates with it", name)
+		}
+	}
 
-	// Create new shadowsocks client
-	newClient, err := shadowsocks.NewClient(newConfig)
-	if err != nil {
-		return fmt.Errorf("failed to create new SS client: %w", err)
+	update := ratelimit.Limits{Global: m.rates.Limits().Global, Inbounds: inbounds, Users: users}
+	if global != nil {
+		update.Global = *global
 	}
+	m.rates.Update(update)
+	m.ratesSet.Store(true)
+	return nil
+}
 
-	// Acquire write lock
-	m.ssClientMu.Lock()
-	defer m.ssClientMu.Unlock()
+// RateLimitsChanged reports whether the bandwidth limits were changed at
+// runtime and may differ from the configuration
+func (m *Manager) RateLimitsChanged() bool {
+	return m.ratesSet.Load()
+}
 
-	// Save old client for graceful shutdown
-	if m.ssClient != nil {
-		m.oldClients = append(m.oldClients, m.ssClient)
-	}
+// Quotas returns the traffic quota enforcer, nil when no quotas are configured
+func (m *Manager) Quotas() *quota.Enforcer {
+	return m.quota
+}
 
-	// Swap to new client
-	oldClient := m.ssClient
-	m.ssClient = newClient
+// History returns the traffic history, nil when stats are disabled
+func (m *Manager) History() *stats.History {
+	m.ssClientMu.RLock()
+	defer m.ssClientMu.RUnlock()
+	return m.history
+}
 
-	// Update configuration
-	m.config.Shadowsocks = newConfig
+// Events returns the real-time event bus
+func (m *Manager) Events() *events.Bus {
+	return m.events
+}
 
-	// Note: Proxy servers will use the new client for new connections
-	// Existing connections will continue using the old client until they close
+// GetCollector returns the stats collector
+func (m *Manager) GetCollector() *stats.Collector {
+	return m.collector
+}
 
-	slog.Info("Configuration reloaded successfully",
-		"old_server", func() string {
-			if oldClient != nil {
-				return "previous"
-			}
-			return "none"
-		}(),
-		"new_server", newConfig.Server,
-	)
+// SelectServer makes the named server the one new connections of inbounds
+// without a server setting use. The configuration is not changed, so the
+// selection is not saved and is reset by a restart.
+func (m *Manager) SelectServer(name string) error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
 
+	if _, ok := m.GetConfig().Server(name); !ok {
+		return fmt.Errorf("unknown server %q", name)
+	}
+
+	m.ssClientMu.Lock()
+	m.selected = serverName(name)
+	m.ssClientMu.Unlock()
+
+	slog.Info("Server selected", "server", serverName(name))
 	return nil
 }
 
+// SelectedServer returns the server new connections of inbounds without a
+// server setting use
+func (m *Manager) SelectedServer() string {
+	m.ssClientMu.RLock()
+	defer m.ssClientMu.RUnlock()
+	return m.selected
+}
@@ -0,0 +1,498 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+
+	"github.com/xrdavies/light-ss/internal/config"
+	"github.com/xrdavies/light-ss/internal/events"
+	"github.com/xrdavies/light-ss/internal/listener"
+	"github.com/xrdavies/light-ss/internal/logging"
+	"github.com/xrdavies/light-ss/internal/pac"
+	"github.com/xrdavies/light-ss/internal/proxy"
+	"github.com/xrdavies/light-ss/internal/ratelimit"
+	"github.com/xrdavies/light-ss/internal/shadowsocks"
+	"github.com/xrdavies/light-ss/internal/stats"
+)
+
+// Reload statuses of a changed configuration section
+const (
+	SectionApplied         = "applied"          // In effect
+	SectionRestartRequired = "restart_required" // Stored, takes effect after a restart
+	SectionFailed          = "failed"           // Made the reload fail
+	SectionRolledBack      = "rolled_back"      // Not applied because another section failed
+)
+
+// Sources of configuration changes
+const (
+	SourceStartup  = "startup"  // Configuration loaded at startup
+	SourceFile     = "file"     // Config file reloaded on SIGHUP or change
+	SourceAPI      = "api"      // Management API
+	SourceRollback = "rollback" // Previous revision restored through the management API
+)
+
+// ErrInvalidConfig is returned for configurations that fail validation
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// ErrNotAllowed is returned for changes rejected by a ConfigCheck
+var ErrNotAllowed = errors.New("configuration change not allowed")
+
+// ConfigCheck approves a change from the current configuration old to the
+// validated next one before it is applied
+type ConfigCheck func(old, next *config.Config) error
+
+// SectionResult reports how a changed configuration section was reloaded
+type SectionResult struct {
+	Section string   `json:"section"`
+	Status  string   `json:"status"`
+	Changes []string `json:"changes"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// sectionError attributes a reload failure to a configuration section
+type sectionError struct {
+	section string
+	err     error
+}
+
+func (e *sectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sectionError) Unwrap() error {
+	return e.err
+}
+
+// ReloadConfig hot-reloads the default shadowsocks server configuration on
+// behalf of the API. A zero timeout keeps the current one.
+func (m *Manager) ReloadConfig(newConfig config.ShadowsocksConfig) ([]SectionResult, error) {
+	return m.UpdateConfig(func(next *config.Config) error {
+		if newConfig.Timeout == 0 {
+			newConfig.Timeout = next.Shadowsocks.Timeout
+		}
+		next.Shadowsocks = newConfig
+		return nil
+	}, SourceAPI)
+}
+
+// UpdateConfig hot-reloads a copy of the current configuration changed by
+// update, like ApplyConfig. The copy is taken with the reload lock held, so
+// concurrent changes are not lost. Errors from update are returned as is.
+func (m *Manager) UpdateConfig(update func(next *config.Config) error, source string, checks ...ConfigCheck) ([]SectionResult, error) {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	next, err := m.GetConfig().Clone()
+	if err != nil {
+		return nil, err
+	}
+	if err := update(next); err != nil {
+		return nil, err
+	}
+	return m.apply(next, source, checks)
+}
+
+// SetConfigFile sets the file the configuration was loaded from, which
+// api.write_back updates after changes from the API
+func (m *Manager) SetConfigFile(path string) {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	m.configFile = path
+}
+
+// ApplyConfig hot-reloads the whole configuration. The changed sections are
+// applied together: if one fails, the others are rolled back and the current
+// configuration stays in effect. Settings that cannot change at runtime are
+// stored and reported as restart_required. next must not be modified afterwards.
+// If one of checks fails, nothing is applied and ErrNotAllowed is returned.
+func (m *Manager) ApplyConfig(next *config.Config, source string, checks ...ConfigCheck) ([]SectionResult, error) {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	return m.apply(next, source, checks)
+}
+
+// apply is ApplyConfig with reloadMu held
+func (m *Manager) apply(next *config.Config, source string, checks []ConfigCheck) ([]SectionResult, error) {
+	if err := next.Validate(); err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		m.events.Publish(events.TypeReload, events.Reload{Server: next.Shadowsocks.Server, Error: err.Error()})
+		return nil, err
+	}
+
+	old := m.GetConfig()
+	for _, check := range checks {
+		if err := check(old, next); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNotAllowed, err)
+		}
+	}
+	changes := config.Diff(old, next)
+	if len(changes) == 0 {
+		slog.Info("Configuration unchanged")
+		m.events.Publish(events.TypeReload, events.Reload{Server: next.Shadowsocks.Server, Success: true})
+		return []SectionResult{}, nil
+	}
+
+	slog.Info("Reloading configuration", "changes", len(changes))
+	for _, change := range changes {
+		slog.Info("Configuration change", "change", change.String())
+	}
+
+	results := sectionResults(changes)
+	restart, err := m.applyConfig(old, next)
+	if err != nil {
+		failed := ""
+		var serr *sectionError
+		if errors.As(err, &serr) {
+			failed = serr.section
+		}
+		for i := range results {
+			if results[i].Section == failed {
+				results[i].Status = SectionFailed
+				results[i].Error = err.Error()
+			} else {
+				results[i].Status = SectionRolledBack
+			}
+		}
+		err = fmt.Errorf("reload failed, configuration rolled back: %w", err)
+		slog.Error("Configuration reload failed", "section", failed, "error", err)
+		m.events.Publish(events.TypeReload, events.Reload{Server: next.Shadowsocks.Server, Error: err.Error()})
+		return results, err
+	}
+
+	for i := range results {
+		results[i].Status = SectionApplied
+		if restart[results[i].Section] {
+			results[i].Status = SectionRestartRequired
+			slog.Warn("Configuration change takes effect after a restart", "section", results[i].Section)
+		}
+	}
+	slog.Info("Configuration reloaded successfully", "server", next.Shadowsocks.Server, "source", source)
+	m.events.Publish(events.TypeReload, events.Reload{Server: next.Shadowsocks.Server, Success: true})
+	m.addRevision(next, source, changes)
+
+	if source != SourceFile && next.API.WriteBack {
+		m.writeBack(old, next)
+	}
+
+	return results, nil
+}
+
+// writeBack saves the changes from old to next to the config file
+func (m *Manager) writeBack(old, next *config.Config) {
+	if m.configFile == "" {
+		slog.Warn("Configuration not saved, no config file was loaded")
+		return
+	}
+	if err := config.WriteBack(m.configFile, old, next, next.API.Backups); err != nil {
+		slog.Error("Failed to save configuration", "file", m.configFile, "error", err)
+		return
+	}
+	slog.Info("Configuration saved", "file", m.configFile)
+}
+
+// sectionResults groups changes by top-level section, in configuration order
+func sectionResults(changes []config.Change) []SectionResult {
+	var results []SectionResult
+	index := make(map[string]int)
+	for _, change := range changes {
+		i, ok := index[change.Section()]
+		if !ok {
+			i = len(results)
+			index[change.Section()] = i
+			results = append(results, SectionResult{Section: change.Section()})
+		}
+		results[i].Changes = append(results[i].Changes, change.String())
+	}
+	return results
+}
+
+// applyConfig switches from old to next. Everything that can fail is created
+// first, then listeners are swapped with a rollback on failure, and finally
+// the settings that cannot fail are applied. It returns the sections that
+// need a restart.
+func (m *Manager) applyConfig(old, next *config.Config) (map[string]bool, error) {
+	clients, err := m.reloadClients(old, next)
+	if err != nil {
+		return nil, err
+	}
+
+	var history *stats.History
+	if old.Stats.Enabled && next.Stats.Enabled && old.Stats.HistoryFile != next.Stats.HistoryFile {
+		history, err = stats.NewHistory(m.collector, next.Stats.HistoryFile)
+		if err != nil {
+			return nil, &sectionError{"stats", err}
+		}
+	}
+
+	limiter := m.limiter
+	if connectionLimits(old.Limits) != connectionLimits(next.Limits) {
+		limiter = listener.NewLimiter(connectionLimits(next.Limits))
+	}
+
+	// New inbounds may use new servers, so swap clients first
+	m.ssClientMu.Lock()
+	oldClients := m.clients
+	m.clients = clients
+	m.ssClientMu.Unlock()
+
+	if err := m.reloadInbounds(old, next, limiter); err != nil {
+		m.ssClientMu.Lock()
+		m.clients = oldClients
+		m.ssClientMu.Unlock()
+		if history != nil {
+			if err := history.Stop(); err != nil {
+				slog.Error("Failed to save statistics history", "error", err)
+			}
+		}
+		return nil, err
+	}
+
+	// Nothing below fails
+	restart := make(map[string]bool)
+	m.limiter = limiter
+	m.rates.Update(reloadedRates(old, next))
+	m.ratesSet.Store(false)
+
+	if m.quota != nil {
+		m.quota.Update(next.Quotas)
+	}
+	if old.Quotas.StateFile != next.Quotas.StateFile || (m.quota == nil && next.Quotas.Enabled()) {
+		restart["quotas"] = true
+	}
+
+	if old.Stats.Enabled != next.Stats.Enabled {
+		restart["stats"] = true
+	} else if m.reporter != nil && (old.Stats.Interval != next.Stats.Interval || old.Name != next.Name) {
+		m.reporter.Stop()
+		m.reporter = stats.NewReporter(m.collector, next.Stats.Interval, next.Name)
+		m.reporter.Start()
+	}
+
+	if old.Logging != next.Logging {
+		logging.Setup(next.Logging, m.events)
+	}
+
+	// The API server is started by the process, but reads its token from the configuration
+	if old.API.Enabled != next.API.Enabled || old.API.Listen != next.API.Listen || !reflect.DeepEqual(old.API.TLS, next.API.TLS) {
+		restart["api"] = true
+	}
+
+	m.ssClientMu.Lock()
+	oldHistory := m.history
+	if history != nil {
+		m.history = history
+	}
+	m.pacFile = nil
+	if next.PAC.Enabled {
+		m.pacFile = pac.New(next)
+	}
+	m.config.Store(next)
+	if _, ok := next.Server(m.selected); !ok {
+		slog.Warn("Selected server removed, using the default server", "server", m.selected)
+		m.selected = config.DefaultServerName
+	}
+	m.ssClientMu.Unlock()
+
+	if history != nil {
+		if err := oldHistory.Stop(); err != nil {
+			slog.Error("Failed to save statistics history", "error", err)
+		}
+		history.Start()
+	}
+
+	return restart, nil
+}
+
+// reloadClients returns the clients of the servers in next, reusing the ones
+// whose settings did not change. Replaced clients hold no resources, open
+// connections keep working without them.
+func (m *Manager) reloadClients(old, next *config.Config) (map[string]*shadowsocks.Client, error) {
+	m.ssClientMu.RLock()
+	current := m.clients
+	m.ssClientMu.RUnlock()
+
+	names := []string{config.DefaultServerName}
+	for _, srv := range next.Servers {
+		names = append(names, srv.Name)
+	}
+
+	clients := make(map[string]*shadowsocks.Client)
+	for _, name := range names {
+		srv, _ := next.Server(name)
+		if prev, ok := old.Server(name); ok && reflect.DeepEqual(prev, srv) && current[name] != nil {
+			clients[name] = current[name]
+			continue
+		}
+
+		client, err := shadowsocks.NewClient(srv)
+		if err != nil {
+			section := "servers"
+			if name == config.DefaultServerName {
+				section = "shadowsocks"
+			}
+			return nil, &sectionError{section, fmt.Errorf("failed to create shadowsocks client for server %s: %w", name, err)}
+		}
+		clients[name] = client
+	}
+	return clients, nil
+}
+
+// inboundSettings is everything an inbound is built from; an inbound is
+// recreated when its settings change
+type inboundSettings struct {
+	Inbound  config.InboundConfig
+	Sniffing config.SniffingConfig // Zero when sniffing is off for the inbound
+	Limits   listener.Limits
+}
+
+// settingsOf returns the settings of an inbound of cfg
+func settingsOf(cfg *config.Config, in config.InboundConfig) inboundSettings {
+	settings := inboundSettings{Inbound: in, Limits: connectionLimits(cfg.Limits)}
+	if in.SniffingEnabled(cfg.Sniffing) {
+		settings.Sniffing = cfg.Sniffing
+	}
+	return settings
+}
+
+// reloadInbounds replaces the inbounds whose settings differ between old and
+// next, starts added ones and stops removed ones. If an inbound fails to
+// start, the previous inbounds are restored.
+func (m *Manager) reloadInbounds(old, next *config.Config, limiter *listener.Limiter) error {
+	m.stopMu.Lock()
+	defer m.stopMu.Unlock()
+
+	previous := make(map[string]config.InboundConfig)
+	for _, in := range old.AllInbounds() {
+		previous[in.Tag] = in
+	}
+	running := make(map[string]proxy.Inbound)
+	for _, inbound := range m.inbounds {
+		running[inbound.Tag()] = inbound
+	}
+
+	// Create the new inbounds before touching the running ones
+	var list, added []proxy.Inbound
+	kept := make(map[string]bool)
+	for _, in := range next.AllInbounds() {
+		if prev, ok := previous[in.Tag]; ok && running[in.Tag] != nil &&
+			reflect.DeepEqual(settingsOf(old, prev), settingsOf(next, in)) {
+			list = append(list, running[in.Tag])
+			kept[in.Tag] = true
+			continue
+		}
+
+		inbound, err := m.newInbound(in, next.Sniffing, limiter)
+		if err != nil {
+			return &sectionError{"inbounds", err}
+		}
+		list = append(list, inbound)
+		added = append(added, inbound)
+	}
+	if len(added) == 0 && len(kept) == len(m.inbounds) {
+		return nil
+	}
+	if m.stopped {
+		return &sectionError{"inbounds", errors.New("inbounds are stopped (draining or shutting down)")}
+	}
+
+	var removed []proxy.Inbound
+	for _, inbound := range m.inbounds {
+		if !kept[inbound.Tag()] {
+			removed = append(removed, inbound)
+		}
+	}
+
+	// Stop first, as changed inbounds may keep their address
+	for _, inbound := range removed {
+		stopInbound(inbound)
+	}
+
+	for i, inbound := range added {
+		if err := inbound.Start(m.ctx); err != nil {
+			for _, started := range added[:i] {
+				stopInbound(started)
+			}
+			m.restoreInbounds(old, removed)
+			return &sectionError{"inbounds", fmt.Errorf("failed to start inbound %s: %w", inbound.Tag(), err)}
+		}
+	}
+
+	for _, inbound := range removed {
+		slog.Info("Inbound stopped", "tag", inbound.Tag())
+	}
+	for _, inbound := range added {
+		slog.Info("Inbound enabled", "tag", inbound.Tag())
+	}
+	m.inbounds = list
+
+	return nil
+}
+
+// restoreInbounds restarts the stopped inbounds of the old configuration,
+// which are recreated as stopped servers cannot start again
+func (m *Manager) restoreInbounds(old *config.Config, stopped []proxy.Inbound) {
+	previous := make(map[string]config.InboundConfig)
+	for _, in := range old.AllInbounds() {
+		previous[in.Tag] = in
+	}
+
+	for _, inbound := range stopped {
+		restored, err := m.newInbound(previous[inbound.Tag()], old.Sniffing, m.limiter)
+		if err == nil {
+			err = restored.Start(m.ctx)
+		}
+		if err != nil {
+			slog.Error("Failed to restore inbound", "tag", inbound.Tag(), "error", err)
+			continue
+		}
+		for i := range m.inbounds {
+			if m.inbounds[i] == inbound {
+				m.inbounds[i] = restored
+			}
+		}
+	}
+}
+
+// newInbound creates the front-end of an inbound listener
+func (m *Manager) newInbound(in config.InboundConfig, sniffing config.SniffingConfig, limiter *listener.Limiter) (proxy.Inbound, error) {
+	opts, err := m.inboundOptions(in, sniffing, limiter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inbound %s: %w", in.Tag, err)
+	}
+	inbound, err := proxy.New(in.Type, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inbound %s: %w", in.Tag, err)
+	}
+	return inbound, nil
+}
+
+// stopInbound closes the listener of an inbound without waiting for its
+// connections, which finish on their own
+func stopInbound(inbound proxy.Inbound) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := inbound.Shutdown(ctx); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, net.ErrClosed) {
+		slog.Error("Error stopping inbound", "tag", inbound.Tag(), "error", err)
+	}
+}
+
+// reloadedRates returns the bandwidth limits of next, clearing the limits of
+// inbounds and users that next no longer lists
+func reloadedRates(old, next *config.Config) ratelimit.Limits {
+	limits := rateLimits(next)
+	for tag := range rateLimits(old).Inbounds {
+		if _, ok := limits.Inbounds[tag]; !ok {
+			limits.Inbounds[tag] = ratelimit.Limit{}
+		}
+	}
+	for name := range old.Limits.Users {
+		if _, ok := limits.Users[name]; !ok {
+			limits.Users[name] = ratelimit.Limit{}
+		}
+	}
+	return limits
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/config"
+)
+
+// ErrRevisionNotFound is returned for configuration revisions that are not kept
+var ErrRevisionNotFound = errors.New("configuration revision not found")
+
+// Revision is an applied configuration kept for rollback
+type Revision struct {
+	Rev     int       `json:"rev"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`            // startup, file, api or rollback
+	Server  string    `json:"server"`            // Default server address
+	Changes []string  `json:"changes,omitempty"` // Changes from the previous revision, passwords masked
+	Current bool      `json:"current"`           // Configuration in effect
+
+	config *config.Config
+}
+
+// addRevision records an applied configuration, dropping the oldest
+// revisions beyond api.revisions
+func (m *Manager) addRevision(cfg *config.Config, source string, changes []config.Change) {
+	clone, err := cfg.Clone()
+	if err != nil {
+		slog.Error("Failed to record configuration revision", "error", err)
+		return
+	}
+
+	m.revisionsMu.Lock()
+	defer m.revisionsMu.Unlock()
+
+	m.lastRev++
+	rev := Revision{
+		Rev:    m.lastRev,
+		Time:   time.Now(),
+		Source: source,
+		Server: cfg.Shadowsocks.Server,
+		config: clone,
+	}
+	for _, change := range changes {
+		rev.Changes = append(rev.Changes, change.String())
+	}
+	m.revisions = append(m.revisions, rev)
+
+	limit := cfg.API.Revisions
+	if limit <= 0 {
+		limit = config.DefaultRevisions
+	}
+	if len(m.revisions) > limit {
+		m.revisions = append([]Revision(nil), m.revisions[len(m.revisions)-limit:]...)
+	}
+}
+
+// Revisions returns the kept configuration revisions, newest first
+func (m *Manager) Revisions() []Revision {
+	m.revisionsMu.RLock()
+	defer m.revisionsMu.RUnlock()
+
+	revisions := make([]Revision, 0, len(m.revisions))
+	for i := len(m.revisions) - 1; i >= 0; i-- {
+		rev := m.revisions[i]
+		rev.Current = rev.Rev == m.lastRev
+		revisions = append(revisions, rev)
+	}
+	return revisions
+}
+
+// revision returns a copy of the configuration of a kept revision
+func (m *Manager) revision(rev int) (*config.Config, error) {
+	m.revisionsMu.RLock()
+	defer m.revisionsMu.RUnlock()
+
+	for _, r := range m.revisions {
+		if r.Rev == rev {
+			return r.config.Clone()
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrRevisionNotFound, rev)
+}
+
+// Rollback hot-reloads the configuration of a previous revision, which is
+// recorded as a new revision. checks are applied like with ApplyConfig.
+func (m *Manager) Rollback(rev int, checks ...ConfigCheck) ([]SectionResult, error) {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	next, err := m.revision(rev)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Rolling back configuration", "rev", rev)
+	return m.apply(next, SourceRollback, checks)
+}
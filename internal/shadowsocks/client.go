@@ -2,6 +2,7 @@ package shadowsocks
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -13,6 +14,10 @@ import (
 	"github.com/xrdavies/light-ss/internal/plugin"
 )
 
+// ErrPluginHandshake marks dial errors caused by the plugin, i.e. while
+// wrapping the connection or sending the first (obfuscated) request
+var ErrPluginHandshake = errors.New("plugin handshake failed")
+
 // Client wraps a shadowsocks connection and provides dialing capabilities
 type Client struct {
 	serverAddr string
@@ -82,14 +87,15 @@ func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Con
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to shadowsocks server: %w", err)
 	}
+	raw := rc
 
 	// Apply plugin if configured (wrap before cipher)
 	if c.plugin != nil {
 		slog.Debug("Applying plugin", "plugin", c.plugin.Name())
 		rc, err = c.plugin.WrapConn(rc)
 		if err != nil {
-			rc.Close()
-			return nil, fmt.Errorf("failed to apply plugin: %w", err)
+			raw.Close()
+			return nil, fmt.Errorf("%w: %w", ErrPluginHandshake, err)
 		}
 	}
 
@@ -99,11 +105,30 @@ func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Con
 	// Send target address through shadowsocks protocol
 	if _, err := rc.Write(tgt); err != nil {
 		rc.Close()
+		if c.plugin != nil {
+			err = fmt.Errorf("%w: %w", ErrPluginHandshake, err)
+		}
 		return nil, fmt.Errorf("failed to send target address: %w", err)
 	}
 
 	slog.Debug("Connected to target through shadowsocks",
 		"target", addr)
 
-	return rc, nil
+	return &conn{Conn: rc, raw: raw}, nil
+}
+
+// conn is an encrypted connection to a target through the shadowsocks server
+type conn struct {
+	net.Conn          // Cipher (and plugin) stream
+	raw      net.Conn // TCP connection to the server
+}
+
+// CloseWrite half-closes the connection to the server, which forwards the
+// EOF to the target. Neither the cipher nor the plugins buffer writes, so
+// everything written before has already been sent.
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.raw.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("server connection does not support half-close")
 }
@@ -0,0 +1,197 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// Domain extracts the destination domain from the first bytes a client sends,
+// either the SNI of a TLS ClientHello or the Host header of an HTTP request.
+// Returns an empty string if the payload is neither or carries no domain.
+func Domain(payload []byte) string {
+	if name := TLSServerName(payload); name != "" {
+		return name
+	}
+	return HTTPHost(payload)
+}
+
+// TLSServerName returns the server_name extension of a TLS ClientHello
+func TLSServerName(b []byte) string {
+	// Record header: type(1) version(2) length(2)
+	if len(b) < 5 || b[0] != 0x16 || b[1] != 0x03 {
+		return ""
+	}
+	recordLen := int(binary.BigEndian.Uint16(b[3:]))
+	b = b[5:]
+	// A ClientHello fragmented over several records is only parsed as far as
+	// the first record goes; the next record header is not extension data
+	if recordLen < len(b) {
+		b = b[:recordLen]
+	}
+
+	// Handshake header: type(1) length(3), type 1 is ClientHello
+	if len(b) < 4 || b[0] != 0x01 {
+		return ""
+	}
+	b = b[4:]
+
+	// client_version(2) random(32)
+	if len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+
+	// session_id, cipher_suites and compression_methods
+	var ok bool
+	if b, ok = skipVector(b, 1); !ok {
+		return ""
+	}
+	if b, ok = skipVector(b, 2); !ok {
+		return ""
+	}
+	if b, ok = skipVector(b, 1); !ok {
+		return ""
+	}
+
+	// extensions
+	if len(b) < 2 {
+		return ""
+	}
+	extLen := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if extLen < len(b) {
+		b = b[:extLen]
+	}
+
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b)
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if length > len(b) {
+			return ""
+		}
+		if extType == 0x0000 {
+			return parseServerNameList(b[:length])
+		}
+		b = b[length:]
+	}
+
+	return ""
+}
+
+// parseServerNameList returns the first host_name entry of a server_name extension
+func parseServerNameList(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+
+	for len(b) >= 3 {
+		nameType := b[0]
+		length := int(binary.BigEndian.Uint16(b[1:]))
+		b = b[3:]
+		if length > len(b) {
+			return ""
+		}
+		if nameType == 0 {
+			name := strings.TrimSuffix(string(b[:length]), ".")
+			if isDomain(name) {
+				return strings.ToLower(name)
+			}
+			return ""
+		}
+		b = b[length:]
+	}
+
+	return ""
+}
+
+// skipVector skips a length-prefixed vector with a lenBytes-byte length
+func skipVector(b []byte, lenBytes int) ([]byte, bool) {
+	if len(b) < lenBytes {
+		return nil, false
+	}
+	var length int
+	if lenBytes == 1 {
+		length = int(b[0])
+	} else {
+		length = int(binary.BigEndian.Uint16(b))
+	}
+	b = b[lenBytes:]
+	if length > len(b) {
+		return nil, false
+	}
+	return b[length:], true
+}
+
+// httpMethods are the request methods recognised when sniffing plain HTTP
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT "}
+
+// HTTPHost returns the host (without port) of a plain HTTP/1.x request
+func HTTPHost(b []byte) string {
+	isHTTP := false
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, []byte(m)) {
+			isHTTP = true
+			break
+		}
+	}
+	if !isHTTP {
+		return ""
+	}
+
+	// Skip the request line, then scan header lines
+	lines := bytes.Split(b, []byte("\r\n"))
+	for _, line := range lines[1:] {
+		if len(line) == 0 {
+			break // End of headers
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon == -1 || !strings.EqualFold(string(line[:colon]), "host") {
+			continue
+		}
+
+		host := strings.TrimSpace(string(line[colon+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if isDomain(host) {
+			return strings.ToLower(host)
+		}
+		return ""
+	}
+
+	return ""
+}
+
+// isDomain reports whether s looks like a domain name rather than an IP literal
+func isDomain(s string) bool {
+	if s == "" || len(s) > 253 || net.ParseIP(s) != nil {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '.' || r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// MatchDomain reports whether domain equals one of suffixes or is a subdomain of one
+func MatchDomain(domain string, suffixes []string) bool {
+	for _, s := range suffixes {
+		s = strings.ToLower(strings.TrimPrefix(s, "."))
+		if s == "" {
+			continue
+		}
+		if domain == s || strings.HasSuffix(domain, "."+s) {
+			return true
+		}
+	}
+	return false
+}
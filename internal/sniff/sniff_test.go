@@ -0,0 +1,117 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first TLS record a client sends for serverName
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer client.Close()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// fragment splits the handshake message of a single-record ClientHello into
+// two records, the first carrying n bytes of it
+func fragment(record []byte, n int) []byte {
+	msg := record[5:]
+	first := append([]byte{0x16, 0x03, 0x01}, binary.BigEndian.AppendUint16(nil, uint16(n))...)
+	first = append(first, msg[:n]...)
+	second := append([]byte{0x16, 0x03, 0x01}, binary.BigEndian.AppendUint16(nil, uint16(len(msg)-n))...)
+	return append(first, append(second, msg[n:]...)...)
+}
+
+func TestTLSServerName(t *testing.T) {
+	hello := clientHello(t, "Example.COM")
+	sni := bytes.Index(hello, []byte("Example.COM"))
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    string
+	}{
+		{"client hello", hello, "example.com"},
+		{"no sni for ip", clientHello(t, "192.0.2.1"), ""},
+		{"record header only", hello[:5], ""},
+		{"truncated in random", hello[:20], ""},
+		{"truncated in sni", hello[:sni+4], ""},
+		{"truncated after sni", hello[:sni+len("Example.COM")], "example.com"},
+		{"fragmented after sni", fragment(hello, sni-5+len("Example.COM")), "example.com"},
+		{"fragmented in sni", fragment(hello, sni-5+4), ""},
+		{"fragmented before sni", fragment(hello, 60), ""},
+		{"handshake not client hello", append([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x02}, 0, 0, 0), ""},
+		{"application data", append([]byte{0x17}, hello[1:]...), ""},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), ""},
+		{"empty", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TLSServerName(tt.payload); got != tt.want {
+				t.Errorf("TLSServerName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{"host", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com"},
+		{"host with port", "GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com"},
+		{"mixed case", "POST /form HTTP/1.1\r\nUser-Agent: x\r\nhOsT:  WWW.Example.com \r\n\r\n", "www.example.com"},
+		{"ipv4 host", "GET / HTTP/1.1\r\nHost: 192.0.2.1:80\r\n\r\n", ""},
+		{"ipv6 host", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", ""},
+		{"no host", "GET / HTTP/1.0\r\nAccept: */*\r\n\r\n", ""},
+		{"host in body", "POST / HTTP/1.1\r\nContent-Length: 17\r\n\r\nHost: example.com", ""},
+		{"truncated headers", "GET / HTTP/1.1\r\nAccept: */*\r\nHost: exam", "exam"},
+		{"invalid host", "GET / HTTP/1.1\r\nHost: exa mple.com\r\n\r\n", ""},
+		{"unknown method", "BREW /pot HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+		{"method without space", "GETX / HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+		{"ssh banner", "SSH-2.0-OpenSSH_9.6\r\n", ""},
+		{"binary", "\x16\x03\x01\x00\x05hello", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTTPHost([]byte(tt.payload)); got != tt.want {
+				t.Errorf("HTTPHost = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDomain(t *testing.T) {
+	if got := Domain(clientHello(t, "tls.example.com")); got != "tls.example.com" {
+		t.Errorf("Domain of a ClientHello = %q, want the SNI", got)
+	}
+	if got := Domain([]byte("GET / HTTP/1.1\r\nHost: http.example.com\r\n\r\n")); got != "http.example.com" {
+		t.Errorf("Domain of an HTTP request = %q, want the Host", got)
+	}
+	if got := Domain([]byte("hello")); got != "" {
+		t.Errorf("Domain of other data = %q, want none", got)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/xrdavies/light-ss/internal/events"
 )
 
 // SpeedSample represents bandwidth measurement at a point in time
@@ -88,10 +90,29 @@ type Collector struct {
 	mu sync.RWMutex
 
 	// Connection counters
-	totalConnections   atomic.Int64
-	activeConnections  atomic.Int64
-	httpConnections    atomic.Int64
-	socks5Connections  atomic.Int64
+	totalConnections    atomic.Int64
+	activeConnections   atomic.Int64
+	httpConnections     atomic.Int64
+	socks5Connections   atomic.Int64
+	rejectedConnections atomic.Int64 // Refused by a listener's allow/deny list or limits
+
+	// Connections closed by light-ss, keyed by reason (guarded by mu)
+	closeReasons map[string]int64
+
+	// Traffic per upstream server and proxy user for quotas (guarded by mu)
+	serverUsage map[string]*Usage
+	userUsage   map[string]*Usage
+
+	// Open connections by ID (guarded by mu)
+	conns      map[uint64]*TrackedConn
+	nextConnID atomic.Uint64
+
+	// Labeled counters for metrics (guarded by mu)
+	connCounts map[ConnLabels]*ConnCount
+	dials      map[string]*DialStats
+
+	// Traffic by dimension and key (guarded by mu)
+	groups map[string]*trafficGroups
 
 	// Bandwidth counters
 	bytesSent     atomic.Int64
@@ -103,18 +124,33 @@ type Collector struct {
 	// Start time
 	startTime time.Time
 
+	// Real-time events, nil when not published
+	events *events.Bus
+
 	// Background ticker for speed sampling
 	ticker *time.Ticker
 	done   chan struct{}
 }
 
-// NewCollector creates a new stats collector
-func NewCollector() *Collector {
+// NewCollector creates a new stats collector that publishes traffic,
+// connection and server health events to bus (may be nil)
+func NewCollector(bus *events.Bus) *Collector {
 	c := &Collector{
 		startTime:    time.Now(),
+		events:       bus,
+		closeReasons: make(map[string]int64),
+		serverUsage:  make(map[string]*Usage),
+		userUsage:    make(map[string]*Usage),
+		conns:        make(map[uint64]*TrackedConn),
+		connCounts:   make(map[ConnLabels]*ConnCount),
+		dials:        make(map[string]*DialStats),
+		groups:       make(map[string]*trafficGroups),
 		speedTracker: NewSpeedTracker(10 * time.Second), // 10-second window
 		done:         make(chan struct{}),
 	}
+	for _, dim := range GroupDimensions {
+		c.groups[dim] = newTrafficGroups()
+	}
 
 	// Start background speed sampling (every second)
 	c.ticker = time.NewTicker(1 * time.Second)
@@ -131,6 +167,9 @@ func (c *Collector) sampleSpeed() {
 			sent := c.bytesSent.Load()
 			received := c.bytesReceived.Load()
 			c.speedTracker.AddSample(sent, received)
+			if c.events.Active() {
+				c.events.Publish(events.TypeTraffic, c.trafficTick())
+			}
 		case <-c.done:
 			return
 		}
@@ -158,6 +197,18 @@ func (c *Collector) RecordConnection(proxyType string) {
 	}
 }
 
+// RecordRejected records a connection refused before it was served
+func (c *Collector) RecordRejected() {
+	c.rejectedConnections.Add(1)
+}
+
+// RecordCloseReason records why light-ss refused or closed a connection
+func (c *Collector) RecordCloseReason(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeReasons[reason]++
+}
+
 // RecordDisconnection records a connection closure
 func (c *Collector) RecordDisconnection() {
 	c.activeConnections.Add(-1)
@@ -177,51 +228,111 @@ func (c *Collector) RecordBytesReceived(n int64) {
 func (c *Collector) GetStats() Stats {
 	uploadSpeed, downloadSpeed := c.speedTracker.GetCurrentSpeed()
 
+	c.mu.RLock()
+	closeReasons := make(map[string]int64, len(c.closeReasons))
+	for reason, n := range c.closeReasons {
+		closeReasons[reason] = n
+	}
+	c.mu.RUnlock()
+
 	return Stats{
-		TotalConnections:   c.totalConnections.Load(),
-		ActiveConnections:  c.activeConnections.Load(),
-		HTTPConnections:    c.httpConnections.Load(),
-		SOCKS5Connections:  c.socks5Connections.Load(),
-		BytesSent:          c.bytesSent.Load(),
-		BytesReceived:      c.bytesReceived.Load(),
-		UploadSpeed:        uploadSpeed,
-		DownloadSpeed:      downloadSpeed,
-		Uptime:             time.Since(c.startTime),
+		TotalConnections:    c.totalConnections.Load(),
+		ActiveConnections:   c.activeConnections.Load(),
+		HTTPConnections:     c.httpConnections.Load(),
+		SOCKS5Connections:   c.socks5Connections.Load(),
+		RejectedConnections: c.rejectedConnections.Load(),
+		BytesSent:           c.bytesSent.Load(),
+		BytesReceived:       c.bytesReceived.Load(),
+		UploadSpeed:         uploadSpeed,
+		DownloadSpeed:       downloadSpeed,
+		CloseReasons:        closeReasons,
+		Uptime:              time.Since(c.startTime),
+	}
+}
+
+// TrafficTick is the data of a traffic event
+type TrafficTick struct {
+	ActiveConnections int64 `json:"active_connections"`
+	BytesSent         int64 `json:"bytes_sent"`
+	BytesReceived     int64 `json:"bytes_received"`
+	UploadSpeed       int64 `json:"upload_speed"`   // bytes/sec
+	DownloadSpeed     int64 `json:"download_speed"` // bytes/sec
+}
+
+// trafficTick returns the current counters and speeds
+func (c *Collector) trafficTick() TrafficTick {
+	uploadSpeed, downloadSpeed := c.speedTracker.GetCurrentSpeed()
+	return TrafficTick{
+		ActiveConnections: c.activeConnections.Load(),
+		BytesSent:         c.bytesSent.Load(),
+		BytesReceived:     c.bytesReceived.Load(),
+		UploadSpeed:       uploadSpeed,
+		DownloadSpeed:     downloadSpeed,
 	}
 }
 
 // Stats holds statistics data
 type Stats struct {
-	TotalConnections   int64
-	ActiveConnections  int64
-	HTTPConnections    int64
-	SOCKS5Connections  int64
-	BytesSent          int64
-	BytesReceived      int64
-	UploadSpeed        int64 // bytes/sec
-	DownloadSpeed      int64 // bytes/sec
-	Uptime             time.Duration
+	TotalConnections    int64
+	ActiveConnections   int64
+	HTTPConnections     int64
+	SOCKS5Connections   int64
+	RejectedConnections int64
+	BytesSent           int64
+	BytesReceived       int64
+	UploadSpeed         int64 // bytes/sec
+	DownloadSpeed       int64 // bytes/sec
+	CloseReasons        map[string]int64
+	Uptime              time.Duration
 }
 
 // TrackedConn wraps a net.Conn to track bandwidth
 type TrackedConn struct {
 	net.Conn
 	collector *Collector
-	proxyType string
-	target    string
+	info      ConnInfo
+	groupKeys map[string]string // Key in every traffic dimension
+	id        uint64
+	start     time.Time
 	closed    bool
 	mu        sync.Mutex
+
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
 }
 
-// NewTrackedConn creates a new tracked connection
-func NewTrackedConn(conn net.Conn, collector *Collector, proxyType, target string) *TrackedConn {
-	collector.RecordConnection(proxyType)
+// NewTrackedConn creates a new tracked connection and adds it to the
+// collector's connection table
+func NewTrackedConn(conn net.Conn, collector *Collector, info ConnInfo) *TrackedConn {
+	collector.RecordConnection(info.ProxyType)
 
-	return &TrackedConn{
+	t := &TrackedConn{
 		Conn:      conn,
 		collector: collector,
-		proxyType: proxyType,
-		target:    target,
+		info:      info,
+		groupKeys: groupKeys(&info),
+		start:     time.Now(),
+	}
+	collector.track(t)
+	if collector.events.Active() {
+		collector.events.Publish(events.TypeConnOpen, t.Connection())
+	}
+	return t
+}
+
+// Connection returns the connection's table entry
+func (t *TrackedConn) Connection() Connection {
+	return Connection{
+		ID:            t.id,
+		ProxyType:     t.info.ProxyType,
+		Inbound:       t.info.Inbound,
+		Client:        t.info.Client,
+		User:          t.info.User,
+		Target:        t.info.Target,
+		Server:        t.info.Server,
+		Start:         t.start,
+		BytesSent:     t.bytesSent.Load(),
+		BytesReceived: t.bytesReceived.Load(),
 	}
 }
 
@@ -229,7 +340,7 @@ func NewTrackedConn(conn net.Conn, collector *Collector, proxyType, target strin
 func (t *TrackedConn) Read(b []byte) (int, error) {
 	n, err := t.Conn.Read(b)
 	if n > 0 {
-		t.collector.RecordBytesReceived(int64(n))
+		t.AddBytes(0, int64(n))
 	}
 	return n, err
 }
@@ -238,7 +349,7 @@ func (t *TrackedConn) Read(b []byte) (int, error) {
 func (t *TrackedConn) Write(b []byte) (int, error) {
 	n, err := t.Conn.Write(b)
 	if n > 0 {
-		t.collector.RecordBytesSent(int64(n))
+		t.AddBytes(int64(n), 0)
 	}
 	return n, err
 }
@@ -250,11 +361,34 @@ func (t *TrackedConn) Close() error {
 
 	if !t.closed {
 		t.closed = true
+		t.collector.untrack(t)
 		t.collector.RecordDisconnection()
+		if t.collector.events.Active() {
+			t.collector.events.Publish(events.TypeConnClose, t.Connection())
+		}
 	}
 
 	return t.Conn.Close()
 }
 
+// AddBytes records bytes moved on the underlying connection directly, for
+// relays that bypass Read/Write and account in batches
+func (t *TrackedConn) AddBytes(sent, received int64) {
+	if sent > 0 {
+		t.bytesSent.Add(sent)
+		t.collector.RecordBytesSent(sent)
+	}
+	if received > 0 {
+		t.bytesReceived.Add(received)
+		t.collector.RecordBytesReceived(received)
+	}
+	t.collector.recordTraffic(t, sent, received)
+}
+
+// NetConn returns the underlying connection
+func (t *TrackedConn) NetConn() net.Conn {
+	return t.Conn
+}
+
 var _ net.Conn = (*TrackedConn)(nil)
 var _ io.ReadWriteCloser = (*TrackedConn)(nil)
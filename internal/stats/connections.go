@@ -0,0 +1,120 @@
+package stats
+
+import (
+	"sort"
+	"time"
+)
+
+// ReasonClosedByAPI is the close reason for connections closed through the management API
+const ReasonClosedByAPI = "closed_by_api"
+
+// ConnInfo describes a proxied connection for accounting
+type ConnInfo struct {
+	ProxyType string // http, socks5 or tunnel
+	Inbound   string // Tag of the accepting listener
+	Client    string // Client address
+	Server    string // Upstream server name
+	User      string // Authenticated username, empty if none
+	Target    string // Requested destination
+
+	// Target is an IP address whose destination domain is sniffed after the
+	// dial and reported with TrackedConn.SetDomain
+	DomainPending bool
+}
+
+// Connection describes an open proxied connection
+type Connection struct {
+	ID            uint64    `json:"id"`
+	ProxyType     string    `json:"type"`
+	Inbound       string    `json:"inbound"`
+	Client        string    `json:"client,omitempty"`
+	User          string    `json:"user,omitempty"`
+	Target        string    `json:"target"`
+	Server        string    `json:"server"`
+	Start         time.Time `json:"start"`
+	BytesSent     int64     `json:"bytes_sent"`     // Upload, client to target
+	BytesReceived int64     `json:"bytes_received"` // Download, target to client
+}
+
+// track adds an open connection to the connection table
+func (c *Collector) track(t *TrackedConn) {
+	t.id = c.nextConnID.Add(1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns[t.id] = t
+
+	n := c.connCount(t.labels())
+	n.Total++
+	n.Active++
+	c.recordGroupConnection(t)
+}
+
+// untrack removes a closed connection from the connection table
+func (c *Collector) untrack(t *TrackedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, t.id)
+	c.connCount(t.labels()).Active--
+}
+
+// labels returns the metric labels of a connection
+func (t *TrackedConn) labels() ConnLabels {
+	return ConnLabels{ProxyType: t.info.ProxyType, Inbound: t.info.Inbound, Server: t.info.Server}
+}
+
+// Connections returns the open connections ordered by ID
+func (c *Collector) Connections() []Connection {
+	c.mu.RLock()
+	list := make([]Connection, 0, len(c.conns))
+	for _, t := range c.conns {
+		list = append(list, t.Connection())
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CloseConnection closes the open connection with the given ID and reports
+// whether it was found
+func (c *Collector) CloseConnection(id uint64) bool {
+	c.mu.RLock()
+	t, ok := c.conns[id]
+	c.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	t.Close()
+	c.RecordCloseReason(ReasonClosedByAPI)
+	return true
+}
+
+// CloseAllConnections closes every open connection and returns how many were closed
+func (c *Collector) CloseAllConnections() int {
+	return c.CloseConnections(func(Connection) bool { return true }, ReasonClosedByAPI)
+}
+
+// CloseConnections closes the open connections for which match returns true,
+// records reason for each of them and returns how many were closed.
+// match is called without holding the collector lock.
+func (c *Collector) CloseConnections(match func(Connection) bool, reason string) int {
+	c.mu.RLock()
+	conns := make([]*TrackedConn, 0, len(c.conns))
+	for _, t := range c.conns {
+		conns = append(conns, t)
+	}
+	c.mu.RUnlock()
+
+	closed := 0
+	for _, t := range conns {
+		if !match(t.Connection()) {
+			continue
+		}
+		t.Close()
+		c.RecordCloseReason(reason)
+		closed++
+	}
+	return closed
+}
@@ -0,0 +1,220 @@
+package stats
+
+import (
+	"container/heap"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dimensions traffic can be grouped by
+const (
+	GroupDomain  = "domain"  // Destination host of the target
+	GroupServer  = "server"  // Upstream server
+	GroupInbound = "inbound" // Accepting listener
+	GroupClient  = "client"  // Client IP address
+)
+
+// GroupDimensions lists the supported dimensions in display order
+var GroupDimensions = []string{GroupDomain, GroupServer, GroupInbound, GroupClient}
+
+// maxGroupEntries bounds the entries kept per dimension. When full, the
+// entry with the least traffic is replaced using the space-saving algorithm:
+// the new key inherits its counts, so a key that becomes a heavy hitter
+// is never dropped before its traffic is counted.
+const maxGroupEntries = 1000
+
+// GroupStats is the traffic of one key of a dimension
+type GroupStats struct {
+	Key           string `json:"key"`
+	Connections   int64  `json:"connections"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+	ErrorBytes    int64  `json:"error_bytes,omitempty"` // Upper bound of the bytes inherited from replaced keys
+}
+
+// total returns the bytes in both directions
+func (g *GroupStats) total() int64 {
+	return g.BytesSent + g.BytesReceived
+}
+
+// groupEntry is a GroupStats with its position in the heap of trafficGroups
+type groupEntry struct {
+	GroupStats
+	index int
+}
+
+// trafficGroups holds the bounded per-key statistics of one dimension, with
+// the entries in a min-heap by traffic so the smallest one is found quickly
+type trafficGroups struct {
+	entries map[string]*groupEntry
+	heap    groupHeap
+}
+
+// newTrafficGroups creates an empty dimension
+func newTrafficGroups() *trafficGroups {
+	return &trafficGroups{entries: make(map[string]*groupEntry)}
+}
+
+// get returns the entry for key. If the dimension is full, the entry with the
+// least traffic is handed over to key, keeping its counts.
+func (g *trafficGroups) get(key string) *groupEntry {
+	if e, ok := g.entries[key]; ok {
+		return e
+	}
+
+	if len(g.entries) >= maxGroupEntries {
+		e := g.heap[0]
+		delete(g.entries, e.Key)
+		e.Key = key
+		e.ErrorBytes = e.total()
+		g.entries[key] = e
+		return e
+	}
+
+	e := &groupEntry{GroupStats: GroupStats{Key: key}}
+	g.entries[key] = e
+	heap.Push(&g.heap, e)
+	return e
+}
+
+// addBytes adds traffic to an entry and restores the heap order
+func (g *trafficGroups) addBytes(e *groupEntry, sent, received int64) {
+	e.BytesSent += sent
+	e.BytesReceived += received
+	heap.Fix(&g.heap, e.index)
+}
+
+// top returns up to n entries with the most traffic (all if n <= 0)
+func (g *trafficGroups) top(n int) []GroupStats {
+	list := make([]GroupStats, 0, len(g.entries))
+	for _, e := range g.entries {
+		list = append(list, e.GroupStats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].total() != list[j].total() {
+			return list[i].total() > list[j].total()
+		}
+		return list[i].Key < list[j].Key
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// groupHeap is a min-heap of entries by traffic, implementing heap.Interface
+type groupHeap []*groupEntry
+
+func (h groupHeap) Len() int           { return len(h) }
+func (h groupHeap) Less(i, j int) bool { return h[i].total() < h[j].total() }
+
+func (h groupHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *groupHeap) Push(x any) {
+	e := x.(*groupEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *groupHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// groupKeys returns the key of a connection in every dimension
+func groupKeys(info *ConnInfo) map[string]string {
+	return map[string]string{
+		GroupDomain:  domainKey(info),
+		GroupServer:  info.Server,
+		GroupInbound: info.Inbound,
+		GroupClient:  hostOf(info.Client),
+	}
+}
+
+// domainKey returns the key of a connection in the domain dimension, empty
+// until SetDomain while its domain is pending
+func domainKey(info *ConnInfo) string {
+	if info.DomainPending {
+		return ""
+	}
+	return hostOf(info.Target)
+}
+
+// hostOf returns the host of a host:port address
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return strings.ToLower(host)
+	}
+	return addr
+}
+
+// recordGroupConnection counts a new connection in every dimension (mu must be held)
+func (c *Collector) recordGroupConnection(t *TrackedConn) {
+	for dim, key := range t.groupKeys {
+		if key != "" {
+			c.groups[dim].get(key).Connections++
+		}
+	}
+}
+
+// SetDomain records the sniffed destination domain of a connection tracked
+// with DomainPending, or keeps the host of its target if domain is empty.
+// The connection is counted in the domain dimension from then on.
+func (t *TrackedConn) SetDomain(domain string) {
+	key := strings.ToLower(domain)
+	if key == "" {
+		key = hostOf(t.info.Target)
+	}
+
+	c := t.collector
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.groupKeys[GroupDomain] != "" {
+		return
+	}
+	t.groupKeys[GroupDomain] = key
+	c.groups[GroupDomain].get(key).Connections++
+}
+
+// recordTraffic adds bytes moved by a connection to the per-key statistics
+// and to the quota usage of its server and user
+func (c *Collector) recordTraffic(t *TrackedConn, sent, received int64) {
+	if sent+received <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for dim, key := range t.groupKeys {
+		if key == "" {
+			continue
+		}
+		g := c.groups[dim]
+		g.addBytes(g.get(key), sent, received)
+	}
+	c.addUsage(&t.info, now, sent+received)
+}
+
+// Groups returns the top n keys (all if n <= 0) by traffic of a dimension
+func (c *Collector) Groups(dim string, n int) ([]GroupStats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	g, ok := c.groups[dim]
+	if !ok {
+		return nil, fmt.Errorf("unknown group %q (want %s)", dim, strings.Join(GroupDimensions, ", "))
+	}
+	return g.top(n), nil
+}
@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/xrdavies/light-ss/internal/events"
+)
+
+func TestTrafficGroupsEviction(t *testing.T) {
+	g := newTrafficGroups()
+	for i := 0; i < maxGroupEntries; i++ {
+		key := fmt.Sprintf("key%d", i)
+		g.addBytes(g.get(key), int64(i+1), 0)
+	}
+
+	// A new key replaces the smallest entry (key0) and keeps its count
+	heavy := g.get("heavy")
+	if len(g.entries) != maxGroupEntries {
+		t.Fatalf("entries = %d, want %d", len(g.entries), maxGroupEntries)
+	}
+	if _, ok := g.entries["key0"]; ok {
+		t.Error("smallest entry key0 was not evicted")
+	}
+	if heavy.total() != 1 || heavy.ErrorBytes != 1 {
+		t.Errorf("new entry total = %d, error = %d, want the evicted count 1", heavy.total(), heavy.ErrorBytes)
+	}
+
+	// The next new key must not evict the one just inserted once it has traffic
+	g.addBytes(heavy, 0, 1<<20)
+	g.get("other")
+	if _, ok := g.entries["heavy"]; !ok {
+		t.Fatal("heavy hitter was evicted")
+	}
+	if _, ok := g.entries["key1"]; ok {
+		t.Error("smallest entry key1 was not evicted")
+	}
+
+	top := g.top(1)
+	if len(top) != 1 || top[0].Key != "heavy" || top[0].BytesReceived != 1<<20 {
+		t.Errorf("top = %+v, want heavy first", top)
+	}
+}
+
+func TestTrafficGroupsKeepTotal(t *testing.T) {
+	g := newTrafficGroups()
+	rng := rand.New(rand.NewSource(1))
+
+	// Space-saving never loses counts: the entries add up to all traffic
+	var total int64
+	for i := 0; i < 20*maxGroupEntries; i++ {
+		key := fmt.Sprintf("key%d", rng.Intn(5*maxGroupEntries))
+		n := int64(rng.Intn(1000) + 1)
+		g.addBytes(g.get(key), n, 0)
+		total += n
+	}
+
+	var sum int64
+	for _, e := range g.entries {
+		sum += e.total()
+	}
+	if sum != total {
+		t.Errorf("entries add up to %d bytes, want %d", sum, total)
+	}
+
+	for i, e := range g.heap {
+		if e.index != i {
+			t.Fatalf("heap entry %d has index %d", i, e.index)
+		}
+		if i > 0 && g.heap[(i-1)/2].total() > e.total() {
+			t.Fatalf("heap order violated at %d", i)
+		}
+	}
+}
+
+func TestGroupsSniffedDomain(t *testing.T) {
+	c := NewCollector(events.NewBus())
+	defer c.Stop()
+
+	track := func(target string, pending bool) *TrackedConn {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { conn.Close(); peer.Close() })
+		return NewTrackedConn(conn, c, ConnInfo{ProxyType: "socks5", Target: target, DomainPending: pending})
+	}
+
+	sniffed := track("192.0.2.1:443", true)
+	sniffed.SetDomain("Example.com")
+	sniffed.AddBytes(100, 200)
+
+	kept := track("192.0.2.2:443", true)
+	kept.SetDomain("")
+	kept.AddBytes(10, 0)
+
+	plain := track("example.com:80", false)
+	plain.AddBytes(1, 0)
+
+	groups, err := c.Groups(GroupDomain, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]GroupStats)
+	for _, g := range groups {
+		got[g.Key] = g
+	}
+	if len(got) != 2 {
+		t.Errorf("domain groups %+v, want example.com and 192.0.2.2 only", groups)
+	}
+	if g := got["example.com"]; g.Connections != 2 || g.BytesSent != 101 || g.BytesReceived != 200 {
+		t.Errorf("example.com = %+v, want 2 connections, 101 bytes sent, 200 received", g)
+	}
+	if g := got["192.0.2.2"]; g.Connections != 1 || g.BytesSent != 10 {
+		t.Errorf("192.0.2.2 = %+v, want the IP kept without a sniffed domain", g)
+	}
+}
@@ -0,0 +1,268 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/atomicfile"
+)
+
+// History resolutions and how many points of each are kept
+const (
+	ResolutionMinute = "minute"
+	ResolutionHour   = "hour"
+
+	minutePoints = 24 * 60 // One day
+	hourPoints   = 30 * 24 // 30 days
+)
+
+// historySaveInterval is how often the history is written to its file
+const historySaveInterval = 5 * time.Minute
+
+// HistoryPoint is the traffic of one minute or hour
+type HistoryPoint struct {
+	Time              time.Time `json:"time"` // Start of the interval
+	Connections       int64     `json:"connections"`
+	Rejected          int64     `json:"rejected_connections"`
+	BytesSent         int64     `json:"bytes_sent"`
+	BytesReceived     int64     `json:"bytes_received"`
+	ActiveConnections int64     `json:"active_connections"` // Highest sampled value in the interval
+}
+
+// merge adds the counters of p to h, keeping the highest active count
+func (h *HistoryPoint) merge(p HistoryPoint) {
+	h.Connections += p.Connections
+	h.Rejected += p.Rejected
+	h.BytesSent += p.BytesSent
+	h.BytesReceived += p.BytesReceived
+	if p.ActiveConnections > h.ActiveConnections {
+		h.ActiveConnections = p.ActiveConnections
+	}
+}
+
+// historyState is the on-disk format of the history
+type historyState struct {
+	Minutes     []HistoryPoint `json:"minutes"`
+	Hours       []HistoryPoint `json:"hours"`
+	CurrentHour *HistoryPoint  `json:"current_hour,omitempty"`
+}
+
+// History rolls the collector's counters up into per-minute points for a
+// day and per-hour points for a month, optionally persisted to a file
+type History struct {
+	collector *Collector
+	file      string
+
+	mu          sync.RWMutex
+	minutes     []HistoryPoint
+	hours       []HistoryPoint
+	currentHour *HistoryPoint // Hour in progress, built from minutes
+
+	last HistoryPoint // Counter values at the last rollup (Time is unused)
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewHistory creates a history of the collector's counters and loads points
+// saved in file (no persistence if file is empty)
+func NewHistory(collector *Collector, file string) (*History, error) {
+	h := &History{
+		collector: collector,
+		file:      file,
+		done:      make(chan struct{}),
+	}
+	h.last = h.counters()
+
+	if file == "" {
+		return h, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read statistics history: %w", err)
+	}
+
+	var state historyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse statistics history %s: %w", file, err)
+	}
+
+	now := time.Now()
+	h.minutes = since(state.Minutes, now.Add(-minutePoints*time.Minute))
+	h.hours = since(state.Hours, now.Add(-hourPoints*time.Hour))
+	if state.CurrentHour != nil && state.CurrentHour.Time.Equal(now.Truncate(time.Hour)) {
+		h.currentHour = state.CurrentHour
+	} else if state.CurrentHour != nil {
+		h.hours = append(h.hours, *state.CurrentHour)
+	}
+	slog.Info("Statistics history restored", "file", file, "minutes", len(h.minutes), "hours", len(h.hours))
+
+	return h, nil
+}
+
+// since returns the points starting at or after cutoff
+func since(points []HistoryPoint, cutoff time.Time) []HistoryPoint {
+	for i, p := range points {
+		if !p.Time.Before(cutoff) {
+			return points[i:]
+		}
+	}
+	return nil
+}
+
+// counters returns the collector's cumulative counters
+func (h *History) counters() HistoryPoint {
+	return HistoryPoint{
+		Connections:       h.collector.totalConnections.Load(),
+		Rejected:          h.collector.rejectedConnections.Load(),
+		BytesSent:         h.collector.bytesSent.Load(),
+		BytesReceived:     h.collector.bytesReceived.Load(),
+		ActiveConnections: h.collector.activeConnections.Load(),
+	}
+}
+
+// Start records a point at the end of every minute and saves the history periodically
+func (h *History) Start() {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		// Wake up every second to sample active connections and notice minute boundaries
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		minute := time.Now().Truncate(time.Minute)
+		var peakActive int64
+		lastSave := time.Now()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				if active := h.collector.activeConnections.Load(); active > peakActive {
+					peakActive = active
+				}
+				if now.Truncate(time.Minute).Equal(minute) {
+					continue
+				}
+
+				h.rollup(minute, peakActive)
+				minute = now.Truncate(time.Minute)
+				peakActive = h.collector.activeConnections.Load()
+
+				if h.file != "" && now.Sub(lastSave) >= historySaveInterval {
+					if err := h.Save(); err != nil {
+						slog.Error("Failed to save statistics history", "error", err)
+					}
+					lastSave = now
+				}
+			case <-h.done:
+				// Keep the traffic of the minute in progress
+				h.rollup(minute, peakActive)
+				return
+			}
+		}
+	}()
+}
+
+// Stop records the minute in progress and saves the history a last time
+func (h *History) Stop() error {
+	close(h.done)
+	h.wg.Wait()
+	if h.file == "" {
+		return nil
+	}
+	return h.Save()
+}
+
+// rollup records the traffic since the last rollup as the point of minute
+func (h *History) rollup(minute time.Time, peakActive int64) {
+	current := h.counters()
+	point := HistoryPoint{
+		Time:              minute,
+		Connections:       current.Connections - h.last.Connections,
+		Rejected:          current.Rejected - h.last.Rejected,
+		BytesSent:         current.BytesSent - h.last.BytesSent,
+		BytesReceived:     current.BytesReceived - h.last.BytesReceived,
+		ActiveConnections: peakActive,
+	}
+	h.last = current
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// A restart within a minute continues its point
+	if n := len(h.minutes); n > 0 && h.minutes[n-1].Time.Equal(minute) {
+		h.minutes[n-1].merge(point)
+	} else {
+		h.minutes = append(h.minutes, point)
+	}
+	if len(h.minutes) > minutePoints {
+		h.minutes = h.minutes[len(h.minutes)-minutePoints:]
+	}
+
+	hour := minute.Truncate(time.Hour)
+	if h.currentHour != nil && !h.currentHour.Time.Equal(hour) {
+		h.hours = append(h.hours, *h.currentHour)
+		if len(h.hours) > hourPoints {
+			h.hours = h.hours[len(h.hours)-hourPoints:]
+		}
+		h.currentHour = nil
+	}
+	if h.currentHour == nil {
+		h.currentHour = &HistoryPoint{Time: hour}
+	}
+	h.currentHour.merge(point)
+}
+
+// Query returns the points of a resolution whose interval starts within
+// [from, to]. Hourly results include the hour in progress.
+func (h *History) Query(resolution string, from, to time.Time) ([]HistoryPoint, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var points []HistoryPoint
+	switch resolution {
+	case ResolutionMinute:
+		points = h.minutes
+	case ResolutionHour:
+		points = h.hours
+		if h.currentHour != nil {
+			points = append(points[:len(points):len(points)], *h.currentHour)
+		}
+	default:
+		return nil, fmt.Errorf("unknown resolution %q (want %s or %s)", resolution, ResolutionMinute, ResolutionHour)
+	}
+
+	result := []HistoryPoint{}
+	for _, p := range points {
+		if !p.Time.Before(from) && !p.Time.After(to) {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// Save writes the history to its file
+func (h *History) Save() error {
+	h.mu.RLock()
+	state := historyState{
+		Minutes:     h.minutes,
+		Hours:       h.hours,
+		CurrentHour: h.currentHour,
+	}
+	data, err := json.Marshal(state)
+	h.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(h.file, data, 0600)
+}
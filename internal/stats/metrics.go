@@ -0,0 +1,155 @@
+package stats
+
+import (
+	"sort"
+	"time"
+
+	"github.com/xrdavies/light-ss/internal/events"
+)
+
+// DialLatencyBuckets are the upper bounds in seconds of the dial latency histogram
+var DialLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ConnLabels identifies a group of connections in the metrics
+type ConnLabels struct {
+	ProxyType string
+	Inbound   string
+	Server    string
+}
+
+// ConnCount counts the connections of a group
+type ConnCount struct {
+	ConnLabels
+	Total  int64
+	Active int64
+}
+
+// Histogram is a cumulative histogram snapshot in the Prometheus style
+type Histogram struct {
+	Buckets []float64 // Upper bounds
+	Counts  []int64   // Observations <= the bound of the same index
+	Count   int64
+	Sum     float64
+}
+
+// observe adds a value to the histogram
+func (h *Histogram) observe(v float64) {
+	for i, bound := range h.Buckets {
+		if v <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += v
+}
+
+// DialStats holds the upstream dial measurements of a server
+type DialStats struct {
+	Server         string
+	Latency        Histogram        // Successful dials
+	Errors         map[string]int64 // Failed dials by reason
+	PluginFailures int64            // Failed plugin handshakes
+	Healthy        bool             // Whether the last dial succeeded
+}
+
+// ServerHealth is the data of a server_health event
+type ServerHealth struct {
+	Server  string `json:"server"`
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"` // Why the failed dial failed
+}
+
+// Metrics is a snapshot of the labeled counters exported to Prometheus
+type Metrics struct {
+	Connections []ConnCount
+	Dials       []DialStats
+}
+
+// connCount returns the counters of a group, creating them if needed (mu must be held)
+func (c *Collector) connCount(labels ConnLabels) *ConnCount {
+	n, ok := c.connCounts[labels]
+	if !ok {
+		n = &ConnCount{ConnLabels: labels}
+		c.connCounts[labels] = n
+	}
+	return n
+}
+
+// dialStats returns the dial measurements of a server, creating them if needed (mu must be held)
+func (c *Collector) dialStats(server string) *DialStats {
+	d, ok := c.dials[server]
+	if !ok {
+		d = &DialStats{
+			Server: server,
+			Latency: Histogram{
+				Buckets: DialLatencyBuckets,
+				Counts:  make([]int64, len(DialLatencyBuckets)),
+			},
+			Errors:  make(map[string]int64),
+			Healthy: true,
+		}
+		c.dials[server] = d
+	}
+	return d
+}
+
+// RecordDial records an upstream dial to server. reason is empty on success
+// and classifies the error otherwise. A server_health event is published
+// when a server starts failing or recovers.
+func (c *Collector) RecordDial(server string, latency time.Duration, reason string) {
+	c.mu.Lock()
+	d := c.dialStats(server)
+	if reason == "" {
+		d.Latency.observe(latency.Seconds())
+	} else {
+		d.Errors[reason]++
+	}
+	healthy := reason == ""
+	changed := d.Healthy != healthy
+	d.Healthy = healthy
+	c.mu.Unlock()
+
+	if changed {
+		c.events.Publish(events.TypeServerHealth, ServerHealth{Server: server, Healthy: healthy, Reason: reason})
+	}
+}
+
+// RecordPluginFailure records a failed plugin handshake with server
+func (c *Collector) RecordPluginFailure(server string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dialStats(server).PluginFailures++
+}
+
+// Metrics returns the labeled counters sorted by their labels
+func (c *Collector) Metrics() Metrics {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var m Metrics
+	for _, n := range c.connCounts {
+		m.Connections = append(m.Connections, *n)
+	}
+	for _, d := range c.dials {
+		snapshot := *d
+		snapshot.Latency.Counts = append([]int64(nil), d.Latency.Counts...)
+		snapshot.Errors = make(map[string]int64, len(d.Errors))
+		for reason, n := range d.Errors {
+			snapshot.Errors[reason] = n
+		}
+		m.Dials = append(m.Dials, snapshot)
+	}
+
+	sort.Slice(m.Connections, func(i, j int) bool {
+		a, b := m.Connections[i], m.Connections[j]
+		if a.ProxyType != b.ProxyType {
+			return a.ProxyType < b.ProxyType
+		}
+		if a.Inbound != b.Inbound {
+			return a.Inbound < b.Inbound
+		}
+		return a.Server < b.Server
+	})
+	sort.Slice(m.Dials, func(i, j int) bool { return m.Dials[i].Server < m.Dials[j].Server })
+	return m
+}
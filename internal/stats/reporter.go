@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"strings"
 	"time"
 )
 
@@ -60,6 +61,7 @@ func (r *Reporter) report() {
 		"active_connections", stats.ActiveConnections,
 		"http_connections", stats.HTTPConnections,
 		"socks5_connections", stats.SOCKS5Connections,
+		"rejected_connections", stats.RejectedConnections,
 		"bytes_sent", formatBytes(stats.BytesSent),
 		"bytes_received", formatBytes(stats.BytesReceived),
 		"upload_speed", formatSpeed(stats.UploadSpeed),
@@ -67,6 +69,17 @@ func (r *Reporter) report() {
 		"uptime", stats.Uptime.Round(time.Second).String(),
 	}
 
+	if len(stats.CloseReasons) > 0 {
+		logAttrs = append(logAttrs, "close_reasons", stats.CloseReasons)
+	}
+
+	// Heaviest keys per dimension, e.g. top_domain="example.com=12.0 MB, google.com=1.1 MB"
+	for _, dim := range GroupDimensions {
+		if top := formatGroups(r.collector, dim); top != "" {
+			logAttrs = append(logAttrs, "top_"+dim, top)
+		}
+	}
+
 	// Add instance name if configured
 	if r.instanceName != "" {
 		logAttrs = append([]any{"instance", r.instanceName}, logAttrs...)
@@ -75,6 +88,23 @@ func (r *Reporter) report() {
 	slog.Info("Statistics", logAttrs...)
 }
 
+// reportTopN is how many keys per dimension the reporter logs
+const reportTopN = 5
+
+// formatGroups formats the top keys of a dimension with their traffic
+func formatGroups(collector *Collector, dim string) string {
+	groups, err := collector.Groups(dim, reportTopN)
+	if err != nil {
+		return ""
+	}
+
+	parts := make([]string, 0, len(groups))
+	for _, g := range groups {
+		parts = append(parts, g.Key+"="+formatBytes(g.total()))
+	}
+	return strings.Join(parts, ", ")
+}
+
 // formatSpeed formats speed into a human-readable string
 func formatSpeed(bytesPerSec int64) string {
 	const unit = 1024
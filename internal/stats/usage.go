@@ -0,0 +1,119 @@
+package stats
+
+import "time"
+
+// Period formats of the quota counters, in local time
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+)
+
+// Usage counts the traffic (sent plus received) of a server or user in the
+// current day and month
+type Usage struct {
+	Day        string `json:"day"` // YYYY-MM-DD
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"` // YYYY-MM
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// add records n bytes at now, starting new periods as needed
+func (u *Usage) add(now time.Time, n int64) {
+	u.roll(now)
+	u.DayBytes += n
+	u.MonthBytes += n
+}
+
+// roll resets the counters of periods that have ended
+func (u *Usage) roll(now time.Time) {
+	if day := now.Format(dayFormat); u.Day != day {
+		u.Day = day
+		u.DayBytes = 0
+	}
+	if month := now.Format(monthFormat); u.Month != month {
+		u.Month = month
+		u.MonthBytes = 0
+	}
+}
+
+// UsageState is the traffic usage of all servers and users
+type UsageState struct {
+	Servers map[string]Usage `json:"servers"`
+	Users   map[string]Usage `json:"users"`
+}
+
+// addUsage adds n bytes to the usage of the connection's server and user (mu must be held)
+func (c *Collector) addUsage(info *ConnInfo, now time.Time, n int64) {
+	if info.Server != "" {
+		c.usage(c.serverUsage, info.Server).add(now, n)
+	}
+	if info.User != "" {
+		c.usage(c.userUsage, info.User).add(now, n)
+	}
+}
+
+// usage returns the counters for name, creating them if needed (mu must be held)
+func (c *Collector) usage(m map[string]*Usage, name string) *Usage {
+	u, ok := m[name]
+	if !ok {
+		u = &Usage{}
+		m[name] = u
+	}
+	return u
+}
+
+// ServerUsage returns the current traffic usage of an upstream server
+func (c *Collector) ServerUsage(name string) Usage {
+	return c.currentUsage(c.serverUsage, name)
+}
+
+// UserUsage returns the current traffic usage of a proxy user
+func (c *Collector) UserUsage(name string) Usage {
+	return c.currentUsage(c.userUsage, name)
+}
+
+// currentUsage returns the counters for name in the current periods
+func (c *Collector) currentUsage(m map[string]*Usage, name string) Usage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var u Usage
+	if cur, ok := m[name]; ok {
+		u = *cur
+	}
+	u.roll(time.Now())
+	return u
+}
+
+// UsageState returns the usage of all servers and users
+func (c *Collector) UsageState() UsageState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := UsageState{
+		Servers: make(map[string]Usage, len(c.serverUsage)),
+		Users:   make(map[string]Usage, len(c.userUsage)),
+	}
+	for name, u := range c.serverUsage {
+		state.Servers[name] = *u
+	}
+	for name, u := range c.userUsage {
+		state.Users[name] = *u
+	}
+	return state
+}
+
+// RestoreUsage replaces the usage counters, e.g. with state saved before a restart
+func (c *Collector) RestoreUsage(state UsageState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, u := range state.Servers {
+		u := u
+		c.serverUsage[name] = &u
+	}
+	for name, u := range state.Users {
+		u := u
+		c.userUsage[name] = &u
+	}
+}
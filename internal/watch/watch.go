@@ -0,0 +1,129 @@
+// Package watch reports changes to the content of a file, using inotify on
+// Linux and polling elsewhere.
+package watch
+
+import (
+	"crypto/sha256"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often the file is checked when inotify is not available
+const pollInterval = 2 * time.Second
+
+// Watcher reports when a file changed
+type Watcher struct {
+	path     string
+	debounce time.Duration
+	sum      [sha256.Size]byte // Content at the last report
+
+	events  chan struct{} // Possible changes from the platform watcher
+	changes chan struct{}
+	done    chan struct{}
+	stop    func() // Stops the platform watcher
+	wg      sync.WaitGroup
+}
+
+// File watches path. A change is reported once the file content differs and
+// no further event arrived for debounce, so editors writing in several steps
+// and replacing the file by rename cause a single report.
+func File(path string, debounce time.Duration) *Watcher {
+	w := &Watcher{
+		path:     path,
+		debounce: debounce,
+		events:   make(chan struct{}, 1),
+		changes:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	w.sum, _ = w.checksum()
+
+	stop, err := w.watch()
+	if err != nil {
+		slog.Info("File notifications not available, polling for changes", "file", path, "error", err)
+		stop = w.poll()
+	}
+	w.stop = stop
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w
+}
+
+// Changes delivers a value after each change of the file
+func (w *Watcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	close(w.done)
+	w.stop()
+	w.wg.Wait()
+	return nil
+}
+
+// notify records a possible change without blocking
+func (w *Watcher) notify() {
+	select {
+	case w.events <- struct{}{}:
+	default:
+	}
+}
+
+// run debounces events and reports content changes
+func (w *Watcher) run() {
+	defer w.wg.Done()
+
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.events:
+			timer.Reset(w.debounce)
+		case <-timer.C:
+			sum, err := w.checksum()
+			if err != nil || sum == w.sum {
+				continue // Missing while being replaced, or unchanged
+			}
+			w.sum = sum
+			select {
+			case w.changes <- struct{}{}:
+			default:
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// checksum hashes the file content
+func (w *Watcher) checksum() ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// poll checks the file periodically, for platforms without notifications
+func (w *Watcher) poll() func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.notify()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,42 @@
+package watch
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// watch subscribes to inotify events of the file's directory, as editors and
+// configuration managers often replace the file instead of writing to it
+func (w *Watcher) watch() (func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_CREATE |
+		syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_ATTRIB)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(w.path), mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// Non-blocking, so Close interrupts a pending Read
+	file := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			// Any event in the directory may be the file; run compares the content
+			if _, err := file.Read(buf); err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					slog.Error("Stopped watching file", "file", w.path, "error", err)
+				}
+				return
+			}
+			w.notify()
+		}
+	}()
+
+	return func() { file.Close() }, nil
+}
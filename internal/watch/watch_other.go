@@ -0,0 +1,10 @@
+//go:build !linux
+
+package watch
+
+import "errors"
+
+// watch is not implemented outside Linux, so the file is polled
+func (w *Watcher) watch() (func(), error) {
+	return nil, errors.New("not supported on this platform")
+}